@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"flag"
@@ -8,8 +9,12 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/shu8/linkener/internal/config"
 	"github.com/shu8/linkener/internal/db"
@@ -18,10 +23,14 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// How long to wait for in-flight requests when shutting down
+const shutdownTimeout = 10 * time.Second
+
 func setCORSHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, DNT, Referer, User-Agent")
+	w.Header().Set("Access-Control-Expose-Headers", "WWW-Authenticate")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, DNT, Referer, User-Agent")
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
@@ -56,6 +65,14 @@ func main() {
 		return
 	}
 
+	// registration_mode supersedes registration_enabled, which is kept for older config files
+	if config.Config.RegistrationMode == "" {
+		config.Config.RegistrationMode = "closed"
+		if config.Config.RegistrationEnabled {
+			config.Config.RegistrationMode = "open"
+		}
+	}
+
 	db.DBCon, err = sql.Open("sqlite3", config.Config.AuthDBLocation)
 	if err != nil {
 		db.DBCon.Close()
@@ -63,6 +80,20 @@ func main() {
 		return
 	}
 
+	err = db.Migrate()
+	if err != nil {
+		db.DBCon.Close()
+		log.Fatal("Failed to migrate auth database: " + err.Error())
+		return
+	}
+
+	err = db.PromoteAdmins(config.Config.AdminUsers)
+	if err != nil {
+		db.DBCon.Close()
+		log.Fatal("Failed to set up admin users: " + err.Error())
+		return
+	}
+
 	router := mux.NewRouter()
 
 	api := router.PathPrefix("/" + config.Config.APIRoot).Subrouter()
@@ -81,21 +112,80 @@ func main() {
 		log.Fatal("Error starting /urls: " + err.Error())
 	}
 
+	// Workspaces always need to know who the user is
+	workspaces := api.PathPrefix("/workspaces").Subrouter()
+	workspaces.Use(handlers.AuthMiddleware)
+
+	err = handlers.SetUpWorkspacesHandlers(workspaces)
+	if err != nil {
+		log.Fatal("Error starting /workspaces: " + err.Error())
+	}
+
+	webhooks := api.PathPrefix("/webhooks").Subrouter()
+	webhooks.Use(handlers.AuthMiddleware)
+
+	err = handlers.SetUpWebhooksHandlers(webhooks)
+	if err != nil {
+		log.Fatal("Error starting /webhooks: " + err.Error())
+	}
+
 	auth := api.PathPrefix("/auth").Subrouter()
 	err = handlers.SetUpAuthHandlers(auth)
 	if err != nil {
 		log.Fatal("Error starting /auth: " + err.Error())
 	}
 
-	router.PathPrefix("/" + config.Config.RedirectRoot).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handlers.ForwarderHandler(w, r)
-	})
+	err = handlers.StartWebhookWorkers()
+	if err != nil {
+		log.Fatal("Error starting webhook deliveries: " + err.Error())
+	}
+
+	err = handlers.StartTrashPurger()
+	if err != nil {
+		log.Fatal("Error starting trash purger: " + err.Error())
+	}
+
+	err = handlers.StartVisitCompactor()
+	if err != nil {
+		log.Fatal("Error starting visit rollups: " + err.Error())
+	}
 
-	fmt.Printf("Listening on port %d\n", config.Config.Port)
+	err = handlers.SetUpForwarderHandler(router.PathPrefix("/" + config.Config.RedirectRoot))
+	if err != nil {
+		log.Fatal("Error starting redirects: " + err.Error())
+	}
+
+	err = handlers.StartVisitRecorder()
+	if err != nil {
+		log.Fatal("Error starting visit recording: " + err.Error())
+	}
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", config.Config.Port), Handler: router}
 	if config.Config.PrivateAPI {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", config.Config.Port), router))
-	} else {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.Config.Port), router))
+		server.Addr = fmt.Sprintf("127.0.0.1:%d", config.Config.Port)
 	}
+
+	go func() {
+		fmt.Printf("Listening on port %d\n", config.Config.Port)
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Finish in-flight requests and write any buffered visits before exiting
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	fmt.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		println("Failed to shut down cleanly: " + err.Error())
+	}
+
+	handlers.StopVisitRecorder()
 	db.DBCon.Close()
 }
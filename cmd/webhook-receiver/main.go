@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// A small HTTP server that prints the webhooks Linkener sends it, for testing webhook subscriptions locally
+
+func main() {
+	var port int
+	var secret string
+	var status int
+	flag.IntVar(&port, "port", 4000, "port to listen on")
+	flag.StringVar(&secret, "secret", "", "the webhook's secret, to check signatures with")
+	flag.IntVar(&status, "status", http.StatusOK, "status code to respond with, e.g. 500 to test retries")
+	flag.Parse()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		signature := "not checked"
+		if secret != "" {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(body)
+			expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+			signature = "invalid"
+			if hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Linkener-Signature"))) {
+				signature = "valid"
+			}
+		}
+
+		fmt.Printf("%s delivery %s (signature %s): %s\n", r.Header.Get("X-Linkener-Event"), r.Header.Get("X-Linkener-Delivery"), signature, body)
+		w.WriteHeader(status)
+	})
+
+	fmt.Printf("Listening for webhooks on port %d\n", port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+}
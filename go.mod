@@ -3,6 +3,8 @@ module github.com/shu8/linkener
 go 1.15
 
 require (
+	github.com/go-asn1-ber/asn1-ber v1.5.1
+	github.com/go-ldap/ldap/v3 v3.2.4
 	github.com/gorilla/mux v1.8.0
 	github.com/mattn/go-sqlite3 v1.14.2
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
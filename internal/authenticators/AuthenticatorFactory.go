@@ -0,0 +1,14 @@
+package authenticators
+
+import "errors"
+
+// AuthenticatorFactory - generate Authenticator instance given user's setting
+func AuthenticatorFactory(authBackend string) (Authenticator, error) {
+	switch authBackend {
+	case "local":
+		return LocalAuthenticator{}, nil
+	case "ldap":
+		return LDAPAuthenticator{}, nil
+	}
+	return nil, errors.New("Unknown auth backend")
+}
@@ -0,0 +1,167 @@
+package authenticators
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/db"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPAuthenticator - checks credentials by binding to an LDAP directory as the user
+type LDAPAuthenticator struct{}
+
+func connectLDAP() (*ldap.Conn, error) {
+	ldapConfig := config.Config.LDAP
+	tlsConfig := &tls.Config{InsecureSkipVerify: ldapConfig.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(ldapConfig.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		println(err.Error())
+		return nil, errors.New("Unable to connect to LDAP server")
+	}
+
+	if ldapConfig.StartTLS {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			println(err.Error())
+			return nil, errors.New("Unable to connect to LDAP server")
+		}
+	}
+
+	return conn, nil
+}
+
+// findUserDN - look up the user's entry as the service account (or anonymously if no bind_dn is configured)
+func findUserDN(conn *ldap.Conn, username string) (string, error) {
+	ldapConfig := config.Config.LDAP
+	var err error
+	if ldapConfig.BindDN != "" {
+		err = conn.Bind(ldapConfig.BindDN, ldapConfig.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		println(err.Error())
+		return "", errors.New("Unable to bind to LDAP server")
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		ldapConfig.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(ldapConfig.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn"}, nil,
+	))
+	if err != nil {
+		println(err.Error())
+		return "", errors.New("Unable to search LDAP directory")
+	}
+
+	if len(result.Entries) != 1 {
+		return "", ErrInvalidCredentials
+	}
+
+	return result.Entries[0].DN, nil
+}
+
+// roleForUser - the role of the first group in group_roles that the user is a member of, or "" if group_roles isn't
+// configured, in which case roles are managed in Linkener instead
+func roleForUser(conn *ldap.Conn, userDN string) (string, error) {
+	ldapConfig := config.Config.LDAP
+	if ldapConfig.GroupBaseDN == "" || len(ldapConfig.GroupRoles) == 0 {
+		return "", nil
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		ldapConfig.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(ldapConfig.GroupFilter, ldap.EscapeFilter(userDN)),
+		[]string{"dn"}, nil,
+	))
+	if err != nil {
+		println(err.Error())
+		return "", errors.New("Unable to search LDAP directory")
+	}
+
+	// Prefer admin if the user is in several mapped groups
+	role := "user"
+	for _, entry := range result.Entries {
+		entryDN, err := ldap.ParseDN(entry.DN)
+		if err != nil {
+			continue
+		}
+
+		for groupDN, groupRole := range ldapConfig.GroupRoles {
+			parsedGroupDN, err := ldap.ParseDN(groupDN)
+			if err == nil && parsedGroupDN.Equal(entryDN) && role != "admin" {
+				role = groupRole
+			}
+		}
+	}
+
+	return role, nil
+}
+
+// Authenticate - bind as the user, then record them (and their role) in the users table so access tokens can refer to them
+func (e LDAPAuthenticator) Authenticate(username, password string) (*User, error) {
+	// An empty password would be an unauthenticated bind, which many servers accept
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := connectLDAP()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	userDN, err := findUserDN(conn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.Bind(userDN, password)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		println(err.Error())
+		return nil, errors.New("Unable to bind to LDAP server")
+	}
+
+	role, err := roleForUser(conn, userDN)
+	if err != nil {
+		return nil, err
+	}
+
+	role, err = recordLDAPUser(username, role)
+	if err != nil {
+		println(err.Error())
+		return nil, errors.New("Failed to authenticate user")
+	}
+
+	return &User{Username: username, Role: role}, nil
+}
+
+// recordLDAPUser - add the user to the users table if they aren't already, returning their role. If the directory's
+// groups decide the user's role, it's updated; otherwise new users are given the user role, and existing users keep
+// whatever role they've been given in Linkener
+func recordLDAPUser(username, role string) (string, error) {
+	// No local password: the directory is the source of truth
+	if role != "" {
+		_, err := db.DBCon.Exec(`insert into users(username, password, role) values(?, '', ?)
+			on conflict(username) do update set role=excluded.role`, username, role)
+		return role, err
+	}
+
+	_, err := db.DBCon.Exec(`insert into users(username, password, role) values(?, '', 'user')
+		on conflict(username) do nothing`, username)
+	if err != nil {
+		return "", err
+	}
+
+	err = db.DBCon.QueryRow("select role from users where username=?", username).Scan(&role)
+	return role, err
+}
@@ -0,0 +1,237 @@
+package authenticators
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/db"
+)
+
+const (
+	testBaseDN      = "ou=people,dc=example,dc=com"
+	testGroupBaseDN = "ou=groups,dc=example,dc=com"
+	testAdminsDN    = "cn=admins," + testGroupBaseDN
+)
+
+// mockLDAPServer - an in-process LDAP directory that answers simple binds and the equality searches the LDAP
+// authenticator makes, for users (DN -> password) and groups (DN -> member DNs)
+type mockLDAPServer struct {
+	listener net.Listener
+	users    map[string]string
+	groups   map[string][]string
+}
+
+func newMockLDAPServer(t *testing.T) *mockLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &mockLDAPServer{listener: listener, users: map[string]string{}, groups: map[string][]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *mockLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value
+		request := packet.Children[1]
+
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, _ := request.Children[1].Value.(string)
+			password := request.Children[2].Data.String()
+			code := ldap.LDAPResultSuccess
+			if dn != "" && (password == "" || s.users[dn] != password) {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			s.respond(conn, messageID, ldap.ApplicationBindResponse, code)
+		case ldap.ApplicationSearchRequest:
+			for _, dn := range s.search(request) {
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+				entry.AppendChild(ber.NewSequence("Attributes"))
+				s.write(conn, messageID, entry)
+			}
+			s.respond(conn, messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+		default:
+			return
+		}
+	}
+}
+
+// search - the DNs of the users or groups matching a search request's (attribute=value) filter
+func (s *mockLDAPServer) search(request *ber.Packet) []string {
+	base, _ := request.Children[0].Value.(string)
+	filter := request.Children[6]
+	if len(filter.Children) != 2 {
+		return nil
+	}
+	value, _ := filter.Children[1].Value.(string)
+
+	dns := []string{}
+	if base == testBaseDN {
+		if _, ok := s.users["uid="+value+","+testBaseDN]; ok {
+			dns = append(dns, "uid="+value+","+testBaseDN)
+		}
+	} else if base == testGroupBaseDN {
+		for groupDN, members := range s.groups {
+			for _, member := range members {
+				if member == value {
+					dns = append(dns, groupDN)
+				}
+			}
+		}
+	}
+	return dns
+}
+
+func (s *mockLDAPServer) respond(conn net.Conn, messageID interface{}, tag ber.Tag, code int) {
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic message"))
+	s.write(conn, messageID, response)
+}
+
+func (s *mockLDAPServer) write(conn net.Conn, messageID interface{}, op *ber.Packet) {
+	packet := ber.NewSequence("LDAP message")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
+
+// setUpMockLDAP - point the LDAP config and db.DBCon at a new mock directory and auth database
+func setUpMockLDAP(t *testing.T) *mockLDAPServer {
+	schema, err := ioutil.ReadFile(filepath.Join("..", "..", "schema.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	con, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { con.Close() })
+
+	// schema.sql is written for the sqlite3 shell, so leave out its dot commands
+	statements := []string{}
+	for _, line := range strings.Split(string(schema), "\n") {
+		if !strings.HasPrefix(line, ".") {
+			statements = append(statements, line)
+		}
+	}
+	_, err = con.Exec(strings.Join(statements, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DBCon = con
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newMockLDAPServer(t)
+	server.users["uid=alice,"+testBaseDN] = "secret"
+
+	oldConfig := config.Config
+	t.Cleanup(func() { config.Config = oldConfig })
+	config.Config.LDAP.URL = "ldap://" + server.listener.Addr().String()
+	config.Config.LDAP.StartTLS = false
+	config.Config.LDAP.BindDN = ""
+	config.Config.LDAP.BaseDN = testBaseDN
+	config.Config.LDAP.UserFilter = "(uid=%s)"
+	config.Config.LDAP.GroupBaseDN = ""
+	config.Config.LDAP.GroupFilter = "(member=%s)"
+	config.Config.LDAP.GroupRoles = nil
+	return server
+}
+
+func authenticateRole(t *testing.T, username, password string) string {
+	user, err := LDAPAuthenticator{}.Authenticate(username, password)
+	if err != nil {
+		t.Fatalf("authenticating %s: %v", username, err)
+	}
+
+	var role string
+	err = db.DBCon.QueryRow("select role from users where username=?", username).Scan(&role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != user.Role {
+		t.Errorf("authenticated as role %q, but stored role is %q", user.Role, role)
+	}
+	return role
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	setUpMockLDAP(t)
+
+	for _, password := range []string{"wrong", ""} {
+		_, err := LDAPAuthenticator{}.Authenticate("alice", password)
+		if err != ErrInvalidCredentials {
+			t.Errorf("authenticating with password %q: got error %v, want %v", password, err, ErrInvalidCredentials)
+		}
+	}
+	_, err := LDAPAuthenticator{}.Authenticate("bob", "secret")
+	if err != ErrInvalidCredentials {
+		t.Errorf("authenticating unknown user: got error %v, want %v", err, ErrInvalidCredentials)
+	}
+
+	if role := authenticateRole(t, "alice", "secret"); role != "user" {
+		t.Errorf("first login: got role %q, want user", role)
+	}
+}
+
+func TestLDAPKeepsLinkenerRoles(t *testing.T) {
+	setUpMockLDAP(t)
+	authenticateRole(t, "alice", "secret")
+
+	_, err := db.DBCon.Exec("update users set role='admin' where username='alice'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if role := authenticateRole(t, "alice", "secret"); role != "admin" {
+		t.Errorf("login after promotion without group_roles: got role %q, want admin", role)
+	}
+}
+
+func TestLDAPGroupRoles(t *testing.T) {
+	server := setUpMockLDAP(t)
+	config.Config.LDAP.GroupBaseDN = testGroupBaseDN
+	config.Config.LDAP.GroupRoles = map[string]string{testAdminsDN: "admin"}
+
+	server.groups[testAdminsDN] = []string{"uid=alice," + testBaseDN}
+	if role := authenticateRole(t, "alice", "secret"); role != "admin" {
+		t.Errorf("login in admins group: got role %q, want admin", role)
+	}
+
+	// group_roles is authoritative, so leaving the group demotes the user
+	server.groups[testAdminsDN] = nil
+	if role := authenticateRole(t, "alice", "secret"); role != "user" {
+		t.Errorf("login after leaving admins group: got role %q, want user", role)
+	}
+}
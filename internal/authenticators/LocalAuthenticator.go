@@ -0,0 +1,37 @@
+package authenticators
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/shu8/linkener/internal/db"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LocalAuthenticator - checks credentials against the bcrypt passwords in the auth database's users table
+type LocalAuthenticator struct{}
+
+// Authenticate - check the user's password
+func (e LocalAuthenticator) Authenticate(username, password string) (*User, error) {
+	var dbUsername, dbPassword, role string
+	err := db.DBCon.QueryRow("select username, password, role from users where username=?", username).Scan(&dbUsername, &dbPassword, &role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidCredentials
+		}
+		println(err.Error())
+		return nil, errors.New("Failed to authenticate user")
+	}
+
+	// Users without a password (e.g. from single sign-on) can't log in this way
+	if dbPassword == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(dbPassword), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &User{Username: dbUsername, Role: role}, nil
+}
@@ -0,0 +1,17 @@
+package authenticators
+
+import "errors"
+
+// ErrInvalidCredentials - returned by an Authenticator when the username or password is wrong
+var ErrInvalidCredentials = errors.New("Invalid credentials")
+
+// Authenticator - interface for all ways of checking a user's login credentials (e.g. local users table/LDAP)
+type Authenticator interface {
+	Authenticate(username, password string) (*User, error)
+}
+
+// User - an authenticated user
+type User struct {
+	Username string
+	Role     string
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LRU - a fixed size cache that evicts the least recently used entry when full, and forgets entries after a TTL.
+// It's safe for concurrent use
+type LRU struct {
+	size int
+	ttl  time.Duration
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	// Most recently used at the front
+	order *list.List
+}
+
+type entry struct {
+	key    string
+	value  interface{}
+	expiry time.Time
+}
+
+// NewLRU - a cache holding up to size entries, each for up to ttl
+func NewLRU(size int, ttl time.Duration) *LRU {
+	return &LRU{
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Get - the value for the key, if it's cached and hasn't expired
+func (c *LRU) Get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(element.Value.(*entry).expiry) {
+		c.remove(element)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*entry).value, true
+}
+
+// Set - cache the value for the key, evicting the least recently used entry if the cache is full
+func (c *LRU) Set(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+
+	c.entries[key] = c.order.PushFront(&entry{key: key, value: value, expiry: time.Now().Add(c.ttl)})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Update - replace the cached value for the key with update(value), keeping its expiry. Does nothing if it isn't cached
+func (c *LRU) Update(key string, update func(interface{}) interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*entry).value = update(element.Value.(*entry).value)
+	}
+}
+
+// Delete - forget the key
+func (c *LRU) Delete(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// Len - how many entries are cached, including any that have expired but not been evicted yet
+func (c *LRU) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
+
+func (c *LRU) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*entry).key)
+}
@@ -1,16 +1,104 @@
 package config
 
+type oidcConfig struct {
+	Enabled           bool     `json:"enabled"`
+	Issuer            string   `json:"issuer"`
+	ClientID          string   `json:"client_id"`
+	ClientSecret      string   `json:"client_secret,omitempty"`
+	RedirectURL       string   `json:"redirect_url"`
+	Scopes            []string `json:"scopes"`
+	UsernameClaim     string   `json:"username_claim"`
+	PostLoginRedirect string   `json:"post_login_redirect,omitempty"`
+	TrustProvider2FA  bool     `json:"trust_provider_2fa"`
+}
+
+type ldapConfig struct {
+	URL                string            `json:"url"`
+	StartTLS           bool              `json:"start_tls"`
+	InsecureSkipVerify bool              `json:"insecure_skip_verify"`
+	BindDN             string            `json:"bind_dn,omitempty"`
+	BindPassword       string            `json:"bind_password,omitempty"`
+	BaseDN             string            `json:"base_dn"`
+	UserFilter         string            `json:"user_filter"`
+	GroupBaseDN        string            `json:"group_base_dn,omitempty"`
+	GroupFilter        string            `json:"group_filter"`
+	GroupRoles         map[string]string `json:"group_roles,omitempty"`
+}
+
+type passwordPolicyConfig struct {
+	MinLength             int    `json:"min_length"`
+	BreachedPasswordsFile string `json:"breached_passwords_file,omitempty"`
+}
+
+type trashConfig struct {
+	Enabled       bool `json:"enabled"`
+	Retention     int  `json:"retention"`
+	PurgeInterval int  `json:"purge_interval"`
+}
+
+type visitBufferConfig struct {
+	Size          int    `json:"size"`
+	BatchSize     int    `json:"batch_size"`
+	FlushInterval int    `json:"flush_interval_ms"`
+	Overflow      string `json:"overflow"`
+}
+
+type visitRetentionConfig struct {
+	Days            int `json:"days"`
+	CompactInterval int `json:"compact_interval"`
+}
+
+type privacyConfig struct {
+	Enabled             bool   `json:"enabled"`
+	SaltRotation        int    `json:"salt_rotation"`
+	DoNotTrack          string `json:"do_not_track"`
+	StoreVisitorDetails bool   `json:"store_visitor_details"`
+}
+
+type botsConfig struct {
+	UserAgents []string `json:"user_agents"`
+	Response   string   `json:"response"`
+}
+
+type webhooksConfig struct {
+	AllowedNetworks   []string `json:"allowed_networks"`
+	DeliveryRetention int      `json:"delivery_retention"`
+	PruneInterval     int      `json:"prune_interval"`
+}
+
+type linkCacheConfig struct {
+	Size int `json:"size"`
+	TTL  int `json:"ttl"`
+}
+
 type configStructure struct {
-	StoreType           string `json:"store_type"`
-	PrivateAPI          bool   `json:"private_api"`
-	Port                int    `json:"port"`
-	AuthDBLocation      string `json:"auth_db_location"`
-	AuthEnabled         bool   `json:"auth_enabled"`
-	RegistrationEnabled bool   `json:"registration_enabled"`
-	APIRoot             string `json:"api_root"`
-	RedirectRoot        string `json:"redirect_root"`
-	JSONStoreLocation   string `json:"json_store_location,omitempty"`
-	SQLiteStoreLocation string `json:"sqlite_store_location,omitempty"`
+	StoreType           string               `json:"store_type"`
+	PrivateAPI          bool                 `json:"private_api"`
+	Port                int                  `json:"port"`
+	AuthDBLocation      string               `json:"auth_db_location"`
+	AuthEnabled         bool                 `json:"auth_enabled"`
+	RegistrationEnabled bool                 `json:"registration_enabled"`
+	RegistrationMode    string               `json:"registration_mode,omitempty"`
+	AdminUsers          []string             `json:"admin_users"`
+	Require2FA          bool                 `json:"require_2fa"`
+	PasswordPolicy      passwordPolicyConfig `json:"password_policy"`
+	AuthBackend         string               `json:"auth_backend"`
+	LDAP                ldapConfig           `json:"ldap"`
+	AccessTokenTTL      int                  `json:"access_token_ttl"`
+	RefreshTokenTTL     int                  `json:"refresh_token_ttl"`
+	OIDC                oidcConfig           `json:"oidc"`
+	APIRoot             string               `json:"api_root"`
+	RedirectRoot        string               `json:"redirect_root"`
+	JSONStoreLocation   string               `json:"json_store_location,omitempty"`
+	SQLiteStoreLocation string               `json:"sqlite_store_location,omitempty"`
+	Trash               trashConfig          `json:"trash"`
+	VisitBuffer         visitBufferConfig    `json:"visit_buffer"`
+	VisitRetention      visitRetentionConfig `json:"visit_retention"`
+	Privacy             privacyConfig        `json:"privacy"`
+	Bots                botsConfig           `json:"bots"`
+	LinkCache           linkCacheConfig      `json:"link_cache"`
+	Webhooks            webhooksConfig       `json:"webhooks"`
+	TemplateHeaders     []string             `json:"template_headers"`
 }
 
 // Config is the global config for the URL shortener, with the default values as follows
@@ -21,8 +109,60 @@ var Config = configStructure{
 	AuthDBLocation:      "/var/lib/linkener/auth.db",
 	AuthEnabled:         true,
 	RegistrationEnabled: true,
+	AdminUsers:          []string{},
+	Require2FA:          false,
+	PasswordPolicy: passwordPolicyConfig{
+		MinLength: 8,
+	},
+	AuthBackend: "local",
+	LDAP: ldapConfig{
+		URL:         "ldap://localhost:389",
+		UserFilter:  "(uid=%s)",
+		GroupFilter: "(member=%s)",
+	},
+	AccessTokenTTL:  60 * 60,
+	RefreshTokenTTL: 30 * 24 * 60 * 60,
+	OIDC: oidcConfig{
+		Enabled:       false,
+		Scopes:        []string{"openid", "email", "profile"},
+		UsernameClaim: "email",
+	},
 	APIRoot:             "api",
 	RedirectRoot:        "",
 	JSONStoreLocation:   "/var/lib/linkener/urls.json",
 	SQLiteStoreLocation: "/var/lib/linkener/urls.db",
+	Trash: trashConfig{
+		Enabled:       false,
+		Retention:     30 * 24 * 60 * 60,
+		PurgeInterval: 60 * 60,
+	},
+	VisitBuffer: visitBufferConfig{
+		Size:          10000,
+		BatchSize:     500,
+		FlushInterval: 1000,
+		Overflow:      "sync",
+	},
+	VisitRetention: visitRetentionConfig{
+		Days:            0,
+		CompactInterval: 60 * 60,
+	},
+	Privacy: privacyConfig{
+		Enabled:      false,
+		SaltRotation: 24 * 60 * 60,
+		DoNotTrack:   "anonymise",
+	},
+	Bots: botsConfig{
+		UserAgents: []string{},
+		Response:   "redirect",
+	},
+	LinkCache: linkCacheConfig{
+		Size: 10000,
+		TTL:  60,
+	},
+	Webhooks: webhooksConfig{
+		AllowedNetworks:   []string{},
+		DeliveryRetention: 7 * 24 * 60 * 60,
+		PruneInterval:     60 * 60,
+	},
+	TemplateHeaders: []string{"Accept-Language", "User-Agent", "Referer"},
 }
@@ -1,5 +1,199 @@
 package db
 
-import "database/sql"
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
 
+// DBCon - the shared connection to the auth database
 var DBCon *sql.DB
+
+// migrations are applied in order on top of schema.sql; the database's user_version records how many have run
+var migrations = []string{
+	// 1: allow multiple named, scoped access tokens per user
+	`CREATE TABLE access_tokens_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL,
+		access_token TEXT UNIQUE,
+		name TEXT NOT NULL DEFAULT '',
+		scope TEXT NOT NULL DEFAULT 'full',
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used DATETIME,
+		expiry DATETIME DEFAULT (datetime('now', '+1 hour'))
+	);
+	INSERT INTO access_tokens_new (username, access_token, expiry) SELECT username, access_token, expiry FROM access_tokens;
+	DROP TABLE access_tokens;
+	ALTER TABLE access_tokens_new RENAME TO access_tokens;
+	CREATE INDEX access_tokens_username ON access_tokens (username);`,
+	// 2: refresh tokens and non-expiring API keys
+	`CREATE TABLE refresh_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL,
+		refresh_token TEXT UNIQUE,
+		access_token_id INTEGER,
+		name TEXT NOT NULL DEFAULT '',
+		scope TEXT NOT NULL DEFAULT 'full',
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expiry DATETIME
+	);
+	ALTER TABLE access_tokens ADD COLUMN api_key INTEGER NOT NULL DEFAULT 0;`,
+	// 3: store only hashes of tokens; existing plaintext tokens can't be hashed in SQL, so they're invalidated
+	`DELETE FROM access_tokens;
+	DELETE FROM refresh_tokens;
+	ALTER TABLE access_tokens RENAME COLUMN access_token TO token_hash;
+	ALTER TABLE refresh_tokens RENAME COLUMN refresh_token TO token_hash;`,
+	// 4: user roles
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';`,
+	// 5: users logging in via an OpenID Connect identity provider
+	`CREATE TABLE oidc_identities (
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		username TEXT NOT NULL,
+		PRIMARY KEY (issuer, subject)
+	);`,
+	// 6: TOTP two-factor authentication
+	`ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL,
+		code_hash TEXT NOT NULL
+	);
+	CREATE INDEX recovery_codes_username ON recovery_codes (username);`,
+	// 7: admin-issued password reset codes
+	`CREATE TABLE password_reset_codes (
+		username TEXT PRIMARY KEY,
+		code_hash TEXT NOT NULL,
+		expiry DATETIME NOT NULL
+	);`,
+	// 8: invite codes for invite-only registration
+	`CREATE TABLE invites (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL,
+		code_hash TEXT NOT NULL UNIQUE,
+		role TEXT NOT NULL DEFAULT 'user',
+		max_uses INTEGER NOT NULL DEFAULT 1,
+		uses INTEGER NOT NULL DEFAULT 0,
+		date_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expiry DATETIME NOT NULL
+	);`,
+	// 9: workspaces for sharing links between users
+	`CREATE TABLE workspaces (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		date_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE workspace_members (
+		workspace_id INTEGER NOT NULL,
+		username TEXT NOT NULL,
+		permission TEXT NOT NULL DEFAULT 'edit',
+		PRIMARY KEY (workspace_id, username)
+	);
+	CREATE INDEX workspace_members_username ON workspace_members (username);`,
+	// 10: append-only audit log
+	`CREATE TABLE audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		before_json TEXT NOT NULL,
+		after_json TEXT NOT NULL
+	);
+	CREATE INDEX audit_log_actor ON audit_log (actor);
+	CREATE INDEX audit_log_target ON audit_log (target);
+	CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'The audit log is append-only');
+	END;
+	CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'The audit log is append-only');
+	END;`,
+	// 11: webhooks for link events, and a log of their deliveries
+	`CREATE TABLE webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL,
+		workspace_id INTEGER NOT NULL DEFAULT 0,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT 1,
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX webhooks_username ON webhooks (username);
+	CREATE INDEX webhooks_workspace_id ON webhooks (workspace_id);
+	CREATE TABLE webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		delivered BOOLEAN NOT NULL DEFAULT 0,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_attempt DATETIME
+	);
+	CREATE INDEX webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id);`,
+	// 12: back off after repeated wrong two-factor authentication codes
+	`ALTER TABLE users ADD COLUMN totp_failures INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN totp_locked_until INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// Migrate - bring the auth database schema up to date
+func Migrate() error {
+	var version int
+	err := DBCon.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		println(err.Error())
+		return errors.New("Unable to read auth database version")
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := DBCon.Begin()
+		if err != nil {
+			println(err.Error())
+			return errors.New("Unable to migrate auth database")
+		}
+
+		_, err = tx.Exec(migrations[i])
+		if err != nil {
+			println(err.Error())
+			tx.Rollback()
+			return fmt.Errorf("Unable to apply auth database migration %d", i+1)
+		}
+
+		// PRAGMA doesn't accept bound parameters
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		if err != nil {
+			println(err.Error())
+			tx.Rollback()
+			return fmt.Errorf("Unable to apply auth database migration %d", i+1)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			println(err.Error())
+			return fmt.Errorf("Unable to apply auth database migration %d", i+1)
+		}
+	}
+
+	return nil
+}
+
+// PromoteAdmins - give the admin role to the given (existing) users
+func PromoteAdmins(usernames []string) error {
+	for _, username := range usernames {
+		_, err := DBCon.Exec("UPDATE users SET role='admin' WHERE username=?", username)
+		if err != nil {
+			println(err.Error())
+			return errors.New("Unable to promote " + username + " to admin")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shu8/linkener/internal/db"
+	"github.com/shu8/linkener/internal/stores"
+)
+
+const defaultAuditLogLimit = 100
+const maxAuditLogLimit = 1000
+
+type auditEntry struct {
+	ID     int64           `json:"id"`
+	Time   time.Time       `json:"time"`
+	Actor  string          `json:"actor"`
+	Action string          `json:"action"`
+	Target string          `json:"target"`
+	IP     string          `json:"ip"`
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// auditURL - what the audit log records about a short URL; not its password hash or visits
+func auditURL(url stores.ShortURL) map[string]interface{} {
+	return map[string]interface{}{
+		"slug":               url.Slug,
+		"url":                url.URL,
+		"allowed_visits":     url.AllowedVisits,
+		"password_protected": url.Password != "",
+		"owner":              url.Owner,
+		"workspace":          url.Workspace,
+		"prefix":             url.Prefix,
+		"template":           url.Template,
+		"forward_query":      url.ForwardQuery,
+		"utm":                url.UTM,
+		"rules":              url.Rules,
+	}
+}
+
+// auditDiff - before and after as JSON, leaving out the fields that are the same in both
+func auditDiff(before, after interface{}) (string, string, error) {
+	beforeJSON, err := json.Marshal(before)
+	if err != nil {
+		return "", "", err
+	}
+
+	afterJSON, err := json.Marshal(after)
+	if err != nil {
+		return "", "", err
+	}
+
+	var beforeFields, afterFields map[string]interface{}
+	if json.Unmarshal(beforeJSON, &beforeFields) != nil || json.Unmarshal(afterJSON, &afterFields) != nil ||
+		beforeFields == nil || afterFields == nil {
+		return string(beforeJSON), string(afterJSON), nil
+	}
+
+	for field, value := range beforeFields {
+		if otherValue, ok := afterFields[field]; ok && reflect.DeepEqual(value, otherValue) {
+			delete(beforeFields, field)
+			delete(afterFields, field)
+		}
+	}
+
+	beforeJSON, err = json.Marshal(beforeFields)
+	if err == nil {
+		afterJSON, err = json.Marshal(afterFields)
+	}
+	return string(beforeJSON), string(afterJSON), err
+}
+
+// recordAudit - append an entry to the audit log for a request. The change has already happened by now, so failures
+// are only logged
+func recordAudit(r *http.Request, actor, action, target string, before, after interface{}) {
+	writeAudit(actor, action, target, requestIP(r), before, after)
+}
+
+// requestIP - the IP the request came from, without its port
+func requestIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// writeAudit - append an entry to the audit log; changes made by Linkener itself have no actor or IP
+func writeAudit(actor, action, target, ip string, before, after interface{}) {
+	beforeJSON, afterJSON, err := auditDiff(before, after)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+
+	_, err = db.DBCon.Exec("insert into audit_log(actor, action, target, ip, before_json, after_json) values(?, ?, ?, ?, ?, ?)",
+		actor, action, target, ip, beforeJSON, afterJSON)
+	if err != nil {
+		println("Failed to write to audit log: " + err.Error())
+	}
+}
+
+func auditLogHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Unauthorized access", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	conditions := []string{}
+	args := []interface{}{}
+
+	for _, field := range []string{"actor", "action", "target"} {
+		if query.Get(field) != "" {
+			conditions = append(conditions, field+"=?")
+			args = append(args, query.Get(field))
+		}
+	}
+
+	// Actions are namespaced, e.g. ?action_prefix=url. gets every short URL change
+	if query.Get("action_prefix") != "" {
+		conditions = append(conditions, "substr(action, 1, ?)=?")
+		args = append(args, len(query.Get("action_prefix")), query.Get("action_prefix"))
+	}
+
+	for param, condition := range map[string]string{"since": "time>=?", "until": "time<?"} {
+		if query.Get(param) == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, query.Get(param))
+		if err != nil {
+			http.Error(w, "Invalid "+param+" time, expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, condition)
+		args = append(args, t.UTC().Format(sqliteTimeFormat))
+	}
+
+	// For paging back through older entries
+	if query.Get("before_id") != "" {
+		beforeID, err := strconv.ParseInt(query.Get("before_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid before_id", http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, "id<?")
+		args = append(args, beforeID)
+	}
+
+	limit := defaultAuditLogLimit
+	if query.Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > maxAuditLogLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxAuditLogLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sqlQuery := "select id, time, actor, action, target, ip, before_json, after_json from audit_log"
+	if len(conditions) > 0 {
+		sqlQuery += " where " + strings.Join(conditions, " and ")
+	}
+	sqlQuery += " order by id desc limit ?"
+	args = append(args, limit)
+
+	rows, err := db.DBCon.Query(sqlQuery, args...)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []auditEntry{}
+	for rows.Next() {
+		var entry auditEntry
+		var before, after string
+		err := rows.Scan(&entry.ID, &entry.Time, &entry.Actor, &entry.Action, &entry.Target, &entry.IP, &before, &after)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+			return
+		}
+		entry.Before = json.RawMessage(before)
+		entry.After = json.RawMessage(after)
+		entries = append(entries, entry)
+	}
+
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/shu8/linkener/internal/db"
+)
+
+// auditEntries - the audit log entries for the action, oldest first
+func auditEntries(t *testing.T, action string) []auditEntry {
+	rows, err := db.DBCon.Query("select id, actor, target, before_json, after_json from audit_log where action=? order by id", action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	entries := []auditEntry{}
+	for rows.Next() {
+		entry := auditEntry{Action: action}
+		var before, after string
+		err := rows.Scan(&entry.ID, &entry.Actor, &entry.Target, &before, &after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Before, entry.After = json.RawMessage(before), json.RawMessage(after)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLogAppendOnly(t *testing.T) {
+	setUpTestAuthDB(t)
+	writeAudit("alice", "url.create", "example", "203.0.113.7", nil, map[string]string{"url": "https://example.com"})
+
+	for _, query := range []string{"update audit_log set actor='mallory'", "delete from audit_log"} {
+		if _, err := db.DBCon.Exec(query); err == nil {
+			t.Errorf("%q: succeeded, want it refused", query)
+		}
+	}
+
+	if entries := auditEntries(t, "url.create"); len(entries) != 1 || entries[0].Actor != "alice" {
+		t.Errorf("got entries %+v, want the original one", entries)
+	}
+}
+
+func TestAuditDiff(t *testing.T) {
+	before, after, err := auditDiff(map[string]interface{}{"url": "https://example.com", "owner": "alice"},
+		map[string]interface{}{"url": "https://example.org", "owner": "alice"})
+	if err != nil || before != `{"url":"https://example.com"}` || after != `{"url":"https://example.org"}` {
+		t.Errorf("got %s and %s and error %v, want only the changed url", before, after, err)
+	}
+
+	before, after, err = auditDiff(nil, map[string]string{"permission": "edit"})
+	if err != nil || before != "null" || after != `{"permission":"edit"}` {
+		t.Errorf("creation: got %s and %s and error %v", before, after, err)
+	}
+}
+
+func TestURLChangesAudited(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			setUpTestStore(t, storeType)
+			router := newTestRouter(t, storeType)
+			token := newTestUser(t, "alice", scopeFull)
+
+			for _, request := range []struct{ method, target, body string }{
+				{http.MethodPost, "/urls/", `{"url": "https://example.com", "slug": "example"}`},
+				{http.MethodPut, "/urls/example", `{"url": "https://example.org"}`},
+				{http.MethodDelete, "/urls/example", ""},
+			} {
+				if w := serveRoute(router, request.method, request.target, request.body, token); w.Code != http.StatusOK {
+					t.Fatalf("%s %s: got status %d: %s", request.method, request.target, w.Code, w.Body.String())
+				}
+			}
+
+			for action, want := range map[string]struct{ before, after string }{
+				"url.create": {"null", ""},
+				"url.update": {`{"url":"https://example.com"}`, `{"url":"https://example.org"}`},
+				"url.delete": {"", "null"},
+			} {
+				entries := auditEntries(t, action)
+				if len(entries) != 1 || entries[0].Actor != "alice" || entries[0].Target != "example" {
+					t.Errorf("%s: got entries %+v, want one by alice for example", action, entries)
+					continue
+				}
+				if (want.before != "" && string(entries[0].Before) != want.before) || (want.after != "" && string(entries[0].After) != want.after) {
+					t.Errorf("%s: got before %s and after %s, want %s and %s", action, entries[0].Before, entries[0].After, want.before, want.after)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditLogHandler(t *testing.T) {
+	setUpTestAuthDB(t)
+	user := newTestUser(t, "alice", scopeFull)
+	admin := newTestUser(t, "carol", scopeFull)
+	_, err := db.DBCon.Exec("update users set role=? where username='carol'", roleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAudit("alice", "url.create", "example", "", nil, nil)
+	writeAudit("alice", "url.delete", "example", "", nil, nil)
+	writeAudit("bob", "user.create", "bob", "", nil, nil)
+
+	if w := serveAuthorized(auditLogHandler, http.MethodGet, "/api/auth/audit", "", user); w.Code != http.StatusForbidden {
+		t.Errorf("non-admin: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	for query, want := range map[string]int{"": 3, "?actor=alice": 2, "?action_prefix=url.": 2, "?action=user.create": 1, "?limit=1": 1} {
+		w := serveAuthorized(auditLogHandler, http.MethodGet, "/api/auth/audit"+query, "", admin)
+		var entries []auditEntry
+		if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil || len(entries) != want {
+			t.Errorf("%q: got %d entries (status %d), want %d", query, len(entries), w.Code, want)
+		}
+	}
+	if w := serveAuthorized(auditLogHandler, http.MethodGet, "/api/auth/audit?since=yesterday", "", admin); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid since: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -2,13 +2,18 @@ package handlers
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/shu8/linkener/internal/authenticators"
 	"github.com/shu8/linkener/internal/config"
 	"github.com/shu8/linkener/internal/db"
-	"net/http"
+	"github.com/shu8/linkener/internal/stores"
 
 	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
@@ -20,26 +25,41 @@ type authRequest struct {
 	Password string `json:"password"`
 }
 
+type newUserRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	InviteCode string `json:"invite_code"`
+}
+
+type newTokenRequest struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	OTP          string `json:"otp"`
+	RecoveryCode string `json:"recovery_code"`
+	Name         string `json:"name"`
+	Scope        string `json:"scope"`
+}
+
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
 type revokeRequest struct {
 	AccessToken string `json:"access_token"`
+	All         bool   `json:"all"`
+	Username    string `json:"username"`
 }
 
 type passwordChangeRequest struct {
 	Password string `json:"password"`
 }
 
-func generateAccessToken() (string, error) {
-	bytes := make([]byte, 50)
-
-	_, err := rand.Read(bytes[:])
-	if err != nil {
-		return "", err
+func editUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFullScope(w, r) {
+		return
 	}
 
-	return hex.EncodeToString(bytes), err
-}
-
-func editUserHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		println(err.Error())
@@ -55,6 +75,11 @@ func editUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if config.Config.AuthBackend != "local" {
+		http.Error(w, "Passwords are managed by the "+config.Config.AuthBackend+" auth backend", http.StatusBadRequest)
+		return
+	}
+
 	vars := mux.Vars(r)
 	requestUsername := vars["username"]
 	loggedInUsername := r.Context().Value(UsernameContextKey)
@@ -63,6 +88,11 @@ func editUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := checkPasswordPolicy(decodedBody.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(decodedBody.Password), bcrypt.DefaultCost)
 	if err != nil {
 		println(err.Error())
@@ -85,6 +115,149 @@ func editUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Log out everywhere else, in case the old password was compromised
+	err = revokeOtherTokens(requestUsername, r.Context().Value(TokenIDContextKey).(int64))
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Password updated, but failed to revoke other access tokens", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, requestUsername, "user.password_change", requestUsername, nil, nil)
+	http.ResponseWriter.Write(w, []byte("Success!"))
+}
+
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	if username != r.Context().Value(UsernameContextKey).(string) && !isAdmin(r) {
+		http.Error(w, "Unauthorized access", http.StatusForbidden)
+		return
+	}
+
+	links := r.URL.Query().Get("links")
+	transferTo := r.URL.Query().Get("transfer_to")
+	if links == "" {
+		links = "delete"
+	}
+
+	if links != "delete" && links != "transfer" {
+		http.Error(w, "links must be one of delete, transfer", http.StatusBadRequest)
+		return
+	}
+
+	var userExists, transfereeExists bool
+	err := db.DBCon.QueryRow("select count(*) > 0 from users where username=?", username).Scan(&userExists)
+	if err == nil && links == "transfer" {
+		err = db.DBCon.QueryRow("select count(*) > 0 from users where username=?", transferTo).Scan(&transfereeExists)
+	}
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	if !userExists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if links == "transfer" && (!transfereeExists || transferTo == username) {
+		http.Error(w, "Invalid transfer_to user", http.StatusBadRequest)
+		return
+	}
+
+	// Handle the links first, so a failure part way leaves the user around to try again
+	store, err := stores.StoreFactory(config.Config.StoreType)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	// Including those in the trash, which would otherwise be left without an owner
+	urls, err := store.GetURLs(false)
+	if err == nil {
+		var trashed *[]stores.ShortURL
+		trashed, err = store.GetTrashedURLs(false)
+		if err == nil {
+			*urls = append(*urls, *trashed...)
+		}
+	}
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to delete user's URLs", http.StatusInternalServerError)
+		return
+	}
+
+	for _, url := range *urls {
+		if url.Owner != username {
+			continue
+		}
+
+		before := auditURL(url)
+		if links == "transfer" {
+			url.Owner = transferTo
+			err = store.UpdateURL(url)
+		} else {
+			err = store.DeleteURL(url.Slug)
+		}
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to delete user's URLs", http.StatusInternalServerError)
+			return
+		}
+
+		if links == "transfer" {
+			recordAudit(r, r.Context().Value(UsernameContextKey).(string), "url.update", url.Slug, before, auditURL(url))
+			dispatchWebhookEvent(eventLinkUpdated, url, nil)
+		} else {
+			recordAudit(r, r.Context().Value(UsernameContextKey).(string), "url.delete", url.Slug, before, nil)
+			dispatchWebhookEvent(eventLinkDeleted, url, nil)
+		}
+	}
+
+	tx, err := db.DBCon.Begin()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	// Workspaces' webhooks stay with the workspace
+	_, err = tx.Exec("delete from webhook_deliveries where webhook_id in (select id from webhooks where username=? and workspace_id=0)", username)
+	if err == nil {
+		_, err = tx.Exec("delete from webhooks where username=? and workspace_id=0", username)
+	}
+	if err != nil {
+		tx.Rollback()
+		println(err.Error())
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	for _, table := range []string{"users", "access_tokens", "refresh_tokens", "recovery_codes", "oidc_identities", "password_reset_codes", "invites", "workspace_members"} {
+		_, err = tx.Exec("delete from "+table+" where username=?", username)
+		if err != nil {
+			tx.Rollback()
+			println(err.Error())
+			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	invalidateWebhookSubscriptions()
+
+	recordAudit(r, r.Context().Value(UsernameContextKey).(string), "user.delete", username, nil, nil)
 	http.ResponseWriter.Write(w, []byte("Success!"))
 }
 
@@ -96,7 +269,7 @@ func newUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var decodedBody authRequest
+	var decodedBody newUserRequest
 	err = json.Unmarshal(body, &decodedBody)
 	if err != nil {
 		println(err.Error())
@@ -125,6 +298,21 @@ func newUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if decodedBody.Username == "" {
+		http.Error(w, "Username required", http.StatusBadRequest)
+		return
+	}
+
+	if config.Config.RegistrationMode == registrationInvite && decodedBody.InviteCode == "" {
+		http.Error(w, "Invite code required", http.StatusForbidden)
+		return
+	}
+
+	if err := checkPasswordPolicy(decodedBody.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(decodedBody.Password), bcrypt.DefaultCost)
 	if err != nil {
 		println(err.Error())
@@ -132,24 +320,66 @@ func newUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stmt, err = db.DBCon.Prepare("insert into users(username, password) values(?, ?)")
+	tx, err := db.DBCon.Begin()
 	if err != nil {
 		println(err.Error())
 		http.Error(w, "Failed to add new user", http.StatusInternalServerError)
 		return
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(decodedBody.Username, string(hashedPassword))
+	// Invite codes are optional in open mode, but still give new users the invite's role
+	role := roleUser
+	if decodedBody.InviteCode != "" {
+		role, err = useInviteCode(tx, decodedBody.InviteCode)
+		if err == errInvalidInviteCode {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec("insert into users(username, password, role) values(?, ?, ?)", decodedBody.Username, string(hashedPassword), role)
+	}
+	if err != nil {
+		tx.Rollback()
+		println(err.Error())
+		http.Error(w, "Failed to add new user", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		println(err.Error())
 		http.Error(w, "Failed to add new user", http.StatusInternalServerError)
 		return
 	}
 
+	recordAudit(r, decodedBody.Username, "user.create", decodedBody.Username, nil, map[string]interface{}{
+		"role":        role,
+		"with_invite": decodedBody.InviteCode != "",
+	})
 	http.ResponseWriter.Write(w, []byte("Success!"))
 }
 
+// authenticator checks login credentials, using the configured auth backend
+var authenticator authenticators.Authenticator
+
+// checkCredentials - verify a username and password, writing an error response if they're invalid
+func checkCredentials(w http.ResponseWriter, r *http.Request, username, password string) (string, bool) {
+	user, err := authenticator.Authenticate(username, password)
+	if err != nil {
+		if err == authenticators.ErrInvalidCredentials {
+			recordAudit(r, username, "user.login_failed", username, nil, map[string]string{"reason": "invalid credentials"})
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return "", false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+
+	return user.Username, true
+}
+
 func generateTokenHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -158,7 +388,7 @@ func generateTokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var decodedBody authRequest
+	var decodedBody newTokenRequest
 	err = json.Unmarshal(body, &decodedBody)
 	if err != nil {
 		println(err.Error())
@@ -166,56 +396,62 @@ func generateTokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stmt, err := db.DBCon.Prepare("select username, password from users where username=?")
-	if err != nil {
-		println(err.Error())
-		http.Error(w, "Failed to authenticate user", http.StatusInternalServerError)
+	if decodedBody.Scope == "" {
+		decodedBody.Scope = scopeFull
+	}
+	if !validScope(decodedBody.Scope) {
+		http.Error(w, "Invalid token scope", http.StatusBadRequest)
 		return
 	}
-	defer stmt.Close()
 
-	var dbUsername, dbPassword string
-	if stmt.QueryRow(decodedBody.Username).Scan(&dbUsername, &dbPassword) != nil {
-		http.Error(w, "Failed to authenticate user", http.StatusInternalServerError)
+	username, ok := checkCredentials(w, r, decodedBody.Username, decodedBody.Password)
+	if !ok {
 		return
 	}
 
-	if dbUsername == "" || dbPassword == "" {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	enrollmentOnly, ok := checkSecondFactor(w, r, username, decodedBody.OTP, decodedBody.RecoveryCode)
+	if !ok {
 		return
 	}
 
-	if bcrypt.CompareHashAndPassword([]byte(dbPassword), []byte(decodedBody.Password)) != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-		return
+	if enrollmentOnly {
+		decodedBody.Scope = scopeEnrollment
 	}
 
-	accessToken, err := generateAccessToken()
-	if err != nil {
-		println(err.Error())
-		http.Error(w, "Failed to generate access token", http.StatusInternalServerError)
-		return
+	if writeNewTokens(w, username, decodedBody.Name, decodedBody.Scope) {
+		recordAudit(r, username, "user.login", username, nil, map[string]string{"method": "token", "scope": decodedBody.Scope})
 	}
+}
 
-	stmt, err = db.DBCon.Prepare("insert or replace into access_tokens(username, access_token) values(?, ?)")
+func isAdmin(r *http.Request) bool {
+	role := r.Context().Value(RoleContextKey)
+	return role != nil && role.(string) == roleAdmin
+}
+
+// revokeSessions - revoke all of a user's login sessions; API keys must be revoked individually
+func revokeSessions(username string) error {
+	tx, err := db.DBCon.Begin()
 	if err != nil {
-		println(err.Error())
-		http.Error(w, "Failed to generate access token", http.StatusInternalServerError)
-		return
+		return err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(dbUsername, accessToken)
+	_, err = tx.Exec("delete from access_tokens where username=? and api_key=0", username)
+	if err == nil {
+		_, err = tx.Exec("delete from refresh_tokens where username=?", username)
+	}
 	if err != nil {
-		println(err.Error())
-		http.Error(w, "Failed to generate access token", http.StatusInternalServerError)
-		return
+		tx.Rollback()
+		return err
 	}
 
-	http.ResponseWriter.Write(w, []byte(accessToken))
+	return tx.Commit()
 }
 
 func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		println(err.Error())
@@ -231,81 +467,271 @@ func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stmt, err := db.DBCon.Prepare("delete from access_tokens where access_token=?")
+	loggedInUsername := r.Context().Value(UsernameContextKey).(string)
+
+	if decodedBody.All {
+		username := loggedInUsername
+		if decodedBody.Username != "" && decodedBody.Username != loggedInUsername {
+			if !isAdmin(r) {
+				http.Error(w, "Unauthorized access", http.StatusForbidden)
+				return
+			}
+			username = decodedBody.Username
+		}
+
+		err = revokeSessions(username)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to revoke access tokens", http.StatusInternalServerError)
+			return
+		}
+
+		recordAudit(r, loggedInUsername, "token.revoke_all", username, nil, nil)
+		http.ResponseWriter.Write(w, []byte("Succesfully revoked all sessions"))
+		return
+	}
+
+	var id int64
+	var tokenUsername string
+	err = db.DBCon.QueryRow("select id, username from access_tokens where token_hash=?", hashToken(decodedBody.AccessToken)).Scan(&id, &tokenUsername)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Access token not found", http.StatusNotFound)
+			return
+		}
 		println(err.Error())
-		http.Error(w, "Failed to authenticate user", http.StatusInternalServerError)
+		http.Error(w, "Failed to revoke access token", http.StatusInternalServerError)
+		return
+	}
+
+	if tokenUsername != loggedInUsername && !isAdmin(r) {
+		http.Error(w, "Unauthorized access", http.StatusForbidden)
 		return
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(decodedBody.AccessToken)
+	_, err = db.DBCon.Exec("delete from access_tokens where id=?", id)
+	if err == nil {
+		_, err = db.DBCon.Exec("delete from refresh_tokens where access_token_id=?", id)
+	}
 	if err != nil {
 		println(err.Error())
 		http.Error(w, "Failed to revoke access token", http.StatusInternalServerError)
 		return
 	}
 
+	recordAudit(r, loggedInUsername, "token.revoke", strconv.FormatInt(id, 10), map[string]string{"username": tokenUsername}, nil)
 	http.ResponseWriter.Write(w, []byte("Succesfully revoked access token"))
 }
 
+// tokenFromRequest - find the access token in the Authorization header (with or without the Bearer scheme),
+// the X-API-Key header, or the session cookie, in that order
+func tokenFromRequest(r *http.Request) string {
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		// "Bearer" on its own, or followed by anything but a single token, isn't a token
+		fields := strings.Fields(authorization)
+		if len(fields) > 0 && strings.EqualFold(fields[0], "Bearer") {
+			if len(fields) != 2 {
+				return ""
+			}
+			return fields[1]
+		}
+		return authorization
+	}
+
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+		return apiKey
+	}
+
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+// authError - respond with an RFC 6750 style challenge; errorCode is omitted when no token was given at all
+func authError(w http.ResponseWriter, status int, errorCode, message string) {
+	challenge := `Bearer realm="linkener"`
+	if errorCode != "" {
+		challenge += `, error="` + errorCode + `"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, message, status)
+}
+
 // AuthMiddleware - ensure valid access token is passed for API routes that require authentication
 func AuthMiddleware(next http.Handler) http.Handler {
+	return authMiddleware(next, false)
+}
+
+// enrollmentAuthMiddleware - AuthMiddleware that also accepts tokens only allowed to set up two-factor authentication
+func enrollmentAuthMiddleware(next http.Handler) http.Handler {
+	return authMiddleware(next, true)
+}
+
+func authMiddleware(next http.Handler, allowEnrollment bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Authorization")
+		token := tokenFromRequest(r)
 		if token == "" {
-			http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+			authError(w, http.StatusUnauthorized, "", "Unauthorized access")
 			return
 		}
 
-		stmt, err := db.DBCon.Prepare("select username from access_tokens where access_token=? and expiry>CURRENT_TIMESTAMP limit 1")
-		if err != nil {
+		var id int64
+		var storedHash, username, scope, role string
+		err := db.DBCon.QueryRow(`select t.id, t.token_hash, t.username, t.scope, u.role from access_tokens t join users u on u.username=t.username
+			where t.token_hash=? and (t.expiry is null or t.expiry>CURRENT_TIMESTAMP) limit 1`,
+			hashToken(token)).Scan(&id, &storedHash, &username, &scope, &role)
+		if err != nil && err != sql.ErrNoRows {
 			println(err.Error())
 			http.Error(w, "Failed to authorize request", http.StatusInternalServerError)
 			return
 		}
-		defer stmt.Close()
 
-		rows, err := stmt.Query(token)
-		if err != nil {
-			println(err.Error())
-			http.Error(w, "Failed to authorize request", http.StatusInternalServerError)
+		if err == sql.ErrNoRows || !tokenHashMatches(storedHash, token) {
+			authError(w, http.StatusUnauthorized, "invalid_token", "Unauthorized access")
 			return
 		}
 
-		if rows.Next() {
-			var username string
-			rows.Scan(&username)
-			rows.Close()
-			ctxt := r.WithContext(context.WithValue(r.Context(), UsernameContextKey, username))
-			next.ServeHTTP(w, ctxt)
-		} else {
-			rows.Close()
-			http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		if scope == scopeEnrollment && !allowEnrollment {
+			authError(w, http.StatusForbidden, "insufficient_scope", "Two-factor authentication must be set up first")
+			return
+		}
+
+		if !scopeAllows(scope, r) {
+			authError(w, http.StatusForbidden, "insufficient_scope", "Access token scope does not permit this request")
 			return
 		}
+
+		_, err = db.DBCon.Exec("update access_tokens set last_used=CURRENT_TIMESTAMP where id=?", id)
+		if err != nil {
+			// Not worth failing the request over
+			println(err.Error())
+		}
+
+		ctx := context.WithValue(r.Context(), UsernameContextKey, username)
+		ctx = context.WithValue(ctx, TokenIDContextKey, id)
+		ctx = context.WithValue(ctx, ScopeContextKey, scope)
+		ctx = context.WithValue(ctx, RoleContextKey, role)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
 // SetUpAuthHandlers - set up the /api/auth REST handlers
 func SetUpAuthHandlers(subrouter *mux.Router) error {
+	var err error
+	authenticator, err = authenticators.AuthenticatorFactory(config.Config.AuthBackend)
+	if err != nil {
+		return err
+	}
+
+	if !validRegistrationMode(config.Config.RegistrationMode) {
+		return errors.New("Invalid registration_mode: " + config.Config.RegistrationMode)
+	}
+
+	err = loadBreachedPasswords()
+	if err != nil {
+		return err
+	}
+
 	subrouter.Handle("/users/{username}", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		editUserHandler(w, r)
 	}))).Methods("PUT")
 
-	if config.Config.RegistrationEnabled {
+	subrouter.Handle("/users/{username}", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleteUserHandler(w, r)
+	}))).Methods("DELETE")
+
+	if config.Config.AuthBackend == "local" {
+		subrouter.Handle("/users/{username}/reset_code", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			newResetCodeHandler(w, r)
+		}))).Methods("POST")
+
+		subrouter.HandleFunc("/reset_password", func(w http.ResponseWriter, r *http.Request) {
+			resetPasswordHandler(w, r)
+		}).Methods("POST")
+	}
+
+	// Users from other backends are created when they first log in
+	if config.Config.RegistrationMode != registrationClosed && config.Config.AuthBackend == "local" {
 		subrouter.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
 			newUserHandler(w, r)
 		}).Methods("POST")
+
+		subrouter.Handle("/invites", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			newInviteHandler(w, r)
+		}))).Methods("POST")
+
+		subrouter.Handle("/invites", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			listInvitesHandler(w, r)
+		}))).Methods("GET")
+
+		subrouter.Handle("/invites/{id}", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			revokeInviteHandler(w, r)
+		}))).Methods("DELETE")
 	}
 
+	subrouter.Handle("/users/{username}/totp", enrollmentAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enrollTOTPHandler(w, r)
+	}))).Methods("POST")
+
+	subrouter.Handle("/users/{username}/totp/verify", enrollmentAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifyTOTPHandler(w, r)
+	}))).Methods("POST")
+
+	subrouter.Handle("/users/{username}/totp", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		disableTOTPHandler(w, r)
+	}))).Methods("DELETE")
+
 	subrouter.HandleFunc("/new_token", func(w http.ResponseWriter, r *http.Request) {
 		generateTokenHandler(w, r)
 	}).Methods("POST")
 
-	subrouter.HandleFunc("/revoke_token", func(w http.ResponseWriter, r *http.Request) {
-		revokeTokenHandler(w, r)
+	subrouter.Handle("/tokens", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listTokensHandler(w, r)
+	}))).Methods("GET")
+
+	subrouter.Handle("/tokens/{id}", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		revokeTokenByIDHandler(w, r)
+	}))).Methods("DELETE")
+
+	subrouter.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		newSessionHandler(w, r)
+	}).Methods("POST")
+
+	subrouter.Handle("/session", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endSessionHandler(w, r)
+	}))).Methods("DELETE")
+
+	if config.Config.OIDC.Enabled {
+		subrouter.HandleFunc("/oidc/login", func(w http.ResponseWriter, r *http.Request) {
+			oidcLoginHandler(w, r)
+		}).Methods("GET")
+
+		subrouter.HandleFunc("/oidc/callback", func(w http.ResponseWriter, r *http.Request) {
+			oidcCallbackHandler(w, r)
+		}).Methods("GET")
+
+		subrouter.HandleFunc("/oidc/2fa", func(w http.ResponseWriter, r *http.Request) {
+			oidcSecondFactorHandler(w, r)
+		}).Methods("POST")
+	}
+
+	subrouter.HandleFunc("/refresh_token", func(w http.ResponseWriter, r *http.Request) {
+		refreshTokenHandler(w, r)
 	}).Methods("POST")
 
+	subrouter.Handle("/api_keys", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		newAPIKeyHandler(w, r)
+	}))).Methods("POST")
+
+	subrouter.Handle("/audit_log", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auditLogHandler(w, r)
+	}))).Methods("GET")
+
+	subrouter.Handle("/revoke_token", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		revokeTokenHandler(w, r)
+	}))).Methods("POST")
+
 	return nil
 }
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/db"
+	"github.com/shu8/linkener/internal/stores"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTokenFromRequest(t *testing.T) {
+	for _, test := range []struct {
+		header, value string
+		want          string
+	}{
+		{"Authorization", "Bearer abc123", "abc123"},
+		{"Authorization", "bearer  abc123 ", "abc123"},
+		{"Authorization", "abc123", "abc123"},
+		{"Authorization", "Bearer", ""},
+		{"Authorization", "Bearer ", ""},
+		{"Authorization", "Bearer abc 123", ""},
+		{"X-API-Key", "abc123", "abc123"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(test.header, test.value)
+		if got := tokenFromRequest(r); got != test.want {
+			t.Errorf("%s: %q: got token %q, want %q", test.header, test.value, got, test.want)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "abc123"})
+	if got := tokenFromRequest(r); got != "abc123" {
+		t.Errorf("session cookie: got token %q, want abc123", got)
+	}
+
+	// The Authorization header wins over the session cookie
+	r.Header.Set("Authorization", "Bearer def456")
+	if got := tokenFromRequest(r); got != "def456" {
+		t.Errorf("header and session cookie: got token %q, want def456", got)
+	}
+}
+
+func TestBareBearerUnauthorized(t *testing.T) {
+	setUpTestAuthDB(t)
+	newTestUser(t, "alice", scopeFull)
+
+	r := httptest.NewRequest(http.MethodGet, "/tokens", nil)
+	r.Header.Set("Authorization", "Bearer")
+	w := httptest.NewRecorder()
+	AuthMiddleware(http.HandlerFunc(listTokensHandler)).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("bare Bearer: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+// deleteTestUser - delete the user as whoever the token belongs to
+func deleteTestUser(username, query, token string) *httptest.ResponseRecorder {
+	return serveAuthorized(func(w http.ResponseWriter, r *http.Request) {
+		deleteUserHandler(w, mux.SetURLVars(r, map[string]string{"username": username}))
+	}, http.MethodDelete, "/api/auth/users/"+username+query, "", token)
+}
+
+// userRows - how many rows in the auth database's table belong to the user
+func userRows(t *testing.T, table, username string) int {
+	var count int
+	err := db.DBCon.QueryRow("select count(*) from "+table+" where username=?", username).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestDeleteUser(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		for _, links := range []string{"delete", "transfer"} {
+			t.Run(storeType+"/"+links, func(t *testing.T) {
+				store := setUpTestStore(t, storeType)
+				oldStoreType := config.Config.StoreType
+				t.Cleanup(func() { config.Config.StoreType = oldStoreType })
+				config.Config.StoreType = storeType
+
+				alice := newTestUser(t, "alice", scopeFull)
+				newTestUser(t, "bob", scopeFull)
+				newTestURL(t, store, stores.ShortURL{Slug: "alice", URL: "https://example.com/alice", Owner: "alice"})
+				newTestURL(t, store, stores.ShortURL{Slug: "trashed", URL: "https://example.com/trashed", Owner: "alice"})
+				newTestURL(t, store, stores.ShortURL{Slug: "bob", URL: "https://example.com/bob", Owner: "bob"})
+				err := store.TrashURL("trashed")
+				if err != nil {
+					t.Fatal(err)
+				}
+				newTestWebhook(t, "alice", 0, "https://example.com/hook", "secret", eventLinkCreated)
+				_, err = db.DBCon.Exec("insert into workspace_members(workspace_id, username) values(1, 'alice')")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// Only admins can delete other users
+				if w := deleteTestUser("bob", "", alice); w.Code != http.StatusForbidden {
+					t.Fatalf("deleting someone else: got status %d, want %d", w.Code, http.StatusForbidden)
+				}
+
+				query := "?links=" + links
+				if links == "transfer" {
+					query += "&transfer_to=bob"
+				}
+				if w := deleteTestUser("alice", query, alice); w.Code != http.StatusOK {
+					t.Fatalf("deleting self: got status %d: %s", w.Code, w.Body.String())
+				}
+
+				for _, table := range []string{"users", "access_tokens", "webhooks", "workspace_members"} {
+					if rows := userRows(t, table, "alice"); rows != 0 {
+						t.Errorf("after deleting: got %d rows left in %s", rows, table)
+					}
+				}
+				if rows := userRows(t, "users", "bob"); rows != 1 {
+					t.Error("after deleting: bob was deleted too")
+				}
+
+				urls, err := store.GetURLs(false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				trashed, err := store.GetTrashedURLs(false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				owners := map[string]string{}
+				for _, url := range append(*urls, *trashed...) {
+					owners[url.Slug] = url.Owner
+				}
+				want := map[string]string{"bob": "bob"}
+				if links == "transfer" {
+					want = map[string]string{"alice": "bob", "trashed": "bob", "bob": "bob"}
+				}
+				if len(owners) != len(want) {
+					t.Fatalf("after deleting: got links %v, want %v", owners, want)
+				}
+				for slug, owner := range want {
+					if owners[slug] != owner {
+						t.Errorf("after deleting: got links %v, want %v", owners, want)
+						break
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/static"
+	"github.com/shu8/linkener/internal/stores"
+)
+
+// How to respond to bots visiting short URLs
+const (
+	botResponseRedirect = "redirect"
+	botResponsePreview  = "preview"
+)
+
+// botUserAgents are the lowercase names of crawlers and the link preview bots of chat apps and social networks, as
+// they appear in their user agents. They're matched as whole words, so "bot" doesn't match phones like the "CUBOT X30".
+// The bots config option's user_agents are checked as well
+var botUserAgents = []string{
+	"bot",
+	"crawler",
+	"spider",
+	"googlebot",
+	"google-inspectiontool",
+	"bingbot",
+	"slurp",
+	"duckduckbot",
+	"baiduspider",
+	"yandexbot",
+	"applebot",
+	"amazonbot",
+	"petalbot",
+	"ahrefsbot",
+	"semrushbot",
+	"mj12bot",
+	"dotbot",
+	"ccbot",
+	"gptbot",
+	"bytespider",
+	"facebookexternalhit",
+	"facebookcatalog",
+	"facebot",
+	"twitterbot",
+	"linkedinbot",
+	"pinterest",
+	"pinterestbot",
+	"redditbot",
+	"whatsapp",
+	"telegrambot",
+	"discordbot",
+	"slackbot",
+	"slack-imgproxy",
+	"skypeuripreview",
+	"embedly",
+	"iframely",
+	"vkshare",
+	"mastodon",
+	"preview",
+	"headlesschrome",
+	"lighthouse",
+}
+
+type previewData struct {
+	Title string
+	URL   string
+}
+
+var previewTmpl = template.Must(template.New("previewTemplate").Parse(static.PreviewTemplate))
+
+// validateBotsConfig - check the bots config options are valid
+func validateBotsConfig() error {
+	response := config.Config.Bots.Response
+	if response != botResponseRedirect && response != botResponsePreview {
+		return errors.New("Invalid bots response: " + response)
+	}
+
+	return nil
+}
+
+// isPrefetch - whether the request is only a HEAD request, or a browser prefetching the short URL before (or without)
+// the user visiting it
+func isPrefetch(r *http.Request) bool {
+	if r.Method == http.MethodHead {
+		return true
+	}
+
+	for _, header := range []string{"Purpose", "Sec-Purpose", "X-Purpose", "X-Moz"} {
+		value := strings.ToLower(r.Header.Get(header))
+		if strings.Contains(value, "prefetch") || strings.Contains(value, "preview") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isWordCharacter - whether the byte is part of a word in a user agent: a letter or digit
+func isWordCharacter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// containsWord - whether s contains the word, without a letter or digit either side of it
+func containsWord(s, word string) bool {
+	for offset := 0; offset+len(word) <= len(s); {
+		i := strings.Index(s[offset:], word)
+		if i == -1 {
+			return false
+		}
+
+		start, end := offset+i, offset+i+len(word)
+		if (start == 0 || !isWordCharacter(s[start-1])) && (end == len(s) || !isWordCharacter(s[end])) {
+			return true
+		}
+		offset = start + 1
+	}
+
+	return false
+}
+
+// isBot - whether the request is from a bot or a prefetch, rather than a person following the short URL
+func isBot(r *http.Request) bool {
+	if isPrefetch(r) {
+		return true
+	}
+
+	userAgent := strings.ToLower(r.UserAgent())
+	if userAgent == "" {
+		return false
+	}
+
+	for _, patterns := range [][]string{botUserAgents, config.Config.Bots.UserAgents} {
+		for _, pattern := range patterns {
+			if pattern != "" && containsWord(userAgent, strings.ToLower(pattern)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// botsKeptOut - whether bots can't be let through to the short URL's destination: if it has a visit limit, which bots'
+// visits don't count towards, or a password. As anyone can look like a bot, being one mustn't get round either
+func botsKeptOut(url *stores.ShortURL) bool {
+	return url.AllowedVisits > 0 || url.Password != ""
+}
+
+// serveKeptOutBot - respond to a bot visiting a short URL it can't be let through: with a preview that doesn't show the
+// destination if bots get previews, or else a 403
+func serveKeptOutBot(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	if config.Config.Bots.Response != botResponsePreview {
+		http.Error(w, "Bots can't visit this short URL", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := previewTmpl.Execute(w, previewData{Title: "Protected link"})
+	if err != nil {
+		println(err.Error())
+	}
+}
+
+// servePreview - respond with an Open Graph preview of the destination, which also redirects people there
+func servePreview(w http.ResponseWriter, destination string) {
+	title := destination
+	if parsed, err := url.Parse(destination); err == nil && parsed.Host != "" {
+		title = parsed.Host
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := previewTmpl.Execute(w, previewData{Title: title, URL: destination})
+	if err != nil {
+		println(err.Error())
+	}
+}
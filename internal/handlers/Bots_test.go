@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/stores"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testBrowserUserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:80.0) Gecko/20100101 Firefox/80.0"
+	testBotUserAgent     = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+)
+
+func setBotsResponse(t *testing.T, response string) {
+	oldBots := config.Config.Bots
+	t.Cleanup(func() { config.Config.Bots = oldBots })
+	config.Config.Bots.Response = response
+}
+
+func TestIsBot(t *testing.T) {
+	setBotsResponse(t, botResponseRedirect)
+	config.Config.Bots.UserAgents = []string{"ExampleFetcher"}
+
+	for userAgent, want := range map[string]bool{
+		testBrowserUserAgent: false,
+		testBotUserAgent:     true,
+		"":                   false,
+		"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)":                true,
+		"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)": true,
+		"WhatsApp/2.21.4.18 A": true,
+		"Mozilla/5.0 (Linux; Android 10; CUBOT X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0 Mobile": false,
+		"Mozilla/5.0 (Linux; Android 9; KING KONG 3 Build/CUBOT) AppleWebKit/537.36 Chrome/90.0 Mobile":        false,
+		"Mozilla/5.0 (compatible; ExampleFetcher/1.0)":                                                         true,
+		"Mozilla/5.0 (compatible; ExampleFetcherPro/1.0)":                                                      false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/example", nil)
+		r.Header.Set("User-Agent", userAgent)
+		if got := isBot(r); got != want {
+			t.Errorf("%q: got bot %v, want %v", userAgent, got, want)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/example", nil)
+	r.Header.Set("User-Agent", testBrowserUserAgent)
+	r.Header.Set("Sec-Purpose", "prefetch")
+	if !isBot(r) {
+		t.Error("prefetch: got bot false, want true")
+	}
+}
+
+// visitShortURL - send a request for the short URL through the forwarder
+func visitShortURL(store stores.Store, method, slug, userAgent string, form url.Values) *httptest.ResponseRecorder {
+	var r *http.Request
+	if form != nil {
+		r = httptest.NewRequest(method, "/"+slug, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, "/"+slug, nil)
+	}
+	r.Header.Set("User-Agent", userAgent)
+
+	w := httptest.NewRecorder()
+	forwarderHandler(w, r, store)
+	return w
+}
+
+func TestBotsKeptOutOfLimitedLinks(t *testing.T) {
+	for _, response := range []string{botResponseRedirect, botResponsePreview} {
+		t.Run(response, func(t *testing.T) {
+			store := setUpTestStore(t, "sqlite")
+			setBotsResponse(t, response)
+			newTestURL(t, store, stores.ShortURL{Slug: "once", URL: "https://example.com/secret", Owner: "alice", AllowedVisits: 1})
+
+			// Bots, or anyone looking like one, never get the destination, however many times they visit
+			for _, bot := range []struct {
+				method    string
+				userAgent string
+			}{{http.MethodGet, testBotUserAgent}, {http.MethodHead, testBrowserUserAgent}, {http.MethodGet, testBotUserAgent}} {
+				w := visitShortURL(store, bot.method, "once", bot.userAgent, nil)
+				if w.Header().Get("Location") != "" || strings.Contains(w.Body.String(), "example.com/secret") {
+					t.Fatalf("bot %s %q: got sent to the destination", bot.method, bot.userAgent)
+				}
+				if response == botResponseRedirect && w.Code != http.StatusForbidden {
+					t.Errorf("bot %s %q: got status %d, want %d", bot.method, bot.userAgent, w.Code, http.StatusForbidden)
+				}
+				if response == botResponsePreview && (w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "og:title")) {
+					t.Errorf("bot %s %q: got status %d without a preview", bot.method, bot.userAgent, w.Code)
+				}
+			}
+
+			// So the single visit is still there for a person
+			w := visitShortURL(store, http.MethodGet, "once", testBrowserUserAgent, nil)
+			if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://example.com/secret" {
+				t.Fatalf("first person: got status %d and location %q, want a redirect", w.Code, w.Header().Get("Location"))
+			}
+			w = visitShortURL(store, http.MethodGet, "once", testBrowserUserAgent, nil)
+			if w.Code != http.StatusForbidden || w.Header().Get("Location") != "" {
+				t.Errorf("second person: got status %d, want %d", w.Code, http.StatusForbidden)
+			}
+			if visits := storedVisitCount(t, store, "once"); visits != 1 {
+				t.Errorf("got %d stored visits, want 1", visits)
+			}
+		})
+	}
+}
+
+func TestBotsKeptOutOfPasswordLinks(t *testing.T) {
+	store := setUpTestStore(t, "sqlite")
+	setBotsResponse(t, botResponsePreview)
+
+	password, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestURL(t, store, stores.ShortURL{Slug: "locked", URL: "https://example.com/secret", Owner: "alice", Password: string(password)})
+
+	form := url.Values{"password": {"hunter2"}}
+	w := visitShortURL(store, http.MethodPost, "locked", testBotUserAgent, form)
+	if w.Header().Get("Location") != "" || strings.Contains(w.Body.String(), "example.com/secret") {
+		t.Fatal("bot with the password: got sent to the destination")
+	}
+
+	w = visitShortURL(store, http.MethodPost, "locked", testBrowserUserAgent, form)
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://example.com/secret" {
+		t.Errorf("person with the password: got status %d and location %q, want a redirect", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestBotsPreviewUnprotectedLinks(t *testing.T) {
+	store := setUpTestStore(t, "sqlite")
+	setBotsResponse(t, botResponsePreview)
+	newTestURL(t, store, stores.ShortURL{Slug: "open", URL: "https://example.com/page", Owner: "alice"})
+
+	w := visitShortURL(store, http.MethodGet, "open", testBotUserAgent, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `content="https://example.com/page"`) {
+		t.Errorf("bot: got status %d without a preview of the destination", w.Code)
+	}
+}
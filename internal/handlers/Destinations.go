@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/shu8/linkener/internal/stores"
+)
+
+// utmFields - the UTM parameters' names, and where they're kept
+func utmFields(params *stores.UTMParams) map[string]*string {
+	return map[string]*string{
+		"utm_source":   &params.Source,
+		"utm_medium":   &params.Medium,
+		"utm_campaign": &params.Campaign,
+		"utm_term":     &params.Term,
+		"utm_content":  &params.Content,
+	}
+}
+
+// campaignParams - the UTM parameters in a query string, or nil if there aren't any
+func campaignParams(query url.Values) *stores.UTMParams {
+	params := stores.UTMParams{}
+	for name, field := range utmFields(&params) {
+		*field = query.Get(name)
+	}
+
+	if params.Empty() {
+		return nil
+	}
+	return &params
+}
+
+// destinationURL - where to redirect a visit to the short URL to: its URL, or the URL of the routing rule it matched
+// (with its template filled in, or the rest of the path after a prefix link's slug added to its path), and the visit's
+// query string merged in (if it forwards them), then any of its UTM parameters that aren't already set. Forwarded
+// parameters replace those already in the URL. Errors if its template can't be filled in, rather than sending visitors
+// to the template itself
+func destinationURL(link *stores.ShortURL, rule int, rest string, r *http.Request) (string, error) {
+	rawURL := link.URL
+	if rule > 0 {
+		rawURL = link.Rules[rule-1].URL
+	}
+
+	if link.Template {
+		rendered, err := renderTemplate(rawURL, rest, r)
+		if err != nil {
+			return "", err
+		}
+		rawURL = rendered
+		// Templates decide where the rest of the path goes themselves
+		rest = ""
+	}
+
+	query := r.URL.Query()
+	if rest == "" && (!link.ForwardQuery || len(query) == 0) && link.UTM.Empty() {
+		return rawURL, nil
+	}
+
+	destination, err := url.Parse(rawURL)
+	if err != nil {
+		// It's still worth trying to redirect
+		println(err.Error())
+		return rawURL, nil
+	}
+
+	if rest != "" {
+		destination.Path = strings.TrimSuffix(destination.Path, "/") + rest
+		destination.RawPath = ""
+	}
+
+	// Only re-encode the query string if it's changed, as that sorts it
+	params := destination.Query()
+	changed := false
+	if link.ForwardQuery {
+		for name, values := range query {
+			params[name] = values
+			changed = true
+		}
+	}
+
+	utm := link.UTM
+	for name, field := range utmFields(&utm) {
+		if *field != "" && params.Get(name) == "" {
+			params.Set(name, *field)
+			changed = true
+		}
+	}
+
+	if changed {
+		destination.RawQuery = params.Encode()
+	}
+	return destination.String(), nil
+}
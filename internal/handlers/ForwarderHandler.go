@@ -1,13 +1,16 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"text/template"
+	"time"
 
 	"github.com/shu8/linkener/internal/config"
 	"github.com/shu8/linkener/internal/static"
 	"github.com/shu8/linkener/internal/stores"
 
+	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -24,36 +27,100 @@ type templateData struct {
 
 var tmpl = template.Must(template.New("passwordTemplate").Parse(static.PasswordTemplate))
 
-func redirect(w http.ResponseWriter, r *http.Request, store stores.Store, url *stores.ShortURL, referer string) {
-	// TODO add more stats like location?
-	err := store.RecordVisit(url.Slug, referer)
+// getLink - the short URL with the given slug, from the link cache if it's there. Visits that are still buffered are
+// counted too
+func getLink(store stores.Store, slug string) (*stores.Link, error) {
+	link, version := stores.CachedLink(slug)
+	if link != nil {
+		return link, nil
+	}
+
+	url, visits, err := getURLWithVisits(store, slug)
+	if err != nil || url == nil {
+		return nil, err
+	}
+
+	link = &stores.Link{URL: *url, Visits: visits}
+	stores.CacheLink(*link, version)
+	return link, nil
+}
+
+// resolveLink - the short URL for the path (without its leading /): the one with it as its slug, or else the prefix
+// link with the longest slug the path starts with. Also returns the rest of the path after the slug, from its /
+func resolveLink(store stores.Store, path string) (*stores.Link, string, error) {
+	link, err := getLink(store, path)
+	if err != nil || link != nil {
+		return link, "", err
+	}
+
+	url, err := store.GetPrefixURL(path)
+	if err != nil || url == nil {
+		return nil, "", err
+	}
+
+	link, err = getLink(store, url.Slug)
+	if err != nil || link == nil {
+		return nil, "", err
+	}
+	return link, path[len(url.Slug):], nil
+}
+
+func redirect(w http.ResponseWriter, r *http.Request, store stores.Store, link *stores.Link, rest, referer string) {
+	url := &link.URL
+
+	rule := matchRule(url, r, time.Now())
+	destination, err := destinationURL(url, rule, rest, r)
 	if err != nil {
+		// Checked before recording the visit, as the visitor doesn't get anywhere
 		println(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
 		tmpl.Execute(w, templateData{
 			Error: true,
 		})
-		http.Error(w, "Failed to unshorten URL", http.StatusInternalServerError)
+		return
 	}
 
-	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-
-	http.Redirect(w, r, url.URL, http.StatusMovedPermanently)
-}
-
-// ForwarderHandler - perform the short URL HTTP redirects on the / route
-func ForwarderHandler(w http.ResponseWriter, r *http.Request) {
-	store, err := stores.StoreFactory(config.Config.StoreType)
+	// TODO add more stats like location?
+	visit, err := newVisitRecord(r, url.Slug, referer)
+	visit.Visit.Rule = rule
+	bot := visit.Visit.Bot
+	// Bots don't count towards visit limits, so link previews don't use up single use links
+	visits := link.Visits
+	if !bot {
+		visits++
+	}
+	if err == nil {
+		err = recordVisit(store, visit)
+	}
 	if err != nil {
 		println(err.Error())
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(http.StatusInternalServerError)
 		tmpl.Execute(w, templateData{
 			Error: true,
 		})
 		return
 	}
 
-	slug := r.URL.Path[1:]
-	url, err := store.GetURL(slug)
+	if !bot {
+		stores.AddCachedVisit(url.Slug)
+	}
+	dispatchWebhookEvent(eventVisitRecorded, *url, map[string]interface{}{"referer": webhookReferer(r, referer), "visits": visits, "bot": bot, "rule": rule})
+	if !bot && url.AllowedVisits > 0 && visits == url.AllowedVisits {
+		dispatchWebhookEvent(eventVisitLimitReached, *url, map[string]interface{}{"visits": visits})
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	if bot && config.Config.Bots.Response == botResponsePreview {
+		servePreview(w, destination)
+		return
+	}
+
+	http.Redirect(w, r, destination, http.StatusMovedPermanently)
+}
+
+func forwarderHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
+	link, rest, err := resolveLink(store, r.URL.Path[1:])
 
 	if err != nil {
 		println(err.Error())
@@ -64,7 +131,7 @@ func ForwarderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if url == nil {
+	if link == nil {
 		w.WriteHeader(http.StatusNotFound)
 		tmpl.Execute(w, templateData{
 			Unknown: true,
@@ -72,7 +139,17 @@ func ForwarderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if url.AllowedVisits > 0 && len(url.Visits) >= url.AllowedVisits {
+	url := &link.URL
+	if url.AllowedVisits > 0 && link.Visits >= url.AllowedVisits {
+		// Only for the first visit refused, rather than every one after
+		if !url.ExpiredNotified {
+			notify, err := store.MarkExpiredNotified(url.Slug)
+			if err != nil {
+				println(err.Error())
+			} else if notify {
+				dispatchWebhookEvent(eventLinkExpired, *url, map[string]interface{}{"referer": webhookReferer(r, r.Referer()), "visits": link.Visits})
+			}
+		}
 		w.WriteHeader(http.StatusForbidden)
 		tmpl.Execute(w, templateData{
 			Expired: true,
@@ -80,6 +157,11 @@ func ForwarderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if botsKeptOut(url) && isBot(r) {
+		serveKeptOutBot(w)
+		return
+	}
+
 	if url.Password != "" {
 		if r.Method != http.MethodPost {
 			tmpl.Execute(w, templateData{
@@ -97,10 +179,41 @@ func ForwarderHandler(w http.ResponseWriter, r *http.Request) {
 					Referer:           referer,
 				})
 			} else {
-				redirect(w, r, store, url, referer)
+				redirect(w, r, store, link, rest, referer)
 			}
 		}
 	} else {
-		redirect(w, r, store, url, r.Referer())
+		redirect(w, r, store, link, rest, r.Referer())
+	}
+}
+
+// SetUpForwarderHandler - perform the short URL HTTP redirects on the route
+func SetUpForwarderHandler(route *mux.Route) error {
+	store, err := stores.StoreFactory(config.Config.StoreType)
+	if err != nil {
+		return err
+	}
+
+	err = validatePrivacyConfig()
+	if err != nil {
+		return err
+	}
+
+	err = validateBotsConfig()
+	if err != nil {
+		return err
 	}
+
+	if config.Config.LinkCache.Size > 0 {
+		if config.Config.LinkCache.TTL <= 0 {
+			return errors.New("Invalid link_cache ttl")
+		}
+		stores.EnableLinkCache(config.Config.LinkCache.Size, time.Duration(config.Config.LinkCache.TTL)*time.Second)
+	}
+
+	route.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarderHandler(w, r, store)
+	})
+
+	return nil
 }
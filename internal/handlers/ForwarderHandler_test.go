@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/shu8/linkener/internal/stores"
+)
+
+func TestPrefixLinks(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestStore(t, storeType)
+			newTestURL(t, store, stores.ShortURL{Slug: "docs", URL: "https://docs.example.com/", Owner: "alice", Prefix: true})
+			newTestURL(t, store, stores.ShortURL{Slug: "docs/api", URL: "https://api.example.com/reference", Owner: "alice", Prefix: true})
+			newTestURL(t, store, stores.ShortURL{Slug: "my_docs", URL: "https://example.com/mine", Owner: "alice", Prefix: true})
+			newTestURL(t, store, stores.ShortURL{Slug: "blog", URL: "https://blog.example.com", Owner: "alice"})
+
+			for path, want := range map[string]string{
+				"docs":                "https://docs.example.com/",
+				"docs/guides/setup":   "https://docs.example.com/guides/setup",
+				"docs/api/v1/users":   "https://api.example.com/reference/v1/users",
+				"my_docs/notes":       "https://example.com/mine/notes",
+				"docsx/guides":        "",
+				"myxdocs/notes":       "",
+				"blog/2020/new-post":  "",
+				"blog":                "https://blog.example.com",
+				"docs/guides/setup/":  "https://docs.example.com/guides/setup/",
+				"docs/a%20b/../setup": "https://docs.example.com/a%20b/../setup",
+			} {
+				w := visitShortURL(store, http.MethodGet, path, testBrowserUserAgent, nil)
+				if want == "" && w.Code != http.StatusNotFound {
+					t.Errorf("%s: got status %d and location %q, want %d", path, w.Code, w.Header().Get("Location"), http.StatusNotFound)
+				}
+				if want != "" && (w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != want) {
+					t.Errorf("%s: got status %d and location %q, want a redirect to %q", path, w.Code, w.Header().Get("Location"), want)
+				}
+			}
+
+			// Visits to paths under a prefix link count as visits to it
+			if visits := storedVisitCount(t, store, "docs"); visits != 4 {
+				t.Errorf("docs: got %d stored visits, want 4", visits)
+			}
+		})
+	}
+}
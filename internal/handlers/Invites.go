@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shu8/linkener/internal/db"
+
+	"github.com/gorilla/mux"
+)
+
+// Values for the registration_mode config option
+const (
+	registrationOpen   = "open"
+	registrationInvite = "invite"
+	registrationClosed = "closed"
+)
+
+const defaultInviteLifetime = 7 * 24 * time.Hour
+
+// errInvalidInviteCode - the invite code doesn't exist, has expired, or has been used up
+var errInvalidInviteCode = errors.New("Invalid or expired invite code")
+
+type newInviteRequest struct {
+	MaxUses   int    `json:"max_uses"`
+	ExpiresIn int    `json:"expires_in"`
+	Role      string `json:"role"`
+}
+
+type inviteResponse struct {
+	ID         int64     `json:"id"`
+	InviteCode string    `json:"invite_code"`
+	Role       string    `json:"role"`
+	MaxUses    int       `json:"max_uses"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type inviteInfo struct {
+	ID          int64     `json:"id"`
+	CreatedBy   string    `json:"created_by"`
+	Role        string    `json:"role"`
+	MaxUses     int       `json:"max_uses"`
+	Uses        int       `json:"uses"`
+	DateCreated time.Time `json:"date_created"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+func validRegistrationMode(mode string) bool {
+	return mode == registrationOpen || mode == registrationInvite || mode == registrationClosed
+}
+
+// useInviteCode - use up one of the invite code's uses as part of tx, returning the role it gives new users
+func useInviteCode(tx *sql.Tx, inviteCode string) (string, error) {
+	result, err := tx.Exec("update invites set uses=uses+1 where code_hash=? and uses<max_uses and expiry>CURRENT_TIMESTAMP", hashToken(inviteCode))
+	if err != nil {
+		return "", err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return "", errInvalidInviteCode
+	}
+
+	var role string
+	err = tx.QueryRow("select role from invites where code_hash=?", hashToken(inviteCode)).Scan(&role)
+	return role, err
+}
+
+func newInviteHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var decodedBody newInviteRequest
+	err = json.Unmarshal(body, &decodedBody)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+		return
+	}
+
+	if decodedBody.MaxUses == 0 {
+		decodedBody.MaxUses = 1
+	}
+	if decodedBody.MaxUses < 0 {
+		http.Error(w, "max_uses must be positive", http.StatusBadRequest)
+		return
+	}
+
+	lifetime := defaultInviteLifetime
+	if decodedBody.ExpiresIn < 0 {
+		http.Error(w, "expires_in must be positive", http.StatusBadRequest)
+		return
+	} else if decodedBody.ExpiresIn > 0 {
+		lifetime = time.Duration(decodedBody.ExpiresIn) * time.Second
+	}
+
+	if decodedBody.Role == "" {
+		decodedBody.Role = roleUser
+	}
+	if decodedBody.Role != roleUser && decodedBody.Role != roleAdmin {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	// Otherwise anyone could make themselves an admin by inviting a second account
+	if decodedBody.Role == roleAdmin && !isAdmin(r) {
+		http.Error(w, "Only admins can invite admins", http.StatusForbidden)
+		return
+	}
+
+	inviteCode, err := randomURLString(16)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+		return
+	}
+
+	username := r.Context().Value(UsernameContextKey).(string)
+	expiry := time.Now().UTC().Truncate(time.Second).Add(lifetime)
+	result, err := db.DBCon.Exec("insert into invites(username, code_hash, role, max_uses, expiry) values(?, ?, ?, ?, ?)",
+		username, hashToken(inviteCode), decodedBody.Role, decodedBody.MaxUses, expiry.Format(sqliteTimeFormat))
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, username, "invite.create", strconv.FormatInt(id, 10), nil, map[string]interface{}{
+		"role":       decodedBody.Role,
+		"max_uses":   decodedBody.MaxUses,
+		"expires_at": expiry,
+	})
+	json.NewEncoder(w).Encode(inviteResponse{
+		ID:         id,
+		InviteCode: inviteCode,
+		Role:       decodedBody.Role,
+		MaxUses:    decodedBody.MaxUses,
+		ExpiresAt:  expiry,
+	})
+}
+
+func listInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	// Admins see everyone's invites
+	var rows *sql.Rows
+	var err error
+	if isAdmin(r) {
+		rows, err = db.DBCon.Query("select id, username, role, max_uses, uses, date_created, expiry from invites order by id")
+	} else {
+		rows, err = db.DBCon.Query("select id, username, role, max_uses, uses, date_created, expiry from invites where username=? order by id",
+			r.Context().Value(UsernameContextKey).(string))
+	}
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to fetch invites", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	invites := []inviteInfo{}
+	for rows.Next() {
+		var invite inviteInfo
+		err := rows.Scan(&invite.ID, &invite.CreatedBy, &invite.Role, &invite.MaxUses, &invite.Uses, &invite.DateCreated, &invite.ExpiresAt)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to fetch invites", http.StatusInternalServerError)
+			return
+		}
+		invites = append(invites, invite)
+	}
+
+	json.NewEncoder(w).Encode(invites)
+}
+
+func revokeInviteHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid invite ID", http.StatusBadRequest)
+		return
+	}
+
+	var result sql.Result
+	if isAdmin(r) {
+		result, err = db.DBCon.Exec("delete from invites where id=?", id)
+	} else {
+		result, err = db.DBCon.Exec("delete from invites where id=? and username=?", id, r.Context().Value(UsernameContextKey).(string))
+	}
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to revoke invite", http.StatusInternalServerError)
+		return
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, r.Context().Value(UsernameContextKey).(string), "invite.revoke", strconv.FormatInt(id, 10), nil, nil)
+	http.ResponseWriter.Write(w, []byte("Success!"))
+}
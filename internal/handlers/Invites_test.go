@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/db"
+)
+
+// newTestInvite - create an invite as whoever the token belongs to, returning the response
+func newTestInvite(t *testing.T, token, body string) (*httptest.ResponseRecorder, inviteResponse) {
+	w := serveAuthorized(newInviteHandler, http.MethodPost, "/api/auth/invites", body, token)
+	var invite inviteResponse
+	if w.Code == http.StatusOK {
+		err := json.Unmarshal(w.Body.Bytes(), &invite)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, invite
+}
+
+// registerTestUser - sign up with the invite code, returning the response status
+func registerTestUser(username, inviteCode string) int {
+	body := `{"username": "` + username + `", "password": "correct horse staple", "invite_code": "` + inviteCode + `"}`
+	w := httptest.NewRecorder()
+	newUserHandler(w, httptest.NewRequest(http.MethodPost, "/api/auth/users", strings.NewReader(body)))
+	return w.Code
+}
+
+func TestInviteRoleLimits(t *testing.T) {
+	setUpTestAuthDB(t)
+	user := newTestUser(t, "alice", scopeFull)
+	admin := newTestUser(t, "carol", scopeFull)
+	_, err := db.DBCon.Exec("update users set role=? where username='carol'", roleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		token string
+		body  string
+		want  int
+	}{
+		{"user inviting a user", user, `{}`, http.StatusOK},
+		{"user inviting an admin", user, `{"role": "admin"}`, http.StatusForbidden},
+		{"admin inviting an admin", admin, `{"role": "admin"}`, http.StatusOK},
+		{"unknown role", admin, `{"role": "owner"}`, http.StatusBadRequest},
+		{"negative max_uses", user, `{"max_uses": -1}`, http.StatusBadRequest},
+	} {
+		if w, _ := newTestInvite(t, test.token, test.body); w.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
+
+func TestInviteOnlyRegistration(t *testing.T) {
+	setUpTestAuthDB(t)
+	oldMode := config.Config.RegistrationMode
+	t.Cleanup(func() { config.Config.RegistrationMode = oldMode })
+	config.Config.RegistrationMode = registrationInvite
+
+	admin := newTestUser(t, "carol", scopeFull)
+	_, err := db.DBCon.Exec("update users set role=? where username='carol'", roleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, invite := newTestInvite(t, admin, `{"role": "admin", "max_uses": 2}`)
+	_, expired := newTestInvite(t, admin, `{}`)
+	_, err = db.DBCon.Exec("update invites set expiry=datetime('now', '-1 minute') where id=?", expired.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		username   string
+		inviteCode string
+		want       int
+	}{
+		{"nocode", "", http.StatusForbidden},
+		{"wrongcode", "not an invite", http.StatusForbidden},
+		{"expired", expired.InviteCode, http.StatusForbidden},
+		{"first", invite.InviteCode, http.StatusOK},
+		{"second", invite.InviteCode, http.StatusOK},
+		{"third", invite.InviteCode, http.StatusForbidden},
+	} {
+		if code := registerTestUser(test.username, test.inviteCode); code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.username, code, test.want)
+		}
+	}
+
+	// New users get the invite's role, and only used invites are counted
+	var role string
+	var uses int
+	err = db.DBCon.QueryRow("select role from users where username='first'").Scan(&role)
+	if err == nil {
+		err = db.DBCon.QueryRow("select uses from invites where id=?", expired.ID).Scan(&uses)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != roleAdmin || uses != 0 {
+		t.Errorf("got role %q and %d uses of the expired invite, want %q and none", role, uses, roleAdmin)
+	}
+	if rows := userRows(t, "users", "third"); rows != 0 {
+		t.Error("user registered with a used up invite")
+	}
+}
@@ -0,0 +1,523 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/db"
+)
+
+// How long a user has to complete the login at the identity provider
+const oidcLoginTimeout = 10 * time.Minute
+
+// The most logins that can be in progress at once, as anyone can start one
+const oidcMaxPendingLogins = 10000
+
+// Ties the state parameter to the browser that started the login, so a login can't be completed in someone else's
+const oidcStateCookieName = "linkener_oidc_state"
+
+// Identifies a login that's waiting for the user's two-factor authentication code (see oidcSecondFactorHandler)
+const oidcSecondFactorCookieName = "linkener_oidc_2fa"
+
+type oidcProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+}
+
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	Expiry            int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	Email             string          `json:"email"`
+	EmailVerified     bool            `json:"email_verified"`
+	PreferredUsername string          `json:"preferred_username"`
+}
+
+type oidcPendingLogin struct {
+	nonce        string
+	codeVerifier string
+	expiry       time.Time
+}
+
+// oidcPendingSecondFactor - a user who has logged in at the identity provider, but not yet given their two-factor
+// authentication code
+type oidcPendingSecondFactor struct {
+	username string
+	expiry   time.Time
+}
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+var oidcMetadata *oidcProviderMetadata
+var oidcMetadataLock sync.Mutex
+
+// Logins started at the identity provider, by state parameter
+var oidcPendingLogins = map[string]oidcPendingLogin{}
+var oidcPendingLoginsLock sync.Mutex
+
+// Logins waiting for a two-factor authentication code, by the value of their oidcSecondFactorCookieName cookie
+var oidcPendingSecondFactors = map[string]oidcPendingSecondFactor{}
+var oidcPendingSecondFactorsLock sync.Mutex
+
+func randomURLString(length int) (string, error) {
+	bytes := make([]byte, length)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// getOIDCMetadata - fetch (once) the identity provider's discovery document
+func getOIDCMetadata() (*oidcProviderMetadata, error) {
+	oidcMetadataLock.Lock()
+	defer oidcMetadataLock.Unlock()
+
+	if oidcMetadata != nil {
+		return oidcMetadata, nil
+	}
+
+	issuer := strings.TrimSuffix(config.Config.OIDC.Issuer, "/")
+	res, err := oidcHTTPClient.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		println(err.Error())
+		return nil, errors.New("Failed to contact identity provider")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("Failed to fetch identity provider configuration")
+	}
+
+	var metadata oidcProviderMetadata
+	err = json.NewDecoder(res.Body).Decode(&metadata)
+	if err != nil {
+		println(err.Error())
+		return nil, errors.New("Invalid identity provider configuration")
+	}
+
+	if metadata.Issuer != issuer || metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" {
+		return nil, errors.New("Invalid identity provider configuration")
+	}
+
+	oidcMetadata = &metadata
+	return oidcMetadata, nil
+}
+
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	metadata, err := getOIDCMetadata()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	state, err := randomURLString(32)
+	var nonce, codeVerifier string
+	if err == nil {
+		nonce, err = randomURLString(32)
+	}
+	if err == nil {
+		codeVerifier, err = randomURLString(48)
+	}
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	oidcPendingLoginsLock.Lock()
+	for key, pending := range oidcPendingLogins {
+		if time.Now().After(pending.expiry) {
+			delete(oidcPendingLogins, key)
+		}
+	}
+	if len(oidcPendingLogins) >= oidcMaxPendingLogins {
+		oidcPendingLoginsLock.Unlock()
+		http.Error(w, "Too many logins in progress, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	oidcPendingLogins[state] = oidcPendingLogin{nonce: nonce, codeVerifier: codeVerifier, expiry: time.Now().Add(oidcLoginTimeout)}
+	oidcPendingLoginsLock.Unlock()
+
+	// Lax, as the identity provider redirects back to the callback from another site
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/" + config.Config.APIRoot,
+		Expires:  time.Now().Add(oidcLoginTimeout),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", config.Config.OIDC.ClientID)
+	query.Set("redirect_uri", config.Config.OIDC.RedirectURL)
+	query.Set("scope", strings.Join(config.Config.OIDC.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, metadata.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// exchangeOIDCCode - swap the authorization code for the user's ID token claims
+func exchangeOIDCCode(metadata *oidcProviderMetadata, code string, pending oidcPendingLogin) (*oidcClaims, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", config.Config.OIDC.RedirectURL)
+	form.Set("client_id", config.Config.OIDC.ClientID)
+	form.Set("code_verifier", pending.codeVerifier)
+	if config.Config.OIDC.ClientSecret != "" {
+		form.Set("client_secret", config.Config.OIDC.ClientSecret)
+	}
+
+	res, err := oidcHTTPClient.PostForm(metadata.TokenEndpoint, form)
+	if err != nil {
+		println(err.Error())
+		return nil, errors.New("Failed to contact identity provider")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("Identity provider rejected the login")
+	}
+
+	var tokens oidcTokenResponse
+	err = json.NewDecoder(res.Body).Decode(&tokens)
+	if err != nil || tokens.IDToken == "" {
+		return nil, errors.New("Invalid response from identity provider")
+	}
+
+	// The ID token comes straight from the token endpoint over a server-authenticated connection,
+	// so (per OpenID Connect Core 3.1.3.7) its claims can be validated without checking its signature
+	parts := strings.Split(tokens.IDToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Invalid ID token from identity provider")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, errors.New("Invalid ID token from identity provider")
+	}
+
+	var claims oidcClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, errors.New("Invalid ID token from identity provider")
+	}
+
+	if claims.Issuer != metadata.Issuer || !claims.hasAudience(config.Config.OIDC.ClientID) ||
+		time.Now().Unix() > claims.Expiry || claims.Nonce != pending.nonce || claims.Subject == "" {
+		return nil, errors.New("Invalid ID token from identity provider")
+	}
+
+	return &claims, nil
+}
+
+func (c *oidcClaims) hasAudience(clientID string) bool {
+	var single string
+	if json.Unmarshal(c.Audience, &single) == nil {
+		return single == clientID
+	}
+
+	var multiple []string
+	if json.Unmarshal(c.Audience, &multiple) == nil {
+		for _, audience := range multiple {
+			if audience == clientID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// usernameForClaims - find or (when registration is open) create the linkener user for an IdP identity
+func usernameForClaims(r *http.Request, claims *oidcClaims) (string, int, error) {
+	var username string
+	err := db.DBCon.QueryRow("select username from oidc_identities where issuer=? and subject=?", claims.Issuer, claims.Subject).Scan(&username)
+	if err == nil {
+		return username, 0, nil
+	}
+	if err != sql.ErrNoRows {
+		println(err.Error())
+		return "", http.StatusInternalServerError, errors.New("Failed to authenticate user")
+	}
+
+	switch config.Config.OIDC.UsernameClaim {
+	case "email":
+		username = claims.Email
+	case "preferred_username":
+		username = claims.PreferredUsername
+	case "sub":
+		username = claims.Subject
+	}
+	if username == "" {
+		return "", http.StatusForbidden, errors.New("Identity provider did not return a username")
+	}
+
+	var existing string
+	err = db.DBCon.QueryRow("select username from users where username=?", username).Scan(&existing)
+	if err != nil && err != sql.ErrNoRows {
+		println(err.Error())
+		return "", http.StatusInternalServerError, errors.New("Failed to authenticate user")
+	}
+
+	if existing != "" {
+		// Only link to an existing account when the IdP vouches for the email it's named after
+		if config.Config.OIDC.UsernameClaim != "email" || !claims.EmailVerified {
+			return "", http.StatusConflict, errors.New("A user with this username already exists")
+		}
+	} else if config.Config.RegistrationMode != registrationOpen {
+		return "", http.StatusForbidden, errors.New("No account exists for this user")
+	}
+
+	tx, err := db.DBCon.Begin()
+	if err != nil {
+		println(err.Error())
+		return "", http.StatusInternalServerError, errors.New("Failed to add new user")
+	}
+
+	if existing == "" {
+		// No password, so the account can only be logged into via the IdP
+		_, err = tx.Exec("insert into users(username, password) values(?, '')", username)
+	}
+	if err == nil {
+		_, err = tx.Exec("insert into oidc_identities(issuer, subject, username) values(?, ?, ?)", claims.Issuer, claims.Subject, username)
+	}
+	if err != nil {
+		tx.Rollback()
+		println(err.Error())
+		return "", http.StatusInternalServerError, errors.New("Failed to add new user")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		println(err.Error())
+		return "", http.StatusInternalServerError, errors.New("Failed to add new user")
+	}
+
+	if existing == "" {
+		recordAudit(r, username, "user.create", username, nil, map[string]string{"role": roleUser, "issuer": claims.Issuer})
+	}
+	recordAudit(r, username, "user.oidc_link", username, nil, map[string]string{"issuer": claims.Issuer, "subject": claims.Subject})
+	return username, 0, nil
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		http.Error(w, "Login failed: "+query.Get("error"), http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(w, "Invalid or expired login attempt", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Path: "/" + config.Config.APIRoot, MaxAge: -1})
+
+	oidcPendingLoginsLock.Lock()
+	pending, ok := oidcPendingLogins[state]
+	delete(oidcPendingLogins, state)
+	oidcPendingLoginsLock.Unlock()
+
+	if !ok || time.Now().After(pending.expiry) {
+		http.Error(w, "Invalid or expired login attempt", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := getOIDCMetadata()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	claims, err := exchangeOIDCCode(metadata, query.Get("code"), pending)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	username, status, err := usernameForClaims(r, claims)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// Unless the identity provider is trusted to have checked a second factor, users who've set up two-factor
+	// authentication in Linkener still need to give a code
+	scope := scopeFull
+	if !config.Config.OIDC.TrustProvider2FA {
+		var enabled bool
+		err = db.DBCon.QueryRow("select totp_enabled from users where username=?", username).Scan(&enabled)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to authenticate user", http.StatusInternalServerError)
+			return
+		}
+
+		if enabled {
+			startOIDCSecondFactor(w, r, username)
+			return
+		}
+		if config.Config.Require2FA {
+			scope = scopeEnrollment
+		}
+	}
+
+	if config.Config.OIDC.PostLoginRedirect == "" {
+		if writeNewTokens(w, username, "Single sign-on", scope) {
+			recordAudit(r, username, "user.login", username, nil, map[string]string{"method": "oidc", "scope": scope})
+		}
+		return
+	}
+
+	if startSession(w, r, username, scope) {
+		recordAudit(r, username, "user.login", username, nil, map[string]string{"method": "oidc", "scope": scope})
+		http.Redirect(w, r, config.Config.OIDC.PostLoginRedirect, http.StatusFound)
+	}
+}
+
+// startOIDCSecondFactor - remember that the user has logged in at the identity provider, and ask them for their
+// two-factor authentication code; they send it to oidcSecondFactorHandler from the same browser
+func startOIDCSecondFactor(w http.ResponseWriter, r *http.Request, username string) {
+	id, err := randomURLString(32)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to authenticate user", http.StatusInternalServerError)
+		return
+	}
+
+	oidcPendingSecondFactorsLock.Lock()
+	for key, pending := range oidcPendingSecondFactors {
+		if time.Now().After(pending.expiry) {
+			delete(oidcPendingSecondFactors, key)
+		}
+	}
+	if len(oidcPendingSecondFactors) >= oidcMaxPendingLogins {
+		oidcPendingSecondFactorsLock.Unlock()
+		http.Error(w, "Too many logins in progress, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	oidcPendingSecondFactors[id] = oidcPendingSecondFactor{username: username, expiry: time.Now().Add(oidcLoginTimeout)}
+	oidcPendingSecondFactorsLock.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcSecondFactorCookieName,
+		Value:    id,
+		Path:     "/" + config.Config.APIRoot,
+		Expires:  time.Now().Add(oidcLoginTimeout),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	if config.Config.OIDC.PostLoginRedirect == "" {
+		w.Header().Set("X-Linkener-OTP", "required")
+		http.Error(w, "Two-factor authentication code required", http.StatusUnauthorized)
+		return
+	}
+
+	redirect, err := url.Parse(config.Config.OIDC.PostLoginRedirect)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to authenticate user", http.StatusInternalServerError)
+		return
+	}
+	query := redirect.Query()
+	query.Set("otp", "required")
+	redirect.RawQuery = query.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// oidcSecondFactorHandler - finish a single sign-on login that's waiting for the user's two-factor authentication code
+func oidcSecondFactorHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(oidcSecondFactorCookieName)
+	if err != nil {
+		http.Error(w, "Invalid or expired login attempt", http.StatusBadRequest)
+		return
+	}
+
+	oidcPendingSecondFactorsLock.Lock()
+	pending, ok := oidcPendingSecondFactors[cookie.Value]
+	oidcPendingSecondFactorsLock.Unlock()
+	if !ok || time.Now().After(pending.expiry) {
+		http.Error(w, "Invalid or expired login attempt", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var decodedBody totpCodeRequest
+	err = json.Unmarshal(body, &decodedBody)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+		return
+	}
+
+	// Wrong codes count towards the user's backoff, so the login can be retried until it expires
+	if _, ok := checkSecondFactor(w, r, pending.username, decodedBody.Code, decodedBody.RecoveryCode); !ok {
+		return
+	}
+
+	oidcPendingSecondFactorsLock.Lock()
+	_, ok = oidcPendingSecondFactors[cookie.Value]
+	delete(oidcPendingSecondFactors, cookie.Value)
+	oidcPendingSecondFactorsLock.Unlock()
+	if !ok {
+		http.Error(w, "Invalid or expired login attempt", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcSecondFactorCookieName, Path: "/" + config.Config.APIRoot, MaxAge: -1})
+
+	if config.Config.OIDC.PostLoginRedirect == "" {
+		if writeNewTokens(w, pending.username, "Single sign-on", scopeFull) {
+			recordAudit(r, pending.username, "user.login", pending.username, nil, map[string]string{"method": "oidc", "scope": scopeFull})
+		}
+		return
+	}
+
+	if startSession(w, r, pending.username, scopeFull) {
+		recordAudit(r, pending.username, "user.login", pending.username, nil, map[string]string{"method": "oidc", "scope": scopeFull})
+		http.ResponseWriter.Write(w, []byte("Success!"))
+	}
+}
@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/db"
+)
+
+const mockOIDCClientID = "linkener-test"
+
+type mockOIDCCode struct {
+	challenge string
+	nonce     string
+}
+
+// mockOIDCProvider - a local OpenID Connect provider that logs everyone in as email, checking the PKCE code verifier
+type mockOIDCProvider struct {
+	server *httptest.Server
+	email  string
+
+	lock  sync.Mutex
+	codes map[string]mockOIDCCode
+}
+
+func newMockOIDCProvider(t *testing.T, email string) *mockOIDCProvider {
+	provider := &mockOIDCProvider{email: email, codes: map[string]mockOIDCCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcProviderMetadata{
+			Issuer:                provider.server.URL,
+			AuthorizationEndpoint: provider.server.URL + "/authorize",
+			TokenEndpoint:         provider.server.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/authorize", provider.authorize)
+	mux.HandleFunc("/token", provider.token)
+
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func (p *mockOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != mockOIDCClientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	code, _ := randomURLString(16)
+	p.lock.Lock()
+	p.codes[code] = mockOIDCCode{challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+	p.lock.Unlock()
+
+	callback := query.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, callback, http.StatusFound)
+}
+
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	code, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	p.lock.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("client_id") != mockOIDCClientID ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":            p.server.URL,
+		"sub":            "user-1",
+		"aud":            mockOIDCClientID,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"nonce":          code.nonce,
+		"email":          p.email,
+		"email_verified": true,
+	})
+	idToken := "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".c2ln"
+	json.NewEncoder(w).Encode(oidcTokenResponse{AccessToken: "at", IDToken: idToken})
+}
+
+// setUpMockOIDC - point the OIDC config at a new mock provider
+func setUpMockOIDC(t *testing.T) *mockOIDCProvider {
+	setUpTestAuthDB(t)
+	provider := newMockOIDCProvider(t, "alice@example.com")
+
+	oldConfig := config.Config
+	t.Cleanup(func() {
+		config.Config = oldConfig
+		oidcMetadata = nil
+	})
+	config.Config.RegistrationMode = registrationOpen
+	config.Config.OIDC.Enabled = true
+	config.Config.OIDC.Issuer = provider.server.URL
+	config.Config.OIDC.ClientID = mockOIDCClientID
+	config.Config.OIDC.ClientSecret = ""
+	config.Config.OIDC.RedirectURL = "http://linkener.test/api/auth/oidc/callback"
+	config.Config.OIDC.UsernameClaim = "email"
+	config.Config.OIDC.PostLoginRedirect = ""
+	oidcMetadata = nil
+	return provider
+}
+
+// startOIDCLogin - start a login, and have the mock provider authorize it. Returns the callback URL and the state cookie
+func startOIDCLogin(t *testing.T) (string, *http.Cookie) {
+	w := httptest.NewRecorder()
+	oidcLoginHandler(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("starting login: got status %d, want %d", w.Code, http.StatusFound)
+	}
+
+	var stateCookie *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcStateCookieName {
+			stateCookie = cookie
+		}
+	}
+	if stateCookie == nil {
+		t.Fatal("starting login: no state cookie set")
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorizing at provider: got status %d, want %d", res.StatusCode, http.StatusFound)
+	}
+
+	return res.Header.Get("Location"), stateCookie
+}
+
+func finishOIDCLogin(callback string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, callback, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	oidcCallbackHandler(w, r)
+	return w
+}
+
+func TestOIDCLogin(t *testing.T) {
+	setUpMockOIDC(t)
+
+	callback, cookie := startOIDCLogin(t)
+	w := finishOIDCLogin(callback, cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("finishing login: got status %d (%s), want %d", w.Code, w.Body.String(), http.StatusOK)
+	}
+
+	var tokens tokenResponse
+	err := json.NewDecoder(w.Body).Decode(&tokens)
+	if err != nil || tokens.AccessToken == "" {
+		t.Fatalf("finishing login: no access token in %q", w.Body.String())
+	}
+
+	var username string
+	err = db.DBCon.QueryRow("select username from oidc_identities where subject='user-1'").Scan(&username)
+	if err != nil || username != "alice@example.com" {
+		t.Errorf("got linked username %q (%v), want alice@example.com", username, err)
+	}
+
+	// Each login can only be finished once
+	w = finishOIDCLogin(callback, cookie)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("finishing login twice: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOIDCLoginNeedsStateCookie(t *testing.T) {
+	setUpMockOIDC(t)
+
+	callback, _ := startOIDCLogin(t)
+	w := finishOIDCLogin(callback, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("finishing login without state cookie: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// Another browser's login can't be finished with this one's cookie
+	_, cookie := startOIDCLogin(t)
+	w = finishOIDCLogin(callback, cookie)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("finishing login with another state cookie: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOIDCLoginChecksCodeVerifier(t *testing.T) {
+	setUpMockOIDC(t)
+
+	callback, cookie := startOIDCLogin(t)
+	oidcPendingLoginsLock.Lock()
+	pending := oidcPendingLogins[cookie.Value]
+	pending.codeVerifier = "not-the-verifier"
+	oidcPendingLogins[cookie.Value] = pending
+	oidcPendingLoginsLock.Unlock()
+
+	w := finishOIDCLogin(callback, cookie)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("finishing login with the wrong code verifier: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func sendOIDCSecondFactor(body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/oidc/2fa", strings.NewReader(body))
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	oidcSecondFactorHandler(w, r)
+	return w
+}
+
+func TestOIDCLoginNeedsSecondFactor(t *testing.T) {
+	setUpMockOIDC(t)
+	newTestUser(t, "alice@example.com", scopeFull)
+	recoveryCode := enableTestTOTP(t, "alice@example.com")
+
+	callback, cookie := startOIDCLogin(t)
+	w := finishOIDCLogin(callback, cookie)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("X-Linkener-OTP") != "required" {
+		t.Fatalf("finishing login with TOTP enabled: got status %d, want %d asking for a code", w.Code, http.StatusUnauthorized)
+	}
+
+	var secondFactorCookie *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcSecondFactorCookieName {
+			secondFactorCookie = cookie
+		}
+	}
+	if secondFactorCookie == nil {
+		t.Fatal("finishing login with TOTP enabled: no two-factor cookie set")
+	}
+
+	body := `{"recovery_code": "` + recoveryCode + `"}`
+	if w := sendOIDCSecondFactor(body, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("sending code without cookie: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := sendOIDCSecondFactor(`{"recovery_code": "00000-00000"}`, secondFactorCookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("sending wrong code: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w = sendOIDCSecondFactor(body, secondFactorCookie)
+	var tokens tokenResponse
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&tokens) != nil || tokens.AccessToken == "" {
+		t.Fatalf("sending right code: got status %d (%s), want tokens", w.Code, w.Body.String())
+	}
+
+	if w := sendOIDCSecondFactor(body, secondFactorCookie); w.Code != http.StatusBadRequest {
+		t.Errorf("sending code twice: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOIDCLoginTrustingProvider2FA(t *testing.T) {
+	setUpMockOIDC(t)
+	config.Config.OIDC.TrustProvider2FA = true
+	newTestUser(t, "alice@example.com", scopeFull)
+	enableTestTOTP(t, "alice@example.com")
+
+	callback, cookie := startOIDCLogin(t)
+	if w := finishOIDCLogin(callback, cookie); w.Code != http.StatusOK {
+		t.Errorf("finishing login trusting the provider's 2FA: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestOIDCLoginRequires2FAEnrollment(t *testing.T) {
+	setUpMockOIDC(t)
+	config.Config.Require2FA = true
+
+	callback, cookie := startOIDCLogin(t)
+	w := finishOIDCLogin(callback, cookie)
+	var tokens tokenResponse
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&tokens) != nil {
+		t.Fatalf("finishing login: got status %d (%s), want %d", w.Code, w.Body.String(), http.StatusOK)
+	}
+
+	var scope string
+	err := db.DBCon.QueryRow("select scope from access_tokens where token_hash=?", hashToken(tokens.AccessToken)).Scan(&scope)
+	if err != nil || scope != scopeEnrollment {
+		t.Errorf("got token scope %q (%v), want %q", scope, err, scopeEnrollment)
+	}
+}
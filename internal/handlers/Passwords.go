@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/db"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordResetCodeLifetime = 24 * time.Hour
+
+type resetCodeResponse struct {
+	ResetCode string    `json:"reset_code"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type resetPasswordRequest struct {
+	Username  string `json:"username"`
+	ResetCode string `json:"reset_code"`
+	Password  string `json:"password"`
+}
+
+// breachedPasswords holds the upper case hex SHA-1 of every password in the breached passwords file
+var breachedPasswords = map[string]bool{}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// loadBreachedPasswords - read the breached passwords file. Each line is either a plain password, or the SHA-1 of one
+// (optionally followed by ":count", as in Have I Been Pwned's downloadable lists)
+func loadBreachedPasswords() error {
+	location := config.Config.PasswordPolicy.BreachedPasswordsFile
+	if location == "" {
+		return nil
+	}
+
+	file, err := os.Open(location)
+	if err != nil {
+		println(err.Error())
+		return errors.New("Failed to open breached passwords file")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		hash := strings.SplitN(line, ":", 2)[0]
+		if _, err := hex.DecodeString(hash); err == nil && len(hash) == sha1.Size*2 {
+			breachedPasswords[strings.ToUpper(hash)] = true
+		} else {
+			breachedPasswords[sha1Hex(line)] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		println(err.Error())
+		return errors.New("Failed to read breached passwords file")
+	}
+
+	return nil
+}
+
+// checkPasswordPolicy - returns an error describing why the password isn't allowed, if it isn't
+func checkPasswordPolicy(password string) error {
+	if len([]rune(password)) < config.Config.PasswordPolicy.MinLength {
+		return fmt.Errorf("Password must be at least %d characters long", config.Config.PasswordPolicy.MinLength)
+	}
+
+	if breachedPasswords[sha1Hex(password)] {
+		return errors.New("Password has appeared in a data breach, please choose another")
+	}
+
+	return nil
+}
+
+// revokeOtherTokens - revoke all of a user's access tokens (including API keys) and refresh tokens, except keepTokenID
+func revokeOtherTokens(username string, keepTokenID int64) error {
+	tx, err := db.DBCon.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("delete from access_tokens where username=? and id!=?", username, keepTokenID)
+	if err == nil {
+		_, err = tx.Exec("delete from refresh_tokens where username=? and access_token_id!=?", username, keepTokenID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func newResetCodeHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
+	if !isAdmin(r) {
+		http.Error(w, "Unauthorized access", http.StatusForbidden)
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	var exists bool
+	err := db.DBCon.QueryRow("select count(*) > 0 from users where username=?", username).Scan(&exists)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to generate reset code", http.StatusInternalServerError)
+		return
+	}
+
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	resetCode, err := generateAccessToken()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to generate reset code", http.StatusInternalServerError)
+		return
+	}
+	resetCode = resetCode[:20]
+
+	expiry := time.Now().UTC().Truncate(time.Second).Add(passwordResetCodeLifetime)
+	_, err = db.DBCon.Exec("insert or replace into password_reset_codes(username, code_hash, expiry) values(?, ?, ?)",
+		username, hashToken(resetCode), expiry.Format(sqliteTimeFormat))
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to generate reset code", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, r.Context().Value(UsernameContextKey).(string), "user.password_reset_code", username, nil, map[string]time.Time{"expires_at": expiry})
+	json.NewEncoder(w).Encode(resetCodeResponse{ResetCode: resetCode, ExpiresAt: expiry})
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var decodedBody resetPasswordRequest
+	err = json.Unmarshal(body, &decodedBody)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+		return
+	}
+
+	var storedHash string
+	err = db.DBCon.QueryRow("select code_hash from password_reset_codes where username=? and expiry>CURRENT_TIMESTAMP", decodedBody.Username).Scan(&storedHash)
+	if err != nil && err != sql.ErrNoRows {
+		println(err.Error())
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	if err == sql.ErrNoRows || !tokenHashMatches(storedHash, decodedBody.ResetCode) {
+		recordAudit(r, decodedBody.Username, "user.password_reset_failed", decodedBody.Username, nil, nil)
+		http.Error(w, "Invalid or expired reset code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := checkPasswordPolicy(decodedBody.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(decodedBody.Password), bcrypt.DefaultCost)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.DBCon.Begin()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("update users set password=? where username=?", string(hashedPassword), decodedBody.Username)
+	if err == nil {
+		_, err = tx.Exec("delete from password_reset_codes where username=?", decodedBody.Username)
+	}
+	if err != nil {
+		tx.Rollback()
+		println(err.Error())
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	err = revokeOtherTokens(decodedBody.Username, 0)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Password reset, but failed to revoke existing access tokens", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, decodedBody.Username, "user.password_reset", decodedBody.Username, nil, nil)
+	http.ResponseWriter.Write(w, []byte("Success!"))
+}
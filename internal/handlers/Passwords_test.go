@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/shu8/linkener/internal/config"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	oldPolicy, oldBreached := config.Config.PasswordPolicy, breachedPasswords
+	t.Cleanup(func() {
+		config.Config.PasswordPolicy = oldPolicy
+		breachedPasswords = oldBreached
+	})
+
+	// Breached passwords can be listed in plain text or as SHA-1s
+	location := filepath.Join(t.TempDir(), "breached.txt")
+	err := ioutil.WriteFile(location, []byte("password123\n"+sha1Hex("letmein!!")+":42\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Config.PasswordPolicy.MinLength = 8
+	config.Config.PasswordPolicy.BreachedPasswordsFile = location
+	breachedPasswords = map[string]bool{}
+	err = loadBreachedPasswords()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for password, allowed := range map[string]bool{
+		"":                     false,
+		"short":                false,
+		"password123":          false,
+		"letmein!!":            false,
+		"correct horse staple": true,
+	} {
+		if err := checkPasswordPolicy(password); (err == nil) != allowed {
+			t.Errorf("%q: got error %v, want allowed %v", password, err, allowed)
+		}
+	}
+}
+
+func TestPasswordChangeRevokesOtherTokens(t *testing.T) {
+	setUpTestAuthDB(t)
+	current := newTestUser(t, "alice", scopeFull)
+	other := newTestToken(t, "alice", scopeFull)
+	bob := newTestUser(t, "bob", scopeFull)
+
+	changePassword := func(password string) int {
+		w := serveAuthorized(func(w http.ResponseWriter, r *http.Request) {
+			editUserHandler(w, mux.SetURLVars(r, map[string]string{"username": "alice"}))
+		}, http.MethodPut, "/api/auth/users/alice", `{"password": "`+password+`"}`, current)
+		return w.Code
+	}
+
+	if code := changePassword(""); code != http.StatusBadRequest {
+		t.Errorf("empty password: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	if !accessTokenExists(t, other) {
+		t.Fatal("rejected password change: other token was revoked")
+	}
+
+	if code := changePassword("correct horse staple"); code != http.StatusOK {
+		t.Fatalf("changing password: got status %d, want %d", code, http.StatusOK)
+	}
+	if !accessTokenExists(t, current) || accessTokenExists(t, other) || !accessTokenExists(t, bob) {
+		t.Error("changing password: want only the user's other tokens revoked")
+	}
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/stores"
+
+	"github.com/gorilla/mux"
+)
+
+// What to do in privacy mode with visits from visitors who asked not to be tracked
+const (
+	doNotTrackAnonymise = "anonymise"
+	doNotTrackSkip      = "skip"
+	doNotTrackIgnore    = "ignore"
+)
+
+// The salt IPs are hashed with in privacy mode. It's never stored, so hashes can't be linked across rotations
+var ipSalt []byte
+var ipSaltCreated time.Time
+var ipSaltLock sync.Mutex
+
+// validatePrivacyConfig - check the privacy config options are valid
+func validatePrivacyConfig() error {
+	privacyConfig := config.Config.Privacy
+	if !privacyConfig.Enabled {
+		return nil
+	}
+
+	if privacyConfig.SaltRotation <= 0 {
+		return errors.New("Invalid privacy salt_rotation")
+	}
+
+	if privacyConfig.DoNotTrack != doNotTrackAnonymise && privacyConfig.DoNotTrack != doNotTrackSkip && privacyConfig.DoNotTrack != doNotTrackIgnore {
+		return errors.New("Invalid privacy do_not_track: " + privacyConfig.DoNotTrack)
+	}
+
+	return nil
+}
+
+// currentIPSalt - the salt to hash IPs with, replacing it if it's older than salt_rotation
+func currentIPSalt() ([]byte, error) {
+	ipSaltLock.Lock()
+	defer ipSaltLock.Unlock()
+
+	if ipSalt == nil || time.Since(ipSaltCreated) >= time.Duration(config.Config.Privacy.SaltRotation)*time.Second {
+		salt := make([]byte, 32)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+		ipSalt = salt
+		ipSaltCreated = time.Now()
+	}
+
+	return ipSalt, nil
+}
+
+// anonymiseIP - the IP truncated to its /24 (IPv4) or /48 (IPv6) network, hashed with the current salt
+func anonymiseIP(ip string) (string, error) {
+	// Anything that isn't an IP is still hashed, in case it's identifying
+	network := ip
+	if parsed := net.ParseIP(ip); parsed != nil {
+		if parsed.To4() != nil {
+			network = parsed.Mask(net.CIDRMask(24, 32)).String()
+		} else {
+			network = parsed.Mask(net.CIDRMask(48, 128)).String()
+		}
+	}
+
+	salt, err := currentIPSalt()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(network))
+	return hex.EncodeToString(mac.Sum(nil))[:16], nil
+}
+
+// doNotTrack - whether the visitor's browser asked not to be tracked, with either DNT or Global Privacy Control
+func doNotTrack(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+// webhookReferer - the referer to send in webhook payloads about a request: none in privacy mode if the visitor asked
+// not to be tracked, as webhooks send it on to other services
+func webhookReferer(r *http.Request, referer string) string {
+	if config.Config.Privacy.Enabled && doNotTrack(r) {
+		return ""
+	}
+	return referer
+}
+
+// newVisitRecord - the visit to record for a request, anonymised according to the privacy config. Outside privacy mode,
+// visitors' IPs and user agents are only kept if store_visitor_details is on
+func newVisitRecord(r *http.Request, slug, referer string) (stores.VisitRecord, error) {
+	now := time.Now().UTC()
+	visit := stores.VisitRecord{Slug: slug, Visit: stores.Visit{
+		Referer:  referer,
+		Time:     &now,
+		Bot:      isBot(r),
+		Campaign: campaignParams(r.URL.Query()),
+	}}
+
+	privacyConfig := config.Config.Privacy
+	if !privacyConfig.Enabled {
+		if privacyConfig.StoreVisitorDetails {
+			visit.Visit.IP = requestIP(r)
+			visit.Visit.UserAgent = r.UserAgent()
+		}
+		return visit, nil
+	}
+
+	if doNotTrack(r) && privacyConfig.DoNotTrack != doNotTrackIgnore {
+		// Visits still count towards visit limits either way
+		visit.CountOnly = privacyConfig.DoNotTrack == doNotTrackSkip
+		return visit, nil
+	}
+
+	ip, err := anonymiseIP(requestIP(r))
+	if err != nil {
+		return visit, err
+	}
+	visit.Visit.IP = ip
+	visit.Visit.UserAgent = r.UserAgent()
+	return visit, nil
+}
+
+func purgeVisitsHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
+	url, err := store.GetURL(mux.Vars(r)["slug"], false)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to delete visits", http.StatusInternalServerError)
+		return
+	}
+
+	if url == nil {
+		http.Error(w, "No URL found", http.StatusNotFound)
+		return
+	}
+
+	if !requireURLPermission(w, r, url, workspaceEdit) {
+		return
+	}
+
+	err = store.PurgeVisits(url.Slug)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to delete visits", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, requestUsername(r), "url.purge_visits", url.Slug, nil, nil)
+	http.ResponseWriter.Write(w, []byte("Success!"))
+}
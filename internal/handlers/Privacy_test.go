@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shu8/linkener/internal/config"
+)
+
+func TestWebhookReferer(t *testing.T) {
+	oldPrivacy := config.Config.Privacy
+	t.Cleanup(func() { config.Config.Privacy = oldPrivacy })
+
+	for _, test := range []struct {
+		privacy bool
+		header  string
+		want    string
+	}{
+		{false, "", "https://example.com/"},
+		{false, "DNT", "https://example.com/"},
+		{true, "", "https://example.com/"},
+		{true, "DNT", ""},
+		{true, "Sec-GPC", ""},
+	} {
+		config.Config.Privacy.Enabled = test.privacy
+		r := httptest.NewRequest(http.MethodGet, "/example", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, "1")
+		}
+
+		if got := webhookReferer(r, "https://example.com/"); got != test.want {
+			t.Errorf("privacy %v with %q: got referer %q, want %q", test.privacy, test.header, got, test.want)
+		}
+	}
+}
+
+func TestNewVisitRecordVisitorDetails(t *testing.T) {
+	oldPrivacy := config.Config.Privacy
+	t.Cleanup(func() { config.Config.Privacy = oldPrivacy })
+
+	r := httptest.NewRequest(http.MethodGet, "/example", nil)
+	r.RemoteAddr = "203.0.113.7:1234"
+	r.Header.Set("User-Agent", testBrowserUserAgent)
+
+	// By default, nothing identifying is stored
+	visit, err := newVisitRecord(r, "example", "")
+	if err != nil || visit.Visit.IP != "" || visit.Visit.UserAgent != "" {
+		t.Errorf("default config: got IP %q, user agent %q and error %v, want neither stored", visit.Visit.IP, visit.Visit.UserAgent, err)
+	}
+
+	config.Config.Privacy.StoreVisitorDetails = true
+	visit, err = newVisitRecord(r, "example", "")
+	if err != nil || visit.Visit.IP != "203.0.113.7" || visit.Visit.UserAgent != testBrowserUserAgent {
+		t.Errorf("store_visitor_details: got IP %q, user agent %q and error %v, want them stored", visit.Visit.IP, visit.Visit.UserAgent, err)
+	}
+}
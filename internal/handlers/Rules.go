@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shu8/linkener/internal/stores"
+)
+
+// Operating systems routing rules can match
+const (
+	osAndroid  = "android"
+	osIOS      = "ios"
+	osWindows  = "windows"
+	osMacOS    = "macos"
+	osLinux    = "linux"
+	osChromeOS = "chromeos"
+)
+
+// osUserAgents are the lowercase substrings of user agents identifying each operating system, in the order to check
+// them; e.g. iOS user agents contain "like Mac OS X", and Android and Chrome OS ones contain "Linux"
+var osUserAgents = []struct {
+	os       string
+	patterns []string
+}{
+	{osIOS, []string{"iphone", "ipad", "ipod"}},
+	{osAndroid, []string{"android"}},
+	{osChromeOS, []string{"cros"}},
+	{osWindows, []string{"windows"}},
+	{osMacOS, []string{"macintosh", "mac os x"}},
+	{osLinux, []string{"linux"}},
+}
+
+var ruleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+const ruleTimeFormat = "15:04"
+
+// validateRules - check a short URL's routing rules are valid
+func validateRules(rules []stores.RoutingRule) error {
+	for i, rule := range rules {
+		err := validateRule(rule)
+		if err != nil {
+			return errors.New("Rule " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// validateRule - check a routing rule's URL and conditions are valid
+func validateRule(rule stores.RoutingRule) error {
+	if parsed, err := url.Parse(rule.URL); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return errors.New("URL must be absolute")
+	}
+
+	for _, os := range rule.OS {
+		known := false
+		for _, osUserAgent := range osUserAgents {
+			known = known || os == osUserAgent.os
+		}
+		if !known {
+			return errors.New("Unknown OS: " + os)
+		}
+	}
+
+	for _, language := range rule.Languages {
+		if language == "" || strings.ContainsAny(language, " ,;") {
+			return errors.New("Invalid language: " + language)
+		}
+	}
+
+	if rule.Header != nil && rule.Header.Name == "" {
+		return errors.New("Header name required")
+	}
+
+	if rule.Query != nil && rule.Query.Name == "" {
+		return errors.New("Query parameter name required")
+	}
+
+	if window := rule.Time; window != nil {
+		for _, t := range []string{window.Start, window.End} {
+			if _, err := time.Parse(ruleTimeFormat, t); t != "" && err != nil {
+				return errors.New("Invalid time: " + t)
+			}
+		}
+		if window.Start != "" && window.Start == window.End {
+			return errors.New("Start and end times must be different")
+		}
+
+		for _, day := range window.Days {
+			if _, ok := ruleDays[day]; !ok {
+				return errors.New("Invalid day: " + day)
+			}
+		}
+
+		if _, err := time.LoadLocation(window.TimeZone); err != nil {
+			return errors.New("Unknown time zone: " + window.TimeZone)
+		}
+	}
+
+	return nil
+}
+
+// requestOS - the operating system in the request's user agent, or "" if it's not one rules can match
+func requestOS(r *http.Request) string {
+	userAgent := strings.ToLower(r.UserAgent())
+	for _, osUserAgent := range osUserAgents {
+		for _, pattern := range osUserAgent.patterns {
+			if strings.Contains(userAgent, pattern) {
+				return osUserAgent.os
+			}
+		}
+	}
+
+	return ""
+}
+
+// preferredLanguage - the language in the request's Accept-Language header with the highest quality, lowercase
+func preferredLanguage(r *http.Request) string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+
+	languages := []language{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		if tag != "" && tag != "*" && quality > 0 {
+			languages = append(languages, language{tag, quality})
+		}
+	}
+
+	if len(languages) == 0 {
+		return ""
+	}
+
+	// Earlier languages win ties
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+	return languages[0].tag
+}
+
+// inTimeWindow - whether the time is within the window, in the window's time zone
+func inTimeWindow(window *stores.RuleTimeWindow, now time.Time) bool {
+	location, err := time.LoadLocation(window.TimeZone)
+	if err != nil {
+		println(err.Error())
+		return false
+	}
+	now = now.In(location)
+
+	minutes := func(t string) int {
+		parsed, _ := time.Parse(ruleTimeFormat, t)
+		return parsed.Hour()*60 + parsed.Minute()
+	}
+	current := now.Hour()*60 + now.Minute()
+
+	// Visits after midnight in windows that wrap past it are on the day the window started
+	day := now.Weekday()
+	if window.Start != "" && window.End != "" {
+		start, end := minutes(window.Start), minutes(window.End)
+		if start <= end && (current < start || current >= end) {
+			return false
+		}
+		if start > end {
+			if current >= end && current < start {
+				return false
+			}
+			if current < end {
+				day = (day + 6) % 7
+			}
+		}
+	} else if window.Start != "" && current < minutes(window.Start) {
+		return false
+	} else if window.End != "" && current >= minutes(window.End) {
+		return false
+	}
+
+	if len(window.Days) == 0 {
+		return true
+	}
+	for _, d := range window.Days {
+		if ruleDays[d] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleMatches - whether the request matches all of the rule's conditions
+func ruleMatches(rule stores.RoutingRule, r *http.Request, now time.Time) bool {
+	if len(rule.OS) > 0 {
+		os := requestOS(r)
+		matched := false
+		for _, ruleOS := range rule.OS {
+			matched = matched || ruleOS == os
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if rule.UserAgent != "" && !strings.Contains(strings.ToLower(r.UserAgent()), strings.ToLower(rule.UserAgent)) {
+		return false
+	}
+
+	if len(rule.Languages) > 0 {
+		language := preferredLanguage(r)
+		matched := false
+		for _, ruleLanguage := range rule.Languages {
+			ruleLanguage = strings.ToLower(ruleLanguage)
+			matched = matched || language == ruleLanguage || strings.HasPrefix(language, ruleLanguage+"-")
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if rule.Header != nil {
+		values := r.Header.Values(rule.Header.Name)
+		if len(values) == 0 || (rule.Header.Value != "" && values[0] != rule.Header.Value) {
+			return false
+		}
+	}
+
+	if rule.Query != nil {
+		values, ok := r.URL.Query()[rule.Query.Name]
+		if !ok || (rule.Query.Value != "" && values[0] != rule.Query.Value) {
+			return false
+		}
+	}
+
+	if rule.Time != nil && !inTimeWindow(rule.Time, now) {
+		return false
+	}
+
+	return true
+}
+
+// matchRule - the number (from 1) of the short URL's first routing rule the request matches, or 0 if none do
+func matchRule(link *stores.ShortURL, r *http.Request, now time.Time) int {
+	for i, rule := range link.Rules {
+		if ruleMatches(rule, r, now) {
+			return i + 1
+		}
+	}
+
+	return 0
+}
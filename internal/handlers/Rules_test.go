@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shu8/linkener/internal/stores"
+)
+
+const (
+	iPhoneUserAgent  = "Mozilla/5.0 (iPhone; CPU iPhone OS 14_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148"
+	androidUserAgent = "Mozilla/5.0 (Linux; Android 11; Pixel 5) AppleWebKit/537.36 Chrome/90.0 Mobile Safari/537.36"
+	macUserAgent     = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 Version/14.0 Safari/605.1.15"
+)
+
+func TestRequestOS(t *testing.T) {
+	tests := map[string]string{
+		iPhoneUserAgent:  osIOS,
+		androidUserAgent: osAndroid,
+		macUserAgent:     osMacOS,
+		"Mozilla/5.0 (X11; CrOS x86_64 13904.97.0) Chrome/91.0": osChromeOS,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/91.0": osWindows,
+		"Mozilla/5.0 (X11; Linux x86_64) Firefox/89.0":          osLinux,
+		"curl/7.68.0": "",
+	}
+
+	for userAgent, want := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/s", nil)
+		r.Header.Set("User-Agent", userAgent)
+		if got := requestOS(r); got != want {
+			t.Errorf("requestOS(%q): got %q, want %q", userAgent, got, want)
+		}
+	}
+}
+
+func TestPreferredLanguage(t *testing.T) {
+	tests := map[string]string{
+		"":                          "",
+		"fr-CH, fr;q=0.9, en;q=0.8": "fr-ch",
+		"en;q=0.5, de":              "de",
+		"*, es;q=0.1":               "es",
+		"en;q=0, it;q=0.2":          "it",
+		"nl;q=0.7, pt;q=0.7":        "nl",
+	}
+
+	for header, want := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/s", nil)
+		r.Header.Set("Accept-Language", header)
+		if got := preferredLanguage(r); got != want {
+			t.Errorf("preferredLanguage(%q): got %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	// A Monday
+	monday := time.Date(2021, time.June, 7, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		rule      stores.RoutingRule
+		target    string
+		userAgent string
+		language  string
+		header    string
+		now       time.Time
+		want      bool
+	}{
+		{"no conditions", stores.RoutingRule{}, "/s", "", "", "", monday, true},
+		{"OS", stores.RoutingRule{OS: []string{osAndroid, osIOS}}, "/s", iPhoneUserAgent, "", "", monday, true},
+		{"other OS", stores.RoutingRule{OS: []string{osAndroid}}, "/s", macUserAgent, "", "", monday, false},
+		{"user agent", stores.RoutingRule{UserAgent: "pixel"}, "/s", androidUserAgent, "", "", monday, true},
+		{"language", stores.RoutingRule{Languages: []string{"de", "fr"}}, "/s", "", "fr-CH, en;q=0.5", "", monday, true},
+		{"language prefix only on subtags", stores.RoutingRule{Languages: []string{"fr"}}, "/s", "", "fry", "", monday, false},
+		{"non-preferred language", stores.RoutingRule{Languages: []string{"en"}}, "/s", "", "fr-CH, en;q=0.5", "", monday, false},
+		{"header present", stores.RoutingRule{Header: &stores.RuleMatch{Name: "X-Beta"}}, "/s", "", "", "1", monday, true},
+		{"header value", stores.RoutingRule{Header: &stores.RuleMatch{Name: "X-Beta", Value: "2"}}, "/s", "", "", "1", monday, false},
+		{"header missing", stores.RoutingRule{Header: &stores.RuleMatch{Name: "X-Beta"}}, "/s", "", "", "", monday, false},
+		{"query present", stores.RoutingRule{Query: &stores.RuleMatch{Name: "beta"}}, "/s?beta", "", "", "", monday, true},
+		{"query value", stores.RoutingRule{Query: &stores.RuleMatch{Name: "v", Value: "2"}}, "/s?v=2", "", "", "", monday, true},
+		{"query missing", stores.RoutingRule{Query: &stores.RuleMatch{Name: "v"}}, "/s?w=2", "", "", "", monday, false},
+		{"all conditions", stores.RoutingRule{OS: []string{osIOS}, Query: &stores.RuleMatch{Name: "v"}}, "/s", iPhoneUserAgent, "", "", monday, false},
+		{"in time window", stores.RoutingRule{Time: &stores.RuleTimeWindow{Start: "09:00", End: "17:00", TimeZone: "UTC"}}, "/s", "", "", "", monday, true},
+		{"time window end", stores.RoutingRule{Time: &stores.RuleTimeWindow{Start: "09:00", End: "12:00", TimeZone: "UTC"}}, "/s", "", "", "", monday, false},
+		{"time zone", stores.RoutingRule{Time: &stores.RuleTimeWindow{Start: "07:00", End: "09:00", TimeZone: "America/New_York"}}, "/s", "", "", "", monday, true},
+		{"time zone outside", stores.RoutingRule{Time: &stores.RuleTimeWindow{Start: "09:00", End: "17:00", TimeZone: "Asia/Tokyo"}}, "/s", "", "", "", monday, false},
+		{"day", stores.RoutingRule{Time: &stores.RuleTimeWindow{Days: []string{"mon"}, TimeZone: "UTC"}}, "/s", "", "", "", monday, true},
+		{"other day", stores.RoutingRule{Time: &stores.RuleTimeWindow{Days: []string{"sat", "sun"}, TimeZone: "UTC"}}, "/s", "", "", "", monday, false},
+		// Windows wrapping past midnight count as the day they started on
+		{"overnight", stores.RoutingRule{Time: &stores.RuleTimeWindow{Start: "22:00", End: "06:00", Days: []string{"sun"}, TimeZone: "UTC"}}, "/s", "", "", "", monday.Add(-9 * time.Hour), true},
+		{"overnight other day", stores.RoutingRule{Time: &stores.RuleTimeWindow{Start: "22:00", End: "06:00", Days: []string{"mon"}, TimeZone: "UTC"}}, "/s", "", "", "", monday.Add(-9 * time.Hour), false},
+		{"overnight daytime", stores.RoutingRule{Time: &stores.RuleTimeWindow{Start: "22:00", End: "06:00", TimeZone: "UTC"}}, "/s", "", "", "", monday, false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.target, nil)
+		r.Header.Set("User-Agent", test.userAgent)
+		if test.language != "" {
+			r.Header.Set("Accept-Language", test.language)
+		}
+		if test.header != "" {
+			r.Header.Set("X-Beta", test.header)
+		}
+
+		if got := ruleMatches(test.rule, r, test.now); got != test.want {
+			t.Errorf("%s: got match %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMatchRuleUsesFirstMatch(t *testing.T) {
+	link := &stores.ShortURL{URL: "https://example.com/", Rules: []stores.RoutingRule{
+		{URL: "https://example.com/android", OS: []string{osAndroid}},
+		{URL: "https://example.com/mobile", OS: []string{osAndroid, osIOS}},
+	}}
+
+	tests := map[string]int{androidUserAgent: 1, iPhoneUserAgent: 2, macUserAgent: 0}
+	for userAgent, want := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/s", nil)
+		r.Header.Set("User-Agent", userAgent)
+		if got := matchRule(link, r, time.Now()); got != want {
+			t.Errorf("matchRule for %q: got rule %d, want %d", userAgent, got, want)
+		}
+	}
+}
+
+func TestRuleDestination(t *testing.T) {
+	link := &stores.ShortURL{
+		URL:      "https://example.com/{query.q}",
+		Template: true,
+		UTM:      stores.UTMParams{Source: "short"},
+		Rules:    []stores.RoutingRule{{URL: "https://m.example.com/{query.q}", OS: []string{osIOS}}},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/s?q=shoes", nil)
+
+	destination, err := destinationURL(link, 1, "", r)
+	if err != nil || destination != "https://m.example.com/shoes?utm_source=short" {
+		t.Errorf("got destination %q (%v), want the rule's filled in template with the link's UTM parameters", destination, err)
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	valid := []stores.RoutingRule{
+		{URL: "https://example.com/", OS: []string{osLinux}, Languages: []string{"en-GB"}},
+		{URL: "https://example.com/", Time: &stores.RuleTimeWindow{Start: "22:00", End: "06:00", Days: []string{"fri"}, TimeZone: "Europe/London"}},
+	}
+	if err := validateRules(valid); err != nil {
+		t.Errorf("valid rules: got error %v", err)
+	}
+
+	invalid := []stores.RoutingRule{
+		{URL: "/relative"},
+		{URL: "https://example.com/", OS: []string{"beos"}},
+		{URL: "https://example.com/", Languages: []string{"en, fr"}},
+		{URL: "https://example.com/", Header: &stores.RuleMatch{}},
+		{URL: "https://example.com/", Query: &stores.RuleMatch{}},
+		{URL: "https://example.com/", Time: &stores.RuleTimeWindow{Start: "25:00"}},
+		{URL: "https://example.com/", Time: &stores.RuleTimeWindow{Start: "09:00", End: "09:00"}},
+		{URL: "https://example.com/", Time: &stores.RuleTimeWindow{Days: []string{"monday"}}},
+		{URL: "https://example.com/", Time: &stores.RuleTimeWindow{TimeZone: "Mars/Olympus_Mons"}},
+	}
+	for _, rule := range invalid {
+		if err := validateRules([]stores.RoutingRule{rule}); err == nil {
+			t.Errorf("invalid rule %+v: got no error", rule)
+		}
+	}
+}
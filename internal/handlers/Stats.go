@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/stores"
+
+	"github.com/gorilla/mux"
+)
+
+type dailyVisits struct {
+	Date   string `json:"date"`
+	Visits int    `json:"visits"`
+	Bots   int    `json:"bots"`
+}
+
+type refererVisits struct {
+	Referer string `json:"referer"`
+	Visits  int    `json:"visits"`
+}
+
+type ruleVisits struct {
+	Rule   int `json:"rule"`
+	Visits int `json:"visits"`
+}
+
+type visitStats struct {
+	Slug     string          `json:"slug"`
+	Total    int             `json:"total"`
+	Bots     int             `json:"bots"`
+	Daily    []dailyVisits   `json:"daily"`
+	Referers []refererVisits `json:"referers"`
+	Rules    []ruleVisits    `json:"rules"`
+}
+
+// getVisitStats - a short URL's visits per day, per referer and per routing rule, combining the visits still kept
+// individually with those that have been rolled up. Bot visits are counted separately, and not by referer or rule
+func getVisitStats(store stores.Store, url *stores.ShortURL) (*visitStats, error) {
+	rollups, err := store.GetVisitRollups(url.Slug)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := visitStats{Slug: url.Slug, Daily: []dailyVisits{}, Referers: []refererVisits{}, Rules: []ruleVisits{}}
+	daily := map[string]*dailyVisits{}
+	referers := map[string]int{}
+	rules := map[int]int{}
+	count := func(date, referer string, bot bool, rule, visits int) {
+		day := daily[date]
+		// Visits recorded before visit times were have no date, so only count towards the totals
+		if day == nil && date != "" {
+			day = &dailyVisits{Date: date}
+			daily[date] = day
+		}
+
+		if bot {
+			stats.Bots += visits
+			if day != nil {
+				day.Bots += visits
+			}
+		} else {
+			stats.Total += visits
+			referers[referer] += visits
+			rules[rule] += visits
+			if day != nil {
+				day.Visits += visits
+			}
+		}
+	}
+
+	for _, rollup := range *rollups {
+		count(rollup.Date, rollup.Referer, rollup.Bot, rollup.Rule, rollup.Visits)
+	}
+	for _, visit := range url.Visits {
+		date := ""
+		if visit.Time != nil {
+			date = visit.Time.UTC().Format("2006-01-02")
+		}
+		count(date, visit.Referer, visit.Bot, visit.Rule, 1)
+	}
+
+	for _, day := range daily {
+		stats.Daily = append(stats.Daily, *day)
+	}
+	sort.Slice(stats.Daily, func(i, j int) bool {
+		return stats.Daily[i].Date < stats.Daily[j].Date
+	})
+
+	for referer, visits := range referers {
+		stats.Referers = append(stats.Referers, refererVisits{Referer: referer, Visits: visits})
+	}
+	// Most visits first
+	sort.Slice(stats.Referers, func(i, j int) bool {
+		if stats.Referers[i].Visits != stats.Referers[j].Visits {
+			return stats.Referers[i].Visits > stats.Referers[j].Visits
+		}
+		return stats.Referers[i].Referer < stats.Referers[j].Referer
+	})
+
+	for rule, visits := range rules {
+		stats.Rules = append(stats.Rules, ruleVisits{Rule: rule, Visits: visits})
+	}
+	sort.Slice(stats.Rules, func(i, j int) bool {
+		return stats.Rules[i].Rule < stats.Rules[j].Rule
+	})
+
+	return &stats, nil
+}
+
+// compactVisits - roll up the visits older than the retention period into daily totals. Only whole days (UTC) are
+// rolled up
+func compactVisits(store stores.Store) error {
+	before := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -config.Config.VisitRetention.Days)
+	compacted, err := store.CompactVisits(before)
+	if err != nil {
+		return err
+	}
+
+	if compacted > 0 {
+		println("Rolled up " + strconv.Itoa(compacted) + " visits from before " + before.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// StartVisitCompactor - roll up old visits in the background every compact_interval, unless visits are kept forever
+func StartVisitCompactor() error {
+	retentionConfig := config.Config.VisitRetention
+	if retentionConfig.Days < 0 {
+		return errors.New("Invalid visit_retention days")
+	}
+
+	if retentionConfig.Days == 0 {
+		return nil
+	}
+
+	if retentionConfig.CompactInterval <= 0 {
+		return errors.New("Invalid visit_retention compact_interval")
+	}
+
+	store, err := stores.StoreFactory(config.Config.StoreType)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			err := compactVisits(store)
+			if err != nil {
+				println("Failed to roll up visits: " + err.Error())
+			}
+			time.Sleep(time.Duration(retentionConfig.CompactInterval) * time.Second)
+		}
+	}()
+
+	return nil
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
+	url, err := store.GetURL(mux.Vars(r)["slug"], true)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to fetch stats", http.StatusInternalServerError)
+		return
+	}
+
+	if url == nil {
+		http.Error(w, "No URL found", http.StatusNotFound)
+		return
+	}
+
+	if !requireURLPermission(w, r, url, workspaceView) {
+		return
+	}
+
+	stats, err := getVisitStats(store, url)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to fetch stats", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/stores"
+)
+
+// testVisitStats - the short URL's stats, as GET /urls/{slug}/stats gives them
+func testVisitStats(t *testing.T, store stores.Store, slug string) *visitStats {
+	url, err := store.GetURL(slug, true)
+	if err != nil || url == nil {
+		t.Fatalf("getting %s: got %v and error %v", slug, url, err)
+	}
+	stats, err := getVisitStats(store, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestStatsCombineRollups(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestStore(t, storeType)
+			oldRetention := config.Config.VisitRetention
+			t.Cleanup(func() { config.Config.VisitRetention = oldRetention })
+			config.Config.VisitRetention.Days = 1
+			newTestURL(t, store, stores.ShortURL{Slug: "example", URL: "https://example.com", Owner: "alice"})
+
+			old := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+			visits := []stores.VisitRecord{testVisit("example", false), testVisit("example", false), testVisit("example", true), testVisit("example", false)}
+			for i := range visits[:3] {
+				visits[i].Visit.Time = &old
+			}
+			visits[1].Visit.Rule = 1
+			visits[3].Visit.Referer = "https://example.org"
+			err := store.RecordVisits(visits)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			before := testVisitStats(t, store, "example")
+			today := visits[3].Visit.Time.Format("2006-01-02")
+			want := &visitStats{
+				Slug:     "example",
+				Total:    3,
+				Bots:     1,
+				Daily:    []dailyVisits{{Date: "2020-03-01", Visits: 2, Bots: 1}, {Date: today, Visits: 1}},
+				Referers: []refererVisits{{Referer: "https://example.com", Visits: 2}, {Referer: "https://example.org", Visits: 1}},
+				Rules:    []ruleVisits{{Rule: 0, Visits: 2}, {Rule: 1, Visits: 1}},
+			}
+			if !reflect.DeepEqual(before, want) {
+				t.Fatalf("before compacting: got %+v, want %+v", before, want)
+			}
+
+			// Only visits from before the retention period are rolled up, and the stats stay the same
+			err = compactVisits(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if url, err := store.GetURL("example", true); err != nil || len(url.Visits) != 1 {
+				t.Fatalf("after compacting: got %v and error %v, want 1 visit kept", url, err)
+			}
+			if after := testVisitStats(t, store, "example"); !reflect.DeepEqual(after, want) {
+				t.Errorf("after compacting: got %+v, want %+v", after, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/stores"
+)
+
+// templatePart - a literal part of a destination template, or a placeholder to substitute
+type templatePart struct {
+	literal     string
+	placeholder string
+	// Placeholders in the query string or fragment are escaped differently to those in the path
+	inQuery bool
+}
+
+// parseTemplate - split a destination template into literals and placeholders: {1}, {2}, ... for the segments of the
+// path after a prefix link's slug, {query.name} for query string parameters and {header.Name} for request headers
+func parseTemplate(template string) ([]templatePart, error) {
+	schemeEnd := strings.Index(template, "://")
+	if schemeEnd == -1 {
+		return nil, errors.New("Must be an absolute URL")
+	}
+	// Placeholders can't change which site visitors are sent to
+	pathStart := strings.IndexAny(template[schemeEnd+3:], "/?#")
+	if pathStart == -1 {
+		pathStart = len(template)
+	} else {
+		pathStart += schemeEnd + 3
+	}
+	queryStart := strings.IndexAny(template, "?#")
+
+	parts := []templatePart{}
+	for i := 0; i < len(template); {
+		open := strings.IndexAny(template[i:], "{}")
+		if open == -1 {
+			parts = append(parts, templatePart{literal: template[i:]})
+			break
+		}
+		open += i
+		if template[open] == '}' {
+			return nil, errors.New("Unmatched }")
+		}
+
+		if open > i {
+			parts = append(parts, templatePart{literal: template[i:open]})
+		}
+
+		end := strings.IndexAny(template[open+1:], "{}")
+		if end == -1 || template[open+1+end] != '}' {
+			return nil, errors.New("Unmatched {")
+		}
+		end += open + 1
+
+		placeholder := template[open+1 : end]
+		if open < pathStart {
+			return nil, errors.New("Placeholders can only be in the destination's path, query string or fragment")
+		}
+		if !validPlaceholder(placeholder) {
+			return nil, errors.New("Invalid placeholder: {" + placeholder + "}")
+		}
+		if header := strings.TrimPrefix(placeholder, "header."); header != placeholder && !templateHeaderAllowed(header) {
+			return nil, errors.New("Header not allowed in templates: " + header)
+		}
+
+		parts = append(parts, templatePart{placeholder: placeholder, inQuery: queryStart != -1 && open > queryStart})
+		i = end + 1
+	}
+
+	return parts, nil
+}
+
+// validPlaceholder - whether a placeholder's name (without its braces) is one that can be filled in
+func validPlaceholder(placeholder string) bool {
+	if segment, err := strconv.Atoi(placeholder); err == nil {
+		return segment >= 1
+	}
+
+	if strings.HasPrefix(placeholder, "query.") {
+		return len(placeholder) > len("query.")
+	}
+
+	if strings.HasPrefix(placeholder, "header.") {
+		name := placeholder[len("header."):]
+		return name != "" && !strings.ContainsAny(name, " \t:")
+	}
+
+	return false
+}
+
+// templateHeaderAllowed - whether {header.Name} placeholders can use the request header; only those in the
+// template_headers config option can be, so link owners can't collect visitors' cookies or credentials
+func templateHeaderAllowed(name string) bool {
+	for _, allowed := range config.Config.TemplateHeaders {
+		if strings.EqualFold(name, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateTemplates - check a short URL's destinations (its URL and its routing rules') are valid templates, if it's a
+// templated link
+func validateTemplates(link stores.ShortURL) error {
+	if !link.Template {
+		return nil
+	}
+
+	err := validateTemplate(link.URL, link.Prefix)
+	if err != nil {
+		return err
+	}
+
+	for i, rule := range link.Rules {
+		err = validateTemplate(rule.URL, link.Prefix)
+		if err != nil {
+			return errors.New("Rule " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// validateTemplate - check a destination is a valid template, for a prefix link or not
+func validateTemplate(template string, prefix bool) error {
+	parts, err := parseTemplate(template)
+	if err != nil {
+		return err
+	}
+
+	example := ""
+	for _, part := range parts {
+		if part.placeholder == "" {
+			example += part.literal
+			continue
+		}
+
+		if _, err := strconv.Atoi(part.placeholder); err == nil && !prefix {
+			return errors.New("Path segment placeholders can only be used in prefix links")
+		}
+		example += "x"
+	}
+
+	parsed, err := url.Parse(example)
+	if err != nil || parsed.Host == "" {
+		return errors.New("Must be an absolute URL")
+	}
+
+	return nil
+}
+
+// renderTemplate - a templated short URL's destination, with its placeholders replaced with values from the request
+// (escaped for where they are in the URL), or "" for values it doesn't have. rest is the path after a prefix link's
+// slug, from its /
+func renderTemplate(template, rest string, r *http.Request) (string, error) {
+	parts, err := parseTemplate(template)
+	if err != nil {
+		return "", err
+	}
+
+	segments := []string{}
+	if rest != "" {
+		segments = strings.Split(rest[1:], "/")
+	}
+
+	destination := ""
+	for _, part := range parts {
+		if part.placeholder == "" {
+			destination += part.literal
+			continue
+		}
+
+		value := ""
+		if segment, err := strconv.Atoi(part.placeholder); err == nil {
+			if segment <= len(segments) {
+				value = segments[segment-1]
+			}
+		} else if strings.HasPrefix(part.placeholder, "query.") {
+			value = r.URL.Query().Get(part.placeholder[len("query."):])
+		} else {
+			value = r.Header.Get(part.placeholder[len("header."):])
+		}
+
+		if part.inQuery {
+			destination += url.QueryEscape(value)
+		} else if value != "." && value != ".." {
+			// Dot segments would be resolved by the browser, letting visitors leave the template's path
+			destination += url.PathEscape(value)
+		}
+	}
+
+	return destination, nil
+}
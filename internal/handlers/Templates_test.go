@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/stores"
+)
+
+func TestValidateTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		prefix   bool
+		valid    bool
+	}{
+		{"https://example.com/{1}/{2}", true, true},
+		{"https://example.com/{1}", false, false},
+		{"https://example.com/search?q={query.q}#{query.section}", false, true},
+		{"https://example.com/?lang={header.Accept-Language}", false, true},
+		{"https://example.com/?lang={header.accept-language}", false, true},
+		{"https://example.com/?c={header.Cookie}", false, false},
+		{"https://example.com/?a={header.Authorization}", false, false},
+		{"https://example.com/?k={header.X-API-Key}", false, false},
+		{"https://{query.host}/", false, false},
+		{"https://example.com/{0}", true, false},
+		{"https://example.com/{nope}", false, false},
+		{"https://example.com/{query.q", false, false},
+		{"https://example.com/query.q}", false, false},
+		{"/relative/{query.q}", false, false},
+	}
+
+	for _, test := range tests {
+		err := validateTemplate(test.template, test.prefix)
+		if (err == nil) != test.valid {
+			t.Errorf("validateTemplate(%q, %v): got error %v, want valid=%v", test.template, test.prefix, err, test.valid)
+		}
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		target   string
+		rest     string
+		headers  map[string]string
+		want     string
+	}{
+		{"https://jira.example.com/browse/{1}", "/jira/ABC-123", "/ABC-123", nil, "https://jira.example.com/browse/ABC-123"},
+		{"https://example.com/{1}/{2}", "/x/a", "/a", nil, "https://example.com/a/"},
+		{"https://example.com/{1}", "/x/a%2Fb", "/a/b", nil, "https://example.com/a"},
+		{"https://example.com/{1}/x", "/x/..", "/..", nil, "https://example.com//x"},
+		{"https://example.com/search?q={query.q}", "/s?q=a+b%26c", "", nil, "https://example.com/search?q=a+b%26c"},
+		{"https://example.com/{query.q}", "/s?q=a/b", "", nil, "https://example.com/a%2Fb"},
+		{"https://example.com/?lang={header.Accept-Language}", "/s", "", map[string]string{"Accept-Language": "en-GB"}, "https://example.com/?lang=en-GB"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.target, nil)
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+
+		got, err := renderTemplate(test.template, test.rest, r)
+		if err != nil || got != test.want {
+			t.Errorf("renderTemplate(%q) for %s: got %q (%v), want %q", test.template, test.target, got, err, test.want)
+		}
+	}
+}
+
+func TestDisallowedHeaderTemplateFailsToRender(t *testing.T) {
+	link := &stores.ShortURL{Slug: "s", URL: "https://example.com/?lang={header.Accept-Language}", Template: true}
+	r := httptest.NewRequest(http.MethodGet, "/s", nil)
+	r.Header.Set("Accept-Language", "en")
+
+	// Headers taken off the allowlist after the link was created aren't filled in either
+	oldHeaders := config.Config.TemplateHeaders
+	t.Cleanup(func() { config.Config.TemplateHeaders = oldHeaders })
+	config.Config.TemplateHeaders = []string{"User-Agent"}
+
+	destination, err := destinationURL(link, 0, "", r)
+	if err == nil {
+		t.Errorf("got destination %q, want an error rather than the raw template", destination)
+	}
+}
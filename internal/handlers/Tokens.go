@@ -0,0 +1,521 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/db"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	scopeFull   = "full"
+	scopeRead   = "read"
+	scopeCreate = "create"
+)
+
+const sessionCookieName = "linkener_session"
+
+// sqliteTimeFormat matches CURRENT_TIMESTAMP, so stored expiries compare correctly against it
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+type tokenResponse struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type newAPIKeyRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+type apiKeyResponse struct {
+	ID     int64  `json:"id"`
+	APIKey string `json:"api_key"`
+}
+
+type accessTokenInfo struct {
+	ID          int64      `json:"id"`
+	Name        string     `json:"name"`
+	Scope       string     `json:"scope"`
+	APIKey      bool       `json:"api_key"`
+	DateCreated time.Time  `json:"date_created"`
+	LastUsed    *time.Time `json:"last_used"`
+	Expiry      *time.Time `json:"expiry"`
+	Current     bool       `json:"current"`
+}
+
+func generateAccessToken() (string, error) {
+	bytes := make([]byte, 50)
+
+	_, err := rand.Read(bytes[:])
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), err
+}
+
+// hashToken - tokens are only ever stored as their SHA-256, so a leaked auth database can't be used to impersonate users
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenHashMatches - constant time comparison of a stored token hash against a presented token
+func tokenHashMatches(storedHash, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(storedHash), []byte(hashToken(token))) == 1
+}
+
+func validScope(scope string) bool {
+	return scope == scopeFull || scope == scopeRead || scope == scopeCreate
+}
+
+// scopeWithin - whether a token with the given scope only allows what one with the granted scope does
+func scopeWithin(scope, granted string) bool {
+	return granted == scopeFull || scope == granted
+}
+
+// createURLRoute names the route for creating short URLs, the only one create scoped tokens can be used for
+const createURLRoute = "createURL"
+
+// scopeAllows - whether a token with the given scope may make the request
+func scopeAllows(scope string, r *http.Request) bool {
+	switch scope {
+	case scopeFull:
+		return true
+	case scopeRead:
+		return r.Method == http.MethodGet || r.Method == http.MethodHead
+	case scopeCreate:
+		route := mux.CurrentRoute(r)
+		return r.Method == http.MethodPost && route != nil && route.GetName() == createURLRoute
+	case scopeEnrollment:
+		// Only accepted at all by enrollmentAuthMiddleware
+		return true
+	}
+	return false
+}
+
+// requireScope - respond with 403 unless the request's access token has one of the scopes. Requests to routes that
+// don't need authentication (/urls when auth_enabled is off) have no scope, and are let through
+func requireScope(w http.ResponseWriter, r *http.Request, scopes ...string) bool {
+	scope, ok := r.Context().Value(ScopeContextKey).(string)
+	if !ok {
+		return true
+	}
+
+	for _, allowed := range scopes {
+		if scope == allowed {
+			return true
+		}
+	}
+
+	authError(w, http.StatusForbidden, "insufficient_scope", "Access token scope does not permit this request")
+	return false
+}
+
+// requireFullScope - respond with 403 unless the request's access token has full scope. Managing tokens, accounts,
+// webhooks, workspaces and invites needs it whatever the request's method, so limited tokens can't be used to get
+// round their scope
+func requireFullScope(w http.ResponseWriter, r *http.Request) bool {
+	return requireScope(w, r, scopeFull)
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// insertAccessToken - create a new access token for the user, returning the token and its ID
+func insertAccessToken(tx *sql.Tx, username, name, scope string, expiry time.Time) (string, int64, error) {
+	accessToken, err := generateAccessToken()
+	if err != nil {
+		println(err.Error())
+		return "", 0, errors.New("Failed to generate access token")
+	}
+
+	result, err := tx.Exec("insert into access_tokens(username, token_hash, name, scope, expiry) values(?, ?, ?, ?, ?)",
+		username, hashToken(accessToken), name, scope, expiry.Format(sqliteTimeFormat))
+	if err != nil {
+		println(err.Error())
+		return "", 0, errors.New("Failed to generate access token")
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		println(err.Error())
+		return "", 0, errors.New("Failed to generate access token")
+	}
+
+	return accessToken, id, nil
+}
+
+// accessTokenExpiry - when an access token created now should expire
+func accessTokenExpiry() time.Time {
+	return time.Now().UTC().Truncate(time.Second).Add(time.Duration(config.Config.AccessTokenTTL) * time.Second)
+}
+
+// issueTokens - create a new access token and accompanying refresh token for the user
+func issueTokens(tx *sql.Tx, username, name, scope string) (*tokenResponse, error) {
+	expiry := accessTokenExpiry()
+	accessToken, accessTokenID, err := insertAccessToken(tx, username, name, scope, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := generateAccessToken()
+	if err != nil {
+		println(err.Error())
+		return nil, errors.New("Failed to generate refresh token")
+	}
+
+	refreshExpiry := time.Now().UTC().Truncate(time.Second).Add(time.Duration(config.Config.RefreshTokenTTL) * time.Second)
+	_, err = tx.Exec("insert into refresh_tokens(username, token_hash, access_token_id, name, scope, expiry) values(?, ?, ?, ?, ?, ?)",
+		username, hashToken(refreshToken), accessTokenID, name, scope, refreshExpiry.Format(sqliteTimeFormat))
+	if err != nil {
+		println(err.Error())
+		return nil, errors.New("Failed to generate refresh token")
+	}
+
+	return &tokenResponse{AccessToken: accessToken, RefreshToken: refreshToken, ExpiresAt: expiry}, nil
+}
+
+// writeNewTokens - issue a new token pair for the user and send it as the response, or an error response
+func writeNewTokens(w http.ResponseWriter, username, name, scope string) bool {
+	tx, err := db.DBCon.Begin()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to generate access token", http.StatusInternalServerError)
+		return false
+	}
+
+	tokens, err := issueTokens(tx, username, name, scope)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to generate access token", http.StatusInternalServerError)
+		return false
+	}
+
+	json.NewEncoder(w).Encode(tokens)
+	return true
+}
+
+// startSession - set an HttpOnly session cookie holding a new access token for the user, for browser clients
+func startSession(w http.ResponseWriter, r *http.Request, username, scope string) bool {
+	tx, err := db.DBCon.Begin()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to start session", http.StatusInternalServerError)
+		return false
+	}
+
+	expiry := accessTokenExpiry()
+	accessToken, _, err := insertAccessToken(tx, username, "Browser session", scope, expiry)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to start session", http.StatusInternalServerError)
+		return false
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    accessToken,
+		Path:     "/" + config.Config.APIRoot,
+		Expires:  expiry,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return true
+}
+
+func newSessionHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var decodedBody newTokenRequest
+	err = json.Unmarshal(body, &decodedBody)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+		return
+	}
+
+	username, ok := checkCredentials(w, r, decodedBody.Username, decodedBody.Password)
+	if !ok {
+		return
+	}
+
+	enrollmentOnly, ok := checkSecondFactor(w, r, username, decodedBody.OTP, decodedBody.RecoveryCode)
+	if !ok {
+		return
+	}
+
+	scope := scopeFull
+	if enrollmentOnly {
+		scope = scopeEnrollment
+	}
+
+	if startSession(w, r, username, scope) {
+		recordAudit(r, username, "user.login", username, nil, map[string]string{"method": "session", "scope": scope})
+		http.ResponseWriter.Write(w, []byte("Success!"))
+	}
+}
+
+func endSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value(TokenIDContextKey).(int64)
+
+	_, err := db.DBCon.Exec("delete from access_tokens where id=?", id)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to end session", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/" + config.Config.APIRoot,
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	recordAudit(r, r.Context().Value(UsernameContextKey).(string), "session.end", strconv.FormatInt(id, 10), nil, nil)
+	http.ResponseWriter.Write(w, []byte("Success!"))
+}
+
+func refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var decodedBody refreshRequest
+	err = json.Unmarshal(body, &decodedBody)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DBCon.Begin()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to refresh access token", http.StatusInternalServerError)
+		return
+	}
+
+	var id, accessTokenID int64
+	var storedHash, username, name, scope string
+	err = tx.QueryRow("select id, token_hash, username, access_token_id, name, scope from refresh_tokens where token_hash=? and expiry>CURRENT_TIMESTAMP",
+		hashToken(decodedBody.RefreshToken)).Scan(&id, &storedHash, &username, &accessTokenID, &name, &scope)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		println(err.Error())
+		http.Error(w, "Failed to refresh access token", http.StatusInternalServerError)
+		return
+	}
+
+	if err == sql.ErrNoRows || !tokenHashMatches(storedHash, decodedBody.RefreshToken) {
+		tx.Rollback()
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	// Refresh tokens are single use: the old pair is replaced by the new one
+	_, err = tx.Exec("delete from refresh_tokens where id=?", id)
+	if err == nil {
+		_, err = tx.Exec("delete from access_tokens where id=?", accessTokenID)
+	}
+	if err != nil {
+		tx.Rollback()
+		println(err.Error())
+		http.Error(w, "Failed to refresh access token", http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := issueTokens(tx, username, name, scope)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to refresh access token", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func newAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var decodedBody newAPIKeyRequest
+	err = json.Unmarshal(body, &decodedBody)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+		return
+	}
+
+	if decodedBody.Scope == "" {
+		decodedBody.Scope = scopeFull
+	}
+	if !validScope(decodedBody.Scope) {
+		http.Error(w, "Invalid token scope", http.StatusBadRequest)
+		return
+	}
+	// API keys never expire, so they mustn't be able to do more than the token used to create them
+	if !scopeWithin(decodedBody.Scope, r.Context().Value(ScopeContextKey).(string)) {
+		authError(w, http.StatusForbidden, "insufficient_scope", "API keys can't have a wider scope than the access token used to create them")
+		return
+	}
+
+	apiKey, err := generateAccessToken()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
+		return
+	}
+
+	username := r.Context().Value(UsernameContextKey).(string)
+	result, err := db.DBCon.Exec("insert into access_tokens(username, token_hash, name, scope, api_key, expiry) values(?, ?, ?, ?, 1, NULL)",
+		username, hashToken(apiKey), decodedBody.Name, decodedBody.Scope)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, username, "api_key.create", strconv.FormatInt(id, 10), nil, map[string]string{"name": decodedBody.Name, "scope": decodedBody.Scope})
+	json.NewEncoder(w).Encode(apiKeyResponse{ID: id, APIKey: apiKey})
+}
+
+func listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
+	username := r.Context().Value(UsernameContextKey).(string)
+	currentTokenID := r.Context().Value(TokenIDContextKey).(int64)
+
+	rows, err := db.DBCon.Query("select id, name, scope, api_key, date_created, last_used, expiry from access_tokens where username=? order by id", username)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to fetch access tokens", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tokens := []accessTokenInfo{}
+	for rows.Next() {
+		var token accessTokenInfo
+		var lastUsed, expiry sql.NullTime
+		err := rows.Scan(&token.ID, &token.Name, &token.Scope, &token.APIKey, &token.DateCreated, &lastUsed, &expiry)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to fetch access tokens", http.StatusInternalServerError)
+			return
+		}
+		token.LastUsed = nullTimePtr(lastUsed)
+		token.Expiry = nullTimePtr(expiry)
+		token.Current = token.ID == currentTokenID
+		tokens = append(tokens, token)
+	}
+
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func revokeTokenByIDHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
+	username := r.Context().Value(UsernameContextKey).(string)
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.DBCon.Exec("delete from access_tokens where id=? and username=?", id, username)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to revoke access token", http.StatusInternalServerError)
+		return
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		http.Error(w, "Access token not found", http.StatusNotFound)
+		return
+	}
+
+	// Its refresh token is useless without it
+	_, err = db.DBCon.Exec("delete from refresh_tokens where access_token_id=?", id)
+	if err != nil {
+		println(err.Error())
+	}
+
+	recordAudit(r, username, "token.revoke", strconv.FormatInt(id, 10), map[string]string{"username": username}, nil)
+	http.ResponseWriter.Write(w, []byte("Succesfully revoked access token"))
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shu8/linkener/internal/db"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTokensStoredHashed(t *testing.T) {
+	setUpTestAuthDB(t)
+	token := newTestUser(t, "alice", scopeFull)
+
+	var stored string
+	err := db.DBCon.QueryRow("select token_hash from access_tokens where username='alice'").Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == token || stored != hashToken(token) {
+		t.Errorf("got %q stored for the token, want its SHA-256", stored)
+	}
+
+	// The stored hash can't be used as a token itself
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	if w := serveAuthorized(ok, http.MethodGet, "/", "", token); w.Code != http.StatusOK {
+		t.Errorf("token: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := serveAuthorized(ok, http.MethodGet, "/", "", stored); w.Code != http.StatusUnauthorized {
+		t.Errorf("stored hash: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestTokenHashMigrationInvalidatesPlaintextTokens(t *testing.T) {
+	setUpUnmigratedTestAuthDB(t)
+	_, err := db.DBCon.Exec(`insert into users(username, password) values('alice', '');
+		insert into access_tokens(username, access_token, expiry) values('alice', 'plaintext', datetime('now', '+1 hour'))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens int
+	err = db.DBCon.QueryRow("select count(*) from access_tokens").Scan(&tokens)
+	if err != nil || tokens != 0 {
+		t.Fatalf("after migrating: got %d access tokens and error %v, want none", tokens, err)
+	}
+	if w := serveAuthorized(func(w http.ResponseWriter, r *http.Request) {}, http.MethodGet, "/", "", "plaintext"); w.Code != http.StatusUnauthorized {
+		t.Errorf("plaintext token after migrating: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+// accessTokenExists - whether the access token hasn't been revoked
+func accessTokenExists(t *testing.T, token string) bool {
+	var count int
+	err := db.DBCon.QueryRow("select count(*) from access_tokens where token_hash=?", hashToken(token)).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func TestRevokeToken(t *testing.T) {
+	setUpTestAuthDB(t)
+	alice := newTestUser(t, "alice", scopeFull)
+	aliceOther := newTestToken(t, "alice", scopeRead)
+	bob := newTestUser(t, "bob", scopeFull)
+	admin := newTestUser(t, "carol", scopeFull)
+	_, err := db.DBCon.Exec("update users set role=? where username='carol'", roleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		token  string
+		revoke string
+		want   int
+	}{
+		{"unauthenticated", "", aliceOther, http.StatusUnauthorized},
+		{"unknown token", alice, "not a token", http.StatusNotFound},
+		{"someone else's token", bob, aliceOther, http.StatusForbidden},
+		{"own token", alice, aliceOther, http.StatusOK},
+		{"revoked token", alice, aliceOther, http.StatusNotFound},
+		{"admin revoking someone else's token", admin, bob, http.StatusOK},
+	} {
+		w := serveAuthorized(revokeTokenHandler, http.MethodPost, "/revoke_token", `{"access_token": "`+test.revoke+`"}`, test.token)
+		if w.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+
+	if accessTokenExists(t, aliceOther) || accessTokenExists(t, bob) || !accessTokenExists(t, alice) {
+		t.Error("only the tokens revoked by their owner or an admin should be revoked")
+	}
+}
+
+func TestTokenManagementNeedsFullScope(t *testing.T) {
+	setUpTestAuthDB(t)
+
+	for _, scope := range []string{scopeRead, scopeCreate} {
+		token := newTestUser(t, "alice", scope)
+
+		w := serveAuthorized(revokeTokenHandler, http.MethodPost, "/revoke_token", `{"all": true}`, token)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s token revoking all sessions: got status %d, want %d", scope, w.Code, http.StatusForbidden)
+		}
+
+		w = serveAuthorized(listTokensHandler, http.MethodGet, "/tokens", "", token)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s token listing tokens: got status %d, want %d", scope, w.Code, http.StatusForbidden)
+		}
+	}
+
+	full := newTestToken(t, "alice", scopeFull)
+	w := serveAuthorized(listTokensHandler, http.MethodGet, "/tokens", "", full)
+	if w.Code != http.StatusOK {
+		t.Errorf("full token listing tokens: got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	w = serveAuthorized(revokeTokenHandler, http.MethodPost, "/revoke_token", `{"all": true}`, full)
+	if w.Code != http.StatusOK {
+		t.Errorf("full token revoking all sessions: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestAPIKeysNeedFullScope(t *testing.T) {
+	setUpTestAuthDB(t)
+
+	for _, scope := range []string{scopeRead, scopeCreate} {
+		token := newTestUser(t, "alice", scope)
+		for _, body := range []string{`{}`, `{"scope": "full"}`, `{"scope": "` + scope + `"}`} {
+			w := serveAuthorized(newAPIKeyHandler, http.MethodPost, "/api_keys", body, token)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%s token creating API key with %s: got status %d, want %d", scope, body, w.Code, http.StatusForbidden)
+			}
+		}
+	}
+
+	var keys int
+	err := db.DBCon.QueryRow("select count(*) from access_tokens where api_key=1").Scan(&keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != 0 {
+		t.Errorf("got %d API keys, want none", keys)
+	}
+
+	full := newTestToken(t, "alice", scopeFull)
+	w := serveAuthorized(newAPIKeyHandler, http.MethodPost, "/api_keys", `{"scope": "read"}`, full)
+	if w.Code != http.StatusOK {
+		t.Errorf("full token creating read API key: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestCreateScopeOnlyCreatesURLs(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			setUpTestStore(t, storeType)
+			router := newTestRouter(t, storeType)
+
+			token := newTestUser(t, "alice", scopeCreate)
+			serve := func(method, target, body string) int {
+				return serveRoute(router, method, target, body, token).Code
+			}
+
+			if code := serve(http.MethodPost, "/urls/", `{"url": "https://example.com", "slug": "example"}`); code != http.StatusOK {
+				t.Fatalf("creating short URL: got status %d, want %d", code, http.StatusOK)
+			}
+			for _, request := range []struct{ method, target, body string }{
+				{http.MethodGet, "/urls/", ""},
+				{http.MethodPost, "/urls/example/revisions/1/rollback", ""},
+				{http.MethodPost, "/urls/trash/example/restore", ""},
+				{http.MethodPost, "/webhooks/", `{"url": "https://example.com/hook", "events": ["link.created"]}`},
+			} {
+				if code := serve(request.method, request.target, request.body); code != http.StatusForbidden {
+					t.Errorf("%s %s: got status %d, want %d", request.method, request.target, code, http.StatusForbidden)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlersNeedFullScope(t *testing.T) {
+	setUpTestAuthDB(t)
+	newTestUser(t, "alice", scopeFull)
+
+	// Checked by the handlers too, in case a route lets a create scoped token through
+	for _, handler := range []http.HandlerFunc{webhooksHandler, workspacesHandler, newInviteHandler, newResetCodeHandler, enrollTOTPHandler} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{}`))
+		ctx := context.WithValue(r.Context(), UsernameContextKey, "alice")
+		ctx = context.WithValue(ctx, ScopeContextKey, scopeCreate)
+		r = mux.SetURLVars(r.WithContext(ctx), map[string]string{"username": "alice"})
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("create scoped POST: got status %d, want %d", w.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/stores"
+
+	"github.com/gorilla/mux"
+)
+
+// trashRetention - how long short URLs stay in the trash before being purged
+func trashRetention() time.Duration {
+	return time.Duration(config.Config.Trash.Retention) * time.Second
+}
+
+// getTrashedURL - the short URL in the trash with the given slug, or nil if there isn't one
+func getTrashedURL(store stores.Store, slug string, withVisits bool) (*stores.ShortURL, error) {
+	urls, err := store.GetTrashedURLs(withVisits)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, url := range *urls {
+		if url.Slug == slug {
+			return &url, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// purgeTrash - permanently delete the short URLs that have been in the trash for longer than the retention period
+func purgeTrash(store stores.Store) error {
+	urls, err := store.GetTrashedURLs(false)
+	if err != nil {
+		return err
+	}
+
+	for _, url := range *urls {
+		if time.Since(*url.DateDeleted) < trashRetention() {
+			continue
+		}
+
+		err := store.DeleteURL(url.Slug)
+		if err != nil {
+			return err
+		}
+		writeAudit("", "url.purge", url.Slug, "", auditURL(url), nil)
+	}
+
+	return nil
+}
+
+// StartTrashPurger - purge the trash in the background every purge_interval. This runs even if the trash is disabled,
+// so links trashed before it was are still purged
+func StartTrashPurger() error {
+	if config.Config.Trash.Retention < 0 {
+		return errors.New("Invalid trash retention")
+	}
+
+	if config.Config.Trash.PurgeInterval <= 0 {
+		return errors.New("Invalid trash purge_interval")
+	}
+
+	store, err := stores.StoreFactory(config.Config.StoreType)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			err := purgeTrash(store)
+			if err != nil {
+				println("Failed to purge trash: " + err.Error())
+			}
+			time.Sleep(time.Duration(config.Config.Trash.PurgeInterval) * time.Second)
+		}
+	}()
+
+	return nil
+}
+
+func trashHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
+	urls, err := store.GetTrashedURLs(includeVisits(r))
+	if err == nil {
+		urls, err = visibleURLs(r, urls, -1)
+	}
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to fetch trash", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(urls)
+}
+
+func restoreURLHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
+	url, err := getTrashedURL(store, mux.Vars(r)["slug"], true)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to restore URL", http.StatusInternalServerError)
+		return
+	}
+
+	if url == nil {
+		http.Error(w, "No URL found in trash", http.StatusNotFound)
+		return
+	}
+
+	if !requireURLPermission(w, r, url, workspaceEdit) {
+		return
+	}
+
+	// It may just not have been purged yet
+	if time.Since(*url.DateDeleted) >= trashRetention() {
+		http.Error(w, "URL has been in the trash too long to restore", http.StatusGone)
+		return
+	}
+
+	err = store.RestoreURL(url.Slug)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to restore URL", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, requestUsername(r), "url.restore", url.Slug, nil, auditURL(*url))
+	url.DateDeleted = nil
+	dispatchWebhookEvent(eventLinkRestored, *url, nil)
+	json.NewEncoder(w).Encode(url)
+}
+
+func purgeURLHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
+	url, err := getTrashedURL(store, mux.Vars(r)["slug"], false)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to delete URL", http.StatusInternalServerError)
+		return
+	}
+
+	if url == nil {
+		http.Error(w, "No URL found in trash", http.StatusNotFound)
+		return
+	}
+
+	if !requireURLPermission(w, r, url, workspaceEdit) {
+		return
+	}
+
+	err = store.DeleteURL(url.Slug)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to delete URL", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, requestUsername(r), "url.purge", url.Slug, auditURL(*url), nil)
+	http.ResponseWriter.Write(w, []byte("Success!"))
+}
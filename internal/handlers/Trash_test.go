@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/stores"
+)
+
+// enableTestTrash - turn on the trash, keeping links in it for the retention period in seconds
+func enableTestTrash(t *testing.T, retention int) {
+	oldTrash := config.Config.Trash
+	t.Cleanup(func() { config.Config.Trash = oldTrash })
+	config.Config.Trash.Enabled = true
+	config.Config.Trash.Retention = retention
+}
+
+func TestTrashAndRestore(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestStore(t, storeType)
+			router := newTestRouter(t, storeType)
+			enableTestTrash(t, 3600)
+			token := newTestUser(t, "alice", scopeFull)
+			newTestURL(t, store, stores.ShortURL{Slug: "example", URL: "https://example.com", Owner: "alice"})
+
+			for _, request := range []struct {
+				method, target string
+				want           int
+			}{
+				{http.MethodDelete, "/urls/example", http.StatusOK},
+				{http.MethodGet, "/urls/example", http.StatusNotFound},
+				{http.MethodPost, "/urls/trash/missing/restore", http.StatusNotFound},
+				{http.MethodPost, "/urls/trash/example/restore", http.StatusOK},
+				{http.MethodGet, "/urls/example", http.StatusOK},
+			} {
+				if w := serveRoute(router, request.method, request.target, "", token); w.Code != request.want {
+					t.Errorf("%s %s: got status %d, want %d", request.method, request.target, w.Code, request.want)
+				}
+			}
+
+			// Trashed links can't be visited
+			err := store.TrashURL("example")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w := visitShortURL(store, http.MethodGet, "example", testBrowserUserAgent, nil); w.Code != http.StatusNotFound {
+				t.Errorf("visiting a trashed link: got status %d, want %d", w.Code, http.StatusNotFound)
+			}
+		})
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestStore(t, storeType)
+			router := newTestRouter(t, storeType)
+			enableTestTrash(t, 3600)
+			token := newTestUser(t, "alice", scopeFull)
+			newTestURL(t, store, stores.ShortURL{Slug: "trashed", URL: "https://example.com/trashed", Owner: "alice"})
+			newTestURL(t, store, stores.ShortURL{Slug: "kept", URL: "https://example.com/kept", Owner: "alice"})
+			err := store.TrashURL("trashed")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Within the retention period, nothing's purged
+			err = purgeTrash(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if url, err := getTrashedURL(store, "trashed", false); err != nil || url == nil {
+				t.Fatalf("within retention: got %v and error %v, want it still in the trash", url, err)
+			}
+
+			// After it, links can't be restored, even before being purged, and purging only deletes trashed links
+			config.Config.Trash.Retention = 0
+			if w := serveRoute(router, http.MethodPost, "/urls/trash/trashed/restore", "", token); w.Code != http.StatusGone {
+				t.Errorf("restoring after retention: got status %d, want %d", w.Code, http.StatusGone)
+			}
+			err = purgeTrash(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if url, err := getTrashedURL(store, "trashed", false); err != nil || url != nil {
+				t.Errorf("after retention: got %v and error %v, want it purged", url, err)
+			}
+			if url, err := store.GetURL("kept", false); err != nil || url == nil {
+				t.Errorf("after purging: got %v and error %v, want the link outside the trash kept", url, err)
+			}
+			if entries := auditEntries(t, "url.purge"); len(entries) != 1 || entries[0].Target != "trashed" || entries[0].Actor != "" {
+				t.Errorf("after purging: got audit entries %+v, want one for trashed with no actor", entries)
+			}
+		})
+	}
+}
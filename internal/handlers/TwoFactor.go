@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/db"
+	"github.com/shu8/linkener/internal/totp"
+
+	"github.com/gorilla/mux"
+)
+
+// scopeEnrollment - given instead of the requested scope when two-factor authentication is mandatory but the user
+// hasn't set it up yet; such tokens can only be used to set it up
+const scopeEnrollment = "2fa_enrollment"
+
+const recoveryCodeCount = 10
+
+// After this many wrong two-factor authentication codes in a row, the user has to wait before trying again; the wait
+// doubles with each further wrong code, up to secondFactorMaxBackoff
+const secondFactorFreeAttempts = 5
+const secondFactorBackoff = 30 * time.Second
+const secondFactorMaxBackoff = time.Hour
+
+type totpEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type totpCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func generateRecoveryCode() (string, error) {
+	bytes := make([]byte, 5)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+
+	code := hex.EncodeToString(bytes)
+	return code[:5] + "-" + code[5:], nil
+}
+
+func normaliseRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(code, " ", ""))
+}
+
+// checkSecondFactor - verify the user's TOTP or recovery code if they have two-factor authentication enabled, writing
+// an error response if it's missing or invalid. enrollmentOnly is true if the user must set it up before doing anything else
+func checkSecondFactor(w http.ResponseWriter, r *http.Request, username, code, recoveryCode string) (enrollmentOnly bool, ok bool) {
+	var secret string
+	var enabled bool
+	var lastStep, lockedUntil int64
+	err := db.DBCon.QueryRow("select totp_secret, totp_enabled, totp_last_step, totp_locked_until from users where username=?", username).
+		Scan(&secret, &enabled, &lastStep, &lockedUntil)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to authenticate user", http.StatusInternalServerError)
+		return false, false
+	}
+
+	if !enabled {
+		return config.Config.Require2FA, true
+	}
+
+	if code == "" && recoveryCode == "" {
+		w.Header().Set("X-Linkener-OTP", "required")
+		http.Error(w, "Two-factor authentication code required", http.StatusUnauthorized)
+		return false, false
+	}
+
+	if wait := lockedUntil - time.Now().Unix(); wait > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(wait, 10))
+		http.Error(w, "Too many wrong two-factor authentication codes, try again later", http.StatusTooManyRequests)
+		return false, false
+	}
+
+	if code != "" {
+		step, valid := totp.Validate(secret, code, time.Now())
+		if valid && step > lastStep {
+			// Only succeeds once per code, even with concurrent requests
+			result, err := db.DBCon.Exec("update users set totp_last_step=? where username=? and totp_last_step<?", step, username, step)
+			if err != nil {
+				println(err.Error())
+				http.Error(w, "Failed to authenticate user", http.StatusInternalServerError)
+				return false, false
+			}
+			if affected, err := result.RowsAffected(); err == nil && affected == 1 {
+				return false, resetSecondFactorFailures(w, username)
+			}
+		}
+	} else {
+		result, err := db.DBCon.Exec("delete from recovery_codes where username=? and code_hash=?", username, hashToken(normaliseRecoveryCode(recoveryCode)))
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to authenticate user", http.StatusInternalServerError)
+			return false, false
+		}
+		if affected, err := result.RowsAffected(); err == nil && affected == 1 {
+			return false, resetSecondFactorFailures(w, username)
+		}
+	}
+
+	err = recordSecondFactorFailure(username)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to authenticate user", http.StatusInternalServerError)
+		return false, false
+	}
+
+	recordAudit(r, username, "user.login_failed", username, nil, map[string]string{"reason": "invalid two-factor authentication code"})
+	http.Error(w, "Invalid two-factor authentication code", http.StatusUnauthorized)
+	return false, false
+}
+
+// recordSecondFactorFailure - count a wrong two-factor authentication code, making the user wait before trying again
+// if they've had too many in a row
+func recordSecondFactorFailure(username string) error {
+	tx, err := db.DBCon.Begin()
+	if err != nil {
+		return err
+	}
+
+	var failures int
+	_, err = tx.Exec("update users set totp_failures=totp_failures+1 where username=?", username)
+	if err == nil {
+		err = tx.QueryRow("select totp_failures from users where username=?", username).Scan(&failures)
+	}
+	if err == nil && failures >= secondFactorFreeAttempts {
+		backoff := secondFactorMaxBackoff
+		if shift := failures - secondFactorFreeAttempts; shift < 8 && secondFactorBackoff<<shift < backoff {
+			backoff = secondFactorBackoff << shift
+		}
+		_, err = tx.Exec("update users set totp_locked_until=? where username=?", time.Now().Add(backoff).Unix(), username)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// resetSecondFactorFailures - forget the user's wrong two-factor authentication codes after a right one, writing an
+// error response if that fails
+func resetSecondFactorFailures(w http.ResponseWriter, username string) bool {
+	_, err := db.DBCon.Exec("update users set totp_failures=0, totp_locked_until=0 where username=?", username)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to authenticate user", http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+// requireSameUser - ensure the {username} in the route is the authorized user, writing an error response if not
+func requireSameUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	requestUsername := mux.Vars(r)["username"]
+	loggedInUsername := r.Context().Value(UsernameContextKey)
+	if loggedInUsername == nil || loggedInUsername.(string) != requestUsername {
+		http.Error(w, "Unauthorized access", http.StatusForbidden)
+		return "", false
+	}
+
+	return requestUsername, true
+}
+
+func enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireScope(w, r, scopeFull, scopeEnrollment) {
+		return
+	}
+
+	username, ok := requireSameUser(w, r)
+	if !ok {
+		return
+	}
+
+	var enabled bool
+	err := db.DBCon.QueryRow("select totp_enabled from users where username=?", username).Scan(&enabled)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	// Not enabled until a code from it has been verified
+	_, err = db.DBCon.Exec("update users set totp_secret=?, totp_last_step=0 where username=?", secret, username)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(totpEnrollResponse{Secret: secret, OTPAuthURI: totp.URI("Linkener", username, secret)})
+}
+
+func verifyTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireScope(w, r, scopeFull, scopeEnrollment) {
+		return
+	}
+
+	username, ok := requireSameUser(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var decodedBody totpCodeRequest
+	err = json.Unmarshal(body, &decodedBody)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+		return
+	}
+
+	var secret string
+	var enabled bool
+	err = db.DBCon.QueryRow("select totp_secret, totp_enabled from users where username=?", username).Scan(&secret, &enabled)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	if secret == "" {
+		http.Error(w, "Two-factor authentication has not been set up", http.StatusBadRequest)
+		return
+	}
+
+	step, valid := totp.Validate(secret, decodedBody.Code, time.Now())
+	if !valid {
+		http.Error(w, "Invalid two-factor authentication code", http.StatusBadRequest)
+		return
+	}
+
+	recoveryCodes := make([]string, recoveryCodeCount)
+	tx, err := db.DBCon.Begin()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("update users set totp_enabled=1, totp_last_step=? where username=?", step, username)
+	if err == nil {
+		_, err = tx.Exec("delete from recovery_codes where username=?", username)
+	}
+	for i := range recoveryCodes {
+		if err != nil {
+			break
+		}
+		recoveryCodes[i], err = generateRecoveryCode()
+		if err == nil {
+			_, err = tx.Exec("insert into recovery_codes(username, code_hash) values(?, ?)", username, hashToken(recoveryCodes[i]))
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		println(err.Error())
+		http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, username, "totp.enable", username, nil, nil)
+	json.NewEncoder(w).Encode(recoveryCodesResponse{RecoveryCodes: recoveryCodes})
+}
+
+func disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	loggedInUsername := r.Context().Value(UsernameContextKey).(string)
+
+	// Admins can reset other users' two-factor authentication, e.g. if they lose their device and recovery codes
+	if username != loggedInUsername {
+		if !isAdmin(r) {
+			http.Error(w, "Unauthorized access", http.StatusForbidden)
+			return
+		}
+	} else {
+		if config.Config.Require2FA {
+			http.Error(w, "Two-factor authentication is mandatory", http.StatusForbidden)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var decodedBody totpCodeRequest
+		err = json.Unmarshal(body, &decodedBody)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+			return
+		}
+
+		if _, ok := checkSecondFactor(w, r, username, decodedBody.Code, decodedBody.RecoveryCode); !ok {
+			return
+		}
+	}
+
+	tx, err := db.DBCon.Begin()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := tx.Exec("update users set totp_secret='', totp_enabled=0, totp_last_step=0 where username=?", username)
+	if err == nil {
+		_, err = tx.Exec("delete from recovery_codes where username=?", username)
+	}
+	if err != nil {
+		tx.Rollback()
+		println(err.Error())
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		tx.Rollback()
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, loggedInUsername, "totp.disable", username, nil, nil)
+	http.ResponseWriter.Write(w, []byte("Success!"))
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shu8/linkener/internal/db"
+)
+
+func TestSecondFactorBackoff(t *testing.T) {
+	setUpTestAuthDB(t)
+	newTestUser(t, "alice", scopeFull)
+	recoveryCode := enableTestTOTP(t, "alice")
+
+	check := func(code, recoveryCode string) (*httptest.ResponseRecorder, bool) {
+		w := httptest.NewRecorder()
+		_, ok := checkSecondFactor(w, httptest.NewRequest(http.MethodPost, "/api/auth/new_token", nil), "alice", code, recoveryCode)
+		return w, ok
+	}
+
+	for i := 0; i < secondFactorFreeAttempts; i++ {
+		if w, ok := check("000000", ""); ok || w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: got status %d, want %d", i+1, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	w, ok := check("", recoveryCode)
+	if ok || w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("right code after %d wrong ones: got status %d, want %d with Retry-After", secondFactorFreeAttempts, w.Code, http.StatusTooManyRequests)
+	}
+
+	// Once the backoff has passed, a right code works and resets the count
+	_, err := db.DBCon.Exec("update users set totp_locked_until=0 where username='alice'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, ok := check("", recoveryCode); !ok {
+		t.Fatalf("right code after backoff: got status %d, want success", w.Code)
+	}
+
+	var failures int
+	err = db.DBCon.QueryRow("select totp_failures from users where username='alice'").Scan(&failures)
+	if err != nil || failures != 0 {
+		t.Errorf("got %d failures after a right code (%v), want 0", failures, err)
+	}
+}
+
+func TestSecondFactorBackoffGrows(t *testing.T) {
+	setUpTestAuthDB(t)
+	newTestUser(t, "alice", scopeFull)
+	enableTestTOTP(t, "alice")
+
+	lockedFor := func() int64 {
+		var lockedUntil int64
+		err := db.DBCon.QueryRow("select totp_locked_until - strftime('%s', 'now') from users where username='alice'").Scan(&lockedUntil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lockedUntil
+	}
+
+	previous := int64(0)
+	for i := 0; i < secondFactorFreeAttempts+10; i++ {
+		err := recordSecondFactorFailure("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i+1 < secondFactorFreeAttempts {
+			continue
+		}
+
+		wait := lockedFor()
+		if wait < previous || wait > int64(secondFactorMaxBackoff.Seconds())+1 {
+			t.Errorf("after %d wrong codes: waiting %ds, want between %ds and %s", i+1, wait, previous, secondFactorMaxBackoff)
+		}
+		previous = wait
+	}
+	if previous < int64(secondFactorMaxBackoff.Seconds())-1 {
+		t.Errorf("after many wrong codes: waiting %ds, want %s", previous, secondFactorMaxBackoff)
+	}
+}
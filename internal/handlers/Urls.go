@@ -6,7 +6,10 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+
 	"github.com/shu8/linkener/internal/config"
 	"github.com/shu8/linkener/internal/stores"
 
@@ -20,12 +23,42 @@ type newURLRequest struct {
 	SlugLength    int    `json:"slug_length"`
 	AllowedVisits int    `json:"allowed_visits"`
 	Password      string `json:"password"`
+	Workspace     int64  `json:"workspace"`
+
+	Prefix       bool                 `json:"prefix"`
+	Template     bool                 `json:"template"`
+	ForwardQuery bool                 `json:"forward_query"`
+	UTM          stores.UTMParams     `json:"utm"`
+	Rules        []stores.RoutingRule `json:"rules"`
 }
 
 type updateURLRequest struct {
 	URL           string  `json:"url"`
 	AllowedVisits int     `json:"allowed_visits"`
 	Password      *string `json:"password"`
+	Workspace     *int64  `json:"workspace"`
+
+	Prefix       *bool                 `json:"prefix"`
+	Template     *bool                 `json:"template"`
+	ForwardQuery *bool                 `json:"forward_query"`
+	UTM          *stores.UTMParams     `json:"utm"`
+	Rules        *[]stores.RoutingRule `json:"rules"`
+}
+
+type revisionInfo struct {
+	ID                int       `json:"id"`
+	URL               string    `json:"url"`
+	AllowedVisits     int       `json:"allowed_visits"`
+	PasswordProtected bool      `json:"password_protected"`
+	Editor            string    `json:"editor"`
+	DateCreated       time.Time `json:"date_created"`
+	RolledBackFrom    int       `json:"rolled_back_from,omitempty"`
+	// Settings added after revisions were, if the revision has them
+	ForwardQuery *bool                 `json:"forward_query,omitempty"`
+	UTM          *stores.UTMParams     `json:"utm,omitempty"`
+	Prefix       *bool                 `json:"prefix,omitempty"`
+	Template     *bool                 `json:"template,omitempty"`
+	Rules        *[]stores.RoutingRule `json:"rules,omitempty"`
 }
 
 func generateSlug(slugLength int) (string, error) {
@@ -44,15 +77,161 @@ func generateSlug(slugLength int) (string, error) {
 	return slug, nil
 }
 
+// requestUsername - the authorized user, or "" if authentication is disabled
+func requestUsername(r *http.Request) string {
+	username := r.Context().Value(UsernameContextKey)
+	if username == nil {
+		return ""
+	}
+	return username.(string)
+}
+
+// requireURLPermission - ensure the authorized user has at least the given permission on the short URL, writing an
+// error response if not. Links the user can't see at all are reported as not found
+func requireURLPermission(w http.ResponseWriter, r *http.Request, url *stores.ShortURL, permission string) bool {
+	allowed, err := urlAllows(r, url, permission)
+	if err == nil && !allowed {
+		var canView bool
+		canView, err = urlAllows(r, url, workspaceView)
+		if err == nil && canView {
+			http.Error(w, "Unauthorized access", http.StatusForbidden)
+			return false
+		}
+	}
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to fetch URL", http.StatusInternalServerError)
+		return false
+	}
+
+	if !allowed {
+		http.Error(w, "No URL found", http.StatusNotFound)
+		return false
+	}
+
+	return true
+}
+
+// includeVisits - whether to respond with short URLs' visits, not just their visit counts. They're included unless
+// ?visits=false is given
+func includeVisits(r *http.Request) bool {
+	return r.URL.Query().Get("visits") != "false"
+}
+
+// visibleURLs - the short URLs the authorized user can view, optionally only those in one workspace (-1 for all)
+func visibleURLs(r *http.Request, urls *[]stores.ShortURL, workspace int64) (*[]stores.ShortURL, error) {
+	visibleWorkspaces := map[int64]bool{}
+	visible := []stores.ShortURL{}
+	for _, url := range *urls {
+		if workspace != -1 && url.Workspace != workspace {
+			continue
+		}
+
+		allowed, checked := visibleWorkspaces[url.Workspace]
+		if !checked {
+			var err error
+			allowed, err = urlAllows(r, &url, workspaceView)
+			if err != nil {
+				return nil, err
+			}
+			visibleWorkspaces[url.Workspace] = allowed
+		}
+
+		if allowed {
+			visible = append(visible, url)
+		}
+	}
+
+	return &visible, nil
+}
+
+// revisionOf - a revision holding the short URL's current destination and settings
+func revisionOf(link stores.ShortURL, editor string) stores.Revision {
+	// Empty rather than nil, so revisions without rules aren't mistaken for ones from before rules were kept
+	if link.Rules == nil {
+		link.Rules = []stores.RoutingRule{}
+	}
+
+	return stores.Revision{
+		URL:           link.URL,
+		AllowedVisits: link.AllowedVisits,
+		Password:      link.Password,
+		Editor:        editor,
+		ForwardQuery:  &link.ForwardQuery,
+		UTM:           &link.UTM,
+		Prefix:        &link.Prefix,
+		Template:      &link.Template,
+		Rules:         &link.Rules,
+	}
+}
+
+// applyRevision - set the short URL's destination and settings back to those saved in the revision
+func applyRevision(link *stores.ShortURL, revision stores.Revision) {
+	link.URL = revision.URL
+	link.AllowedVisits = revision.AllowedVisits
+	link.Password = revision.Password
+	if revision.ForwardQuery != nil {
+		link.ForwardQuery = *revision.ForwardQuery
+	}
+	if revision.UTM != nil {
+		link.UTM = *revision.UTM
+	}
+	if revision.Prefix != nil {
+		link.Prefix = *revision.Prefix
+	}
+	if revision.Template != nil {
+		link.Template = *revision.Template
+	}
+	if revision.Rules != nil {
+		link.Rules = *revision.Rules
+	}
+}
+
+// addRevision - save the short URL's new state as a revision. Links from before revisions were kept get one for their
+// previous state first, so they can still be rolled back to it
+func addRevision(store stores.Store, oldURL *stores.ShortURL, newURL stores.ShortURL, editor string, rolledBackFrom int) error {
+	if oldURL != nil {
+		revisions, err := store.GetRevisions(oldURL.Slug)
+		if err == nil && len(*revisions) == 0 {
+			revision := revisionOf(*oldURL, oldURL.Owner)
+			revision.DateCreated = oldURL.DateCreated
+			_, err = store.AddRevision(oldURL.Slug, revision)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	revision := revisionOf(newURL, editor)
+	revision.RolledBackFrom = rolledBackFrom
+	_, err := store.AddRevision(newURL.Slug, revision)
+	return err
+}
+
 func urlsHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
 	switch r.Method {
 	case http.MethodGet:
-		urls, err := store.GetURLs()
+		// ?workspace=ID only returns that workspace's links (0 for links outside workspaces)
+		var workspace int64 = -1
+		if r.URL.Query().Get("workspace") != "" {
+			var err error
+			workspace, err = strconv.ParseInt(r.URL.Query().Get("workspace"), 10, 64)
+			if err != nil || workspace < 0 {
+				http.Error(w, "Invalid workspace ID", http.StatusBadRequest)
+				return
+			}
+		}
+
+		urls, err := store.GetURLs(includeVisits(r))
+		if err == nil {
+			urls, err = visibleURLs(r, urls, workspace)
+		}
 		if err != nil {
 			println(err.Error())
 			http.Error(w, "Failed to fetch URLs", http.StatusInternalServerError)
 			return
 		}
+
 		json.NewEncoder(w).Encode(urls)
 	case http.MethodPost:
 		body, err := ioutil.ReadAll(r.Body)
@@ -70,6 +249,20 @@ func urlsHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
 			return
 		}
 
+		if decodedBody.Workspace != 0 {
+			allowed, err := workspaceAllows(r, decodedBody.Workspace, workspaceEdit)
+			if err != nil {
+				println(err.Error())
+				http.Error(w, "Failed to save URL", http.StatusInternalServerError)
+				return
+			}
+
+			if !allowed {
+				http.Error(w, "Unauthorized access to workspace", http.StatusForbidden)
+				return
+			}
+		}
+
 		if decodedBody.Password != "" {
 			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(decodedBody.Password), bcrypt.DefaultCost)
 			if err != nil {
@@ -94,20 +287,60 @@ func urlsHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
 			}
 			decodedBody.Slug = slug
 		} else {
-			url, _ := store.GetURL(decodedBody.Slug)
+			url, _ := store.GetURL(decodedBody.Slug, false)
+			if url == nil {
+				// Trashed links keep their slugs until they're purged, so they can be restored
+				url, _ = getTrashedURL(store, decodedBody.Slug, false)
+			}
 			if url != nil {
 				http.Error(w, "Slug already exists", http.StatusConflict)
 				return
 			}
 		}
 
-		inserted, err := store.InsertURL(decodedBody.Slug, decodedBody.URL, decodedBody.Password, decodedBody.AllowedVisits)
+		newURL := stores.ShortURL{
+			Slug:          decodedBody.Slug,
+			URL:           decodedBody.URL,
+			Password:      decodedBody.Password,
+			AllowedVisits: decodedBody.AllowedVisits,
+			Owner:         requestUsername(r),
+			Workspace:     decodedBody.Workspace,
+			Prefix:        decodedBody.Prefix,
+			Template:      decodedBody.Template,
+			ForwardQuery:  decodedBody.ForwardQuery,
+			UTM:           decodedBody.UTM,
+			Rules:         decodedBody.Rules,
+		}
+		if newURL.Rules == nil {
+			newURL.Rules = []stores.RoutingRule{}
+		}
+		err = validateTemplates(newURL)
+		if err != nil {
+			http.Error(w, "Invalid destination template: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = validateRules(newURL.Rules)
+		if err != nil {
+			http.Error(w, "Invalid routing rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		inserted, err := store.InsertURL(newURL)
 		if err != nil {
 			println(err.Error())
 			http.Error(w, "Failed to save URL", http.StatusInternalServerError)
 			return
 		}
 
+		err = addRevision(store, nil, *inserted, requestUsername(r), 0)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "URL saved, but failed to save revision", http.StatusInternalServerError)
+			return
+		}
+
+		recordAudit(r, requestUsername(r), "url.create", inserted.Slug, nil, auditURL(*inserted))
+		dispatchWebhookEvent(eventLinkCreated, *inserted, nil)
 		json.NewEncoder(w).Encode(inserted)
 	}
 }
@@ -122,7 +355,7 @@ func urlHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
 
 	switch r.Method {
 	case http.MethodGet:
-		url, err := store.GetURL(slug)
+		url, err := store.GetURL(slug, includeVisits(r))
 		if err != nil {
 			println(err.Error())
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -134,14 +367,43 @@ func urlHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
 			return
 		}
 
+		if !requireURLPermission(w, r, url, workspaceView) {
+			return
+		}
+
 		json.NewEncoder(w).Encode(url)
 	case http.MethodDelete:
-		err := store.DeleteURL(slug)
+		url, err := store.GetURL(slug, false)
 		if err != nil {
 			println(err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+
+		if url == nil {
+			http.Error(w, "No URL found", http.StatusNotFound)
+			return
+		}
+
+		if !requireURLPermission(w, r, url, workspaceEdit) {
+			return
+		}
+
+		action := "url.delete"
+		if config.Config.Trash.Enabled {
+			action = "url.trash"
+			err = store.TrashURL(slug)
+		} else {
+			err = store.DeleteURL(slug)
+		}
+		if err != nil {
+			println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		recordAudit(r, requestUsername(r), action, slug, auditURL(*url), nil)
+		dispatchWebhookEvent(eventLinkDeleted, *url, map[string]interface{}{"trashed": config.Config.Trash.Enabled})
 	case http.MethodPut:
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
@@ -158,6 +420,40 @@ func urlHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
 			return
 		}
 
+		oldURL, err := store.GetURL(slug, false)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to update URL", http.StatusInternalServerError)
+			return
+		}
+
+		if oldURL == nil {
+			http.Error(w, "No URL found", http.StatusNotFound)
+			return
+		}
+
+		if !requireURLPermission(w, r, oldURL, workspaceEdit) {
+			return
+		}
+
+		if newURL.Workspace != nil && *newURL.Workspace != oldURL.Workspace {
+			// Only the owner can put a link outside workspaces into one, or it could be taken from them
+			allowed := oldURL.Workspace != 0 || oldURL.Owner == requestUsername(r) || isAdmin(r)
+			if allowed && *newURL.Workspace != 0 {
+				allowed, err = workspaceAllows(r, *newURL.Workspace, workspaceEdit)
+			}
+			if err != nil {
+				println(err.Error())
+				http.Error(w, "Failed to update URL", http.StatusInternalServerError)
+				return
+			}
+
+			if !allowed {
+				http.Error(w, "Unauthorized access to workspace", http.StatusForbidden)
+				return
+			}
+		}
+
 		if newURL.Password != nil {
 			// New password
 			if *newURL.Password != "" {
@@ -172,22 +468,199 @@ func urlHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
 			}
 		} else {
 			// Re-set newURL password to be existing password
-			oldURL, err := store.GetURL(slug)
-			if err != nil {
-				println(err.Error())
-				http.Error(w, "Failed to update URL", http.StatusInternalServerError)
-				return
-			}
 			newURL.Password = &oldURL.Password
 		}
 
-		err = store.UpdateURL(slug, newURL.URL, *newURL.Password, newURL.AllowedVisits)
+		updatedURL := *oldURL
+		updatedURL.URL = newURL.URL
+		updatedURL.AllowedVisits = newURL.AllowedVisits
+		updatedURL.Password = *newURL.Password
+		if newURL.Workspace != nil {
+			updatedURL.Workspace = *newURL.Workspace
+		}
+		if newURL.Prefix != nil {
+			updatedURL.Prefix = *newURL.Prefix
+		}
+		if newURL.Template != nil {
+			updatedURL.Template = *newURL.Template
+		}
+		if newURL.ForwardQuery != nil {
+			updatedURL.ForwardQuery = *newURL.ForwardQuery
+		}
+		if newURL.UTM != nil {
+			updatedURL.UTM = *newURL.UTM
+		}
+		if newURL.Rules != nil {
+			updatedURL.Rules = *newURL.Rules
+			if updatedURL.Rules == nil {
+				updatedURL.Rules = []stores.RoutingRule{}
+			}
+		}
+		err = validateTemplates(updatedURL)
+		if err != nil {
+			http.Error(w, "Invalid destination template: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = validateRules(updatedURL.Rules)
+		if err != nil {
+			http.Error(w, "Invalid routing rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = store.UpdateURL(updatedURL)
 		if err != nil {
 			println(err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+
+		err = addRevision(store, oldURL, updatedURL, requestUsername(r), 0)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "URL updated, but failed to save revision", http.StatusInternalServerError)
+			return
+		}
+
+		after := auditURL(updatedURL)
+		if updatedURL.Password != oldURL.Password {
+			after["password_changed"] = true
+		}
+		recordAudit(r, requestUsername(r), "url.update", slug, auditURL(*oldURL), after)
+		dispatchWebhookEvent(eventLinkUpdated, updatedURL, nil)
+	}
+}
+
+func revisionsHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
+	url, err := store.GetURL(mux.Vars(r)["slug"], false)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+		return
 	}
+
+	if url == nil {
+		http.Error(w, "No URL found", http.StatusNotFound)
+		return
+	}
+
+	if !requireURLPermission(w, r, url, workspaceView) {
+		return
+	}
+
+	revisions, err := store.GetRevisions(url.Slug)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+		return
+	}
+
+	// Newest first
+	response := []revisionInfo{}
+	for i := len(*revisions) - 1; i >= 0; i-- {
+		revision := (*revisions)[i]
+		response = append(response, revisionInfo{
+			ID:                revision.ID,
+			URL:               revision.URL,
+			AllowedVisits:     revision.AllowedVisits,
+			PasswordProtected: revision.Password != "",
+			Editor:            revision.Editor,
+			DateCreated:       revision.DateCreated,
+			RolledBackFrom:    revision.RolledBackFrom,
+			ForwardQuery:      revision.ForwardQuery,
+			UTM:               revision.UTM,
+			Prefix:            revision.Prefix,
+			Template:          revision.Template,
+			Rules:             revision.Rules,
+		})
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func rollbackHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
+	revisionID, err := strconv.Atoi(mux.Vars(r)["revision"])
+	if err != nil {
+		http.Error(w, "Invalid revision ID", http.StatusBadRequest)
+		return
+	}
+
+	url, err := store.GetURL(mux.Vars(r)["slug"], false)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to roll back URL", http.StatusInternalServerError)
+		return
+	}
+
+	if url == nil {
+		http.Error(w, "No URL found", http.StatusNotFound)
+		return
+	}
+
+	if !requireURLPermission(w, r, url, workspaceEdit) {
+		return
+	}
+
+	revisions, err := store.GetRevisions(url.Slug)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to roll back URL", http.StatusInternalServerError)
+		return
+	}
+
+	var revision *stores.Revision
+	for i := range *revisions {
+		if (*revisions)[i].ID == revisionID {
+			revision = &(*revisions)[i]
+		}
+	}
+
+	if revision == nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	// Rolling back is itself a new revision, so it can be undone too
+	updatedURL := *url
+	applyRevision(&updatedURL, *revision)
+
+	// The link's other settings may have changed since, so the revision's destination might not suit them
+	err = validateTemplates(updatedURL)
+	if err != nil {
+		http.Error(w, "Can't roll back to this revision: invalid destination template: "+err.Error(), http.StatusConflict)
+		return
+	}
+	err = validateRules(updatedURL.Rules)
+	if err != nil {
+		http.Error(w, "Can't roll back to this revision: invalid routing rules: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	err = store.UpdateURL(updatedURL)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to roll back URL", http.StatusInternalServerError)
+		return
+	}
+
+	err = addRevision(store, url, updatedURL, requestUsername(r), revision.ID)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "URL rolled back, but failed to save revision", http.StatusInternalServerError)
+		return
+	}
+
+	after := auditURL(updatedURL)
+	after["rolled_back_to"] = revision.ID
+	if updatedURL.Password != url.Password {
+		after["password_changed"] = true
+	}
+	recordAudit(r, requestUsername(r), "url.rollback", url.Slug, auditURL(*url), after)
+	dispatchWebhookEvent(eventLinkUpdated, updatedURL, map[string]interface{}{"rolled_back_to": revision.ID})
+	json.NewEncoder(w).Encode(updatedURL)
 }
 
 // SetUpUrlsHandlers - set up the /urls REST handlers
@@ -197,13 +670,45 @@ func SetUpUrlsHandlers(subrouter *mux.Router) error {
 		return err
 	}
 
+	subrouter.HandleFunc("/trash/", func(w http.ResponseWriter, r *http.Request) {
+		trashHandler(w, r, store)
+	}).Methods("GET")
+
+	subrouter.HandleFunc("/trash/{slug}", func(w http.ResponseWriter, r *http.Request) {
+		purgeURLHandler(w, r, store)
+	}).Methods("DELETE")
+
+	subrouter.HandleFunc("/trash/{slug}/restore", func(w http.ResponseWriter, r *http.Request) {
+		restoreURLHandler(w, r, store)
+	}).Methods("POST")
+
+	subrouter.HandleFunc("/{slug}/stats", func(w http.ResponseWriter, r *http.Request) {
+		statsHandler(w, r, store)
+	}).Methods("GET")
+
+	subrouter.HandleFunc("/{slug}/visits", func(w http.ResponseWriter, r *http.Request) {
+		purgeVisitsHandler(w, r, store)
+	}).Methods("DELETE")
+
+	subrouter.HandleFunc("/{slug}/revisions", func(w http.ResponseWriter, r *http.Request) {
+		revisionsHandler(w, r, store)
+	}).Methods("GET")
+
+	subrouter.HandleFunc("/{slug}/revisions/{revision}/rollback", func(w http.ResponseWriter, r *http.Request) {
+		rollbackHandler(w, r, store)
+	}).Methods("POST")
+
 	subrouter.HandleFunc("/{slug}", func(w http.ResponseWriter, r *http.Request) {
 		urlHandler(w, r, store)
 	}).Methods("GET", "PUT", "DELETE")
 
 	subrouter.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		urlsHandler(w, r, store)
-	}).Methods("GET", "POST")
+	}).Methods("GET")
+
+	subrouter.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		urlsHandler(w, r, store)
+	}).Methods("POST").Name(createURLRoute)
 
 	return nil
 }
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/shu8/linkener/internal/stores"
+)
+
+// rollBack - roll the short URL back to the revision, returning the response status
+func rollBack(t *testing.T, store stores.Store, slug, revision, token string) int {
+	return serveURLRoute(rollbackHandler, store, http.MethodPost, map[string]string{"slug": slug, "revision": revision}, token).Code
+}
+
+// updateTestURL - save changes to a short URL and a revision for them, as if made via the API
+func updateTestURL(t *testing.T, store stores.Store, slug string, update func(*stores.ShortURL)) {
+	link, err := store.GetURL(slug, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated := *link
+	update(&updated)
+	err = store.UpdateURL(updated)
+	if err == nil {
+		err = addRevision(store, link, updated, "alice", 0)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRollbackRestoresRevision(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestStore(t, storeType)
+			token := newTestUser(t, "alice", scopeFull)
+			newTestURL(t, store, stores.ShortURL{
+				Slug:          "docs",
+				URL:           "https://example.com/old",
+				AllowedVisits: 5,
+				ForwardQuery:  true,
+				UTM:           stores.UTMParams{Source: "newsletter"},
+				Prefix:        true,
+				Rules:         []stores.RoutingRule{{URL: "https://example.com/ios", OS: []string{osIOS}}},
+				Owner:         "alice",
+			})
+
+			updateTestURL(t, store, "docs", func(link *stores.ShortURL) {
+				link.URL = "https://example.com/new"
+				link.AllowedVisits = 0
+				link.ForwardQuery = false
+				link.UTM = stores.UTMParams{}
+				link.Prefix = false
+				link.Rules = nil
+			})
+			err := store.RecordVisits([]stores.VisitRecord{testVisit("docs", false), testVisit("docs", false)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if status := rollBack(t, store, "docs", "1", token); status != http.StatusOK {
+				t.Fatalf("rolling back: got status %d, want %d", status, http.StatusOK)
+			}
+
+			// Rolling back only changes settings, so the visits stay
+			link, _ := store.GetURL("docs", true)
+			if link.VisitCount != 2 || len(link.Visits) != 2 {
+				t.Errorf("after rolling back: got a visit count of %d and %d visits, want 2", link.VisitCount, len(link.Visits))
+			}
+			if link.URL != "https://example.com/old" || link.AllowedVisits != 5 || !link.ForwardQuery || link.UTM.Source != "newsletter" || !link.Prefix ||
+				len(link.Rules) != 1 || link.Rules[0].URL != "https://example.com/ios" {
+				t.Errorf("after rolling back: got %+v, want revision 1's destination and settings", *link)
+			}
+
+			revisions, _ := store.GetRevisions("docs")
+			if len(*revisions) != 3 || (*revisions)[2].RolledBackFrom != 1 {
+				t.Errorf("after rolling back: got revisions %+v, want a third rolled back from 1", *revisions)
+			}
+		})
+	}
+}
+
+func TestRollbackKeepsSettingsMissingFromRevision(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestStore(t, storeType)
+			token := newTestUser(t, "alice", scopeFull)
+			newTestURL(t, store, stores.ShortURL{Slug: "docs", URL: "https://example.com/new", ForwardQuery: true, Owner: "alice"})
+
+			// Saved before revisions kept these settings
+			_, err := store.AddRevision("docs", stores.Revision{URL: "https://example.com/old", Editor: "alice"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if status := rollBack(t, store, "docs", "2", token); status != http.StatusOK {
+				t.Fatalf("rolling back: got status %d, want %d", status, http.StatusOK)
+			}
+
+			link, _ := store.GetURL("docs", false)
+			if link.URL != "https://example.com/old" || !link.ForwardQuery {
+				t.Errorf("after rolling back: got %+v, want the old URL still forwarding query strings", *link)
+			}
+		})
+	}
+}
+
+func TestRollbackRestoresTemplate(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestStore(t, storeType)
+			token := newTestUser(t, "alice", scopeFull)
+			newTestURL(t, store, stores.ShortURL{Slug: "search", URL: "https://example.com/?q={query.q}", Template: true, Owner: "alice"})
+
+			updateTestURL(t, store, "search", func(link *stores.ShortURL) {
+				link.URL = "https://example.com/{braces}"
+				link.Template = false
+			})
+
+			if status := rollBack(t, store, "search", "1", token); status != http.StatusOK {
+				t.Fatalf("rolling back: got status %d, want %d", status, http.StatusOK)
+			}
+
+			link, _ := store.GetURL("search", false)
+			if link.URL != "https://example.com/?q={query.q}" || !link.Template {
+				t.Errorf("after rolling back: got %+v, want revision 1's templated destination", *link)
+			}
+		})
+	}
+}
+
+func TestRollbackClearsRules(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestStore(t, storeType)
+			token := newTestUser(t, "alice", scopeFull)
+			newTestURL(t, store, stores.ShortURL{Slug: "docs", URL: "https://example.com/", Owner: "alice"})
+
+			updateTestURL(t, store, "docs", func(link *stores.ShortURL) {
+				link.Rules = []stores.RoutingRule{{URL: "https://example.com/ios", OS: []string{osIOS}}}
+			})
+
+			if status := rollBack(t, store, "docs", "1", token); status != http.StatusOK {
+				t.Fatalf("rolling back: got status %d, want %d", status, http.StatusOK)
+			}
+
+			link, _ := store.GetURL("docs", false)
+			if len(link.Rules) != 0 {
+				t.Errorf("after rolling back to a revision without rules: got rules %+v, want none", link.Rules)
+			}
+		})
+	}
+}
+
+func TestRollbackValidatesRules(t *testing.T) {
+	store := setUpTestStore(t, "json")
+	token := newTestUser(t, "alice", scopeFull)
+	newTestURL(t, store, stores.ShortURL{Slug: "docs", URL: "https://example.com/", Owner: "alice"})
+
+	_, err := store.AddRevision("docs", stores.Revision{
+		URL:    "https://example.com/",
+		Editor: "alice",
+		Rules:  &[]stores.RoutingRule{{URL: "https://example.com/", OS: []string{"beos"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := rollBack(t, store, "docs", "2", token); status != http.StatusConflict {
+		t.Errorf("rolling back to invalid rules: got status %d, want %d", status, http.StatusConflict)
+	}
+}
+
+func TestRollbackValidatesTemplates(t *testing.T) {
+	store := setUpTestStore(t, "json")
+	token := newTestUser(t, "alice", scopeFull)
+	newTestURL(t, store, stores.ShortURL{Slug: "search", URL: "https://example.com/?q={query.q}", Template: true, Owner: "alice"})
+
+	// A revision whose destination was never a valid template for this link
+	_, err := store.AddRevision("search", stores.Revision{URL: "https://example.com/{1}", Editor: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := rollBack(t, store, "search", "2", token); status != http.StatusConflict {
+		t.Errorf("rolling back to an invalid template: got status %d, want %d", status, http.StatusConflict)
+	}
+
+	link, _ := store.GetURL("search", false)
+	if link.URL != "https://example.com/?q={query.q}" {
+		t.Errorf("after failed rollback: got URL %q, want it unchanged", link.URL)
+	}
+}
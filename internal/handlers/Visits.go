@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/stores"
+)
+
+// What to do with a visit when the visit buffer is full
+const (
+	overflowDrop  = "drop"
+	overflowBlock = "block"
+	overflowSync  = "sync"
+)
+
+// visitRecorder - buffers visits and writes them to the store in batches, so redirects don't wait for the store
+type visitRecorder struct {
+	store stores.Store
+	queue chan stores.VisitRecord
+	stop  chan struct{}
+	done  chan struct{}
+
+	lock    sync.Mutex
+	stopped bool
+	// Visits queued or being written, by slug, so visit limits can count them
+	pending map[string]int
+	// Visits being sent to the queue, which is read until they all are once the recorder's stopping
+	sending sync.WaitGroup
+
+	// Held while a batch is written and taken out of pending, so a short URL's visits can't be counted part way
+	// through, with the batch both in the store and pending, or in neither
+	flushLock sync.RWMutex
+}
+
+// visitBuffer is nil when visits are written synchronously
+var visitBuffer *visitRecorder
+
+// countPending - add delta to the number of visits pending for the visit's short URL. Bot visits aren't counted, as they
+// don't count towards visit limits. v.lock must be held
+func (v *visitRecorder) countPending(visit stores.VisitRecord, delta int) {
+	if visit.Visit.Bot {
+		return
+	}
+
+	v.pending[visit.Slug] += delta
+	if v.pending[visit.Slug] <= 0 {
+		delete(v.pending, visit.Slug)
+	}
+}
+
+// visitFlushAttempts - how many times a batch of visits is written before giving up on it
+const visitFlushAttempts = 5
+
+// flush - write a batch of visits to the store. They're only taken out of pending once they're written, so they still
+// count towards visit limits while the batch is kept to try again
+func (v *visitRecorder) flush(batch []stores.VisitRecord) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	v.flushLock.Lock()
+	defer v.flushLock.Unlock()
+
+	err := v.store.RecordVisits(batch)
+	if err != nil {
+		return err
+	}
+
+	v.lock.Lock()
+	for _, visit := range batch {
+		v.countPending(visit, -1)
+	}
+	v.lock.Unlock()
+
+	return nil
+}
+
+// drop - give up on a batch of visits that couldn't be written
+func (v *visitRecorder) drop(batch []stores.VisitRecord) {
+	v.lock.Lock()
+	for _, visit := range batch {
+		v.countPending(visit, -1)
+	}
+	v.lock.Unlock()
+}
+
+func (v *visitRecorder) run() {
+	ticker := time.NewTicker(time.Duration(config.Config.VisitBuffer.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+
+	batch := []stores.VisitRecord{}
+	// Times the batch has failed to be written; it's kept and tried again at the next interval until it's written, or
+	// has failed visitFlushAttempts times
+	failures := 0
+	write := func() {
+		err := v.flush(batch)
+		if err == nil {
+			batch = []stores.VisitRecord{}
+			failures = 0
+			return
+		}
+
+		failures++
+		if failures < visitFlushAttempts {
+			println("Failed to record " + strconv.Itoa(len(batch)) + " visits, will retry: " + err.Error())
+			return
+		}
+
+		println("Failed to record " + strconv.Itoa(len(batch)) + " visits, dropping them: " + err.Error())
+		v.drop(batch)
+		batch = []stores.VisitRecord{}
+		failures = 0
+	}
+
+	for {
+		select {
+		case visit := <-v.queue:
+			batch = append(batch, visit)
+			// A batch that failed waits for the next interval, rather than being tried again for every visit
+			if len(batch) >= config.Config.VisitBuffer.BatchSize && failures == 0 {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		case <-v.stop:
+			// Keep reading until every visit being sent is queued, so none are left blocked or in the queue, then write
+			// everything buffered before exiting
+			sent := make(chan struct{})
+			go func() {
+				v.sending.Wait()
+				close(sent)
+			}()
+
+			for {
+				select {
+				case visit := <-v.queue:
+					batch = append(batch, visit)
+				case <-sent:
+					for len(v.queue) > 0 {
+						batch = append(batch, <-v.queue)
+					}
+					for len(batch) > 0 {
+						write()
+					}
+					close(v.done)
+					return
+				}
+			}
+		}
+	}
+}
+
+// send - queue a visit, returning whether it was. Waits for room if the buffer is full and its overflow is "block".
+// v.sending must have been added to
+func (v *visitRecorder) send(visit stores.VisitRecord) bool {
+	defer v.sending.Done()
+
+	select {
+	case v.queue <- visit:
+		return true
+	default:
+	}
+
+	if config.Config.VisitBuffer.Overflow == overflowBlock {
+		v.queue <- visit
+		return true
+	}
+	return false
+}
+
+// recordVisit - record a visit, via the visit buffer if it's enabled
+func recordVisit(store stores.Store, visit stores.VisitRecord) error {
+	if visitBuffer == nil {
+		return store.RecordVisits([]stores.VisitRecord{visit})
+	}
+
+	visitBuffer.lock.Lock()
+	if visitBuffer.stopped {
+		visitBuffer.lock.Unlock()
+		return store.RecordVisits([]stores.VisitRecord{visit})
+	}
+	visitBuffer.countPending(visit, 1)
+	visitBuffer.sending.Add(1)
+	visitBuffer.lock.Unlock()
+
+	if visitBuffer.send(visit) {
+		return nil
+	}
+
+	if config.Config.VisitBuffer.Overflow == overflowDrop {
+		println("Visit buffer full, dropping visit to " + visit.Slug)
+	}
+
+	visitBuffer.lock.Lock()
+	visitBuffer.countPending(visit, -1)
+	visitBuffer.lock.Unlock()
+
+	if config.Config.VisitBuffer.Overflow == overflowSync {
+		return store.RecordVisits([]stores.VisitRecord{visit})
+	}
+	return nil
+}
+
+// pendingVisits - how many visits to the short URL are buffered but not yet in the store
+func pendingVisits(slug string) int {
+	if visitBuffer == nil {
+		return 0
+	}
+
+	visitBuffer.lock.Lock()
+	defer visitBuffer.lock.Unlock()
+	return visitBuffer.pending[slug]
+}
+
+// getURLWithVisits - the short URL from the store, and how many visits it has including those still buffered. Not read
+// while a batch is being written, so the batch's visits are counted once
+func getURLWithVisits(store stores.Store, slug string) (*stores.ShortURL, int, error) {
+	if visitBuffer != nil {
+		visitBuffer.flushLock.RLock()
+		defer visitBuffer.flushLock.RUnlock()
+	}
+
+	url, err := store.GetURL(slug, false)
+	if err != nil || url == nil {
+		return nil, 0, err
+	}
+	return url, url.VisitCount + pendingVisits(slug), nil
+}
+
+// StartVisitRecorder - start writing visits to the store in the background, unless the visit buffer is disabled
+func StartVisitRecorder() error {
+	bufferConfig := config.Config.VisitBuffer
+	if bufferConfig.Size <= 0 {
+		return nil
+	}
+
+	if bufferConfig.BatchSize <= 0 {
+		return errors.New("Invalid visit_buffer batch_size")
+	}
+
+	if bufferConfig.FlushInterval <= 0 {
+		return errors.New("Invalid visit_buffer flush_interval_ms")
+	}
+
+	if bufferConfig.Overflow != overflowDrop && bufferConfig.Overflow != overflowBlock && bufferConfig.Overflow != overflowSync {
+		return errors.New("Invalid visit_buffer overflow: " + bufferConfig.Overflow)
+	}
+
+	store, err := stores.StoreFactory(config.Config.StoreType)
+	if err != nil {
+		return err
+	}
+
+	visitBuffer = &visitRecorder{
+		store:   store,
+		queue:   make(chan stores.VisitRecord, bufferConfig.Size),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: map[string]int{},
+	}
+	go visitBuffer.run()
+
+	return nil
+}
+
+// StopVisitRecorder - write any buffered visits to the store. Visits recorded after this are written synchronously
+func StopVisitRecorder() {
+	if visitBuffer == nil {
+		return
+	}
+
+	visitBuffer.lock.Lock()
+	alreadyStopped := visitBuffer.stopped
+	visitBuffer.stopped = true
+	visitBuffer.lock.Unlock()
+
+	if !alreadyStopped {
+		close(visitBuffer.stop)
+		<-visitBuffer.done
+	}
+}
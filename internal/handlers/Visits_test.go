@@ -0,0 +1,350 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/stores"
+)
+
+// startTestVisitRecorder - buffer visits to a store of the given type, stopping the recorder when the test ends
+func startTestVisitRecorder(t *testing.T, storeType string, size, batchSize int, overflow string) {
+	oldConfig := config.Config
+	t.Cleanup(func() {
+		StopVisitRecorder()
+		visitBuffer = nil
+		config.Config = oldConfig
+	})
+
+	config.Config.StoreType = storeType
+	config.Config.VisitBuffer.Size = size
+	config.Config.VisitBuffer.BatchSize = batchSize
+	config.Config.VisitBuffer.FlushInterval = int(time.Hour / time.Millisecond)
+	config.Config.VisitBuffer.Overflow = overflow
+	err := StartVisitRecorder()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testVisit(slug string, bot bool) stores.VisitRecord {
+	now := time.Now().UTC()
+	return stores.VisitRecord{Slug: slug, Visit: stores.Visit{Referer: "https://example.com", Time: &now, Bot: bot}}
+}
+
+// storedVisitCount - how many visits the store has for the short URL, not counting buffered ones
+func storedVisitCount(t *testing.T, store stores.Store, slug string) int {
+	url, err := store.GetURL(slug, false)
+	if err != nil || url == nil {
+		t.Fatalf("getting %s: %v", slug, err)
+	}
+	return url.VisitCount
+}
+
+func TestVisitBufferFlush(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestStore(t, storeType)
+			newTestURL(t, store, stores.ShortURL{Slug: "example", URL: "https://example.com", Owner: "alice"})
+			startTestVisitRecorder(t, storeType, 10, 3, overflowDrop)
+
+			for _, visit := range []stores.VisitRecord{testVisit("example", false), testVisit("example", true)} {
+				err := recordVisit(store, visit)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Bots don't count towards visit limits, so aren't pending
+			if pending := pendingVisits("example"); pending != 1 {
+				t.Errorf("before flush: got %d pending visits, want 1", pending)
+			}
+			if _, visits, _ := getURLWithVisits(store, "example"); visits != 1 {
+				t.Errorf("before flush: got %d visits, want 1", visits)
+			}
+
+			err := recordVisit(store, testVisit("example", false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for pendingVisits("example") > 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			if pending := pendingVisits("example"); pending != 0 {
+				t.Errorf("after flush: got %d pending visits, want 0", pending)
+			}
+			if _, visits, _ := getURLWithVisits(store, "example"); visits != 2 {
+				t.Errorf("after flush: got %d visits, want 2", visits)
+			}
+		})
+	}
+}
+
+// failingVisitsStore - a store that fails to record visits while fail is set
+type failingVisitsStore struct {
+	stores.Store
+	fail int32
+}
+
+func (s *failingVisitsStore) RecordVisits(visits []stores.VisitRecord) error {
+	if atomic.LoadInt32(&s.fail) != 0 {
+		return errors.New("Error writing to database")
+	}
+	return s.Store.RecordVisits(visits)
+}
+
+func TestVisitBufferKeepsFailedBatch(t *testing.T) {
+	store := setUpTestStore(t, "sqlite")
+	newTestURL(t, store, stores.ShortURL{Slug: "example", URL: "https://example.com", Owner: "alice"})
+
+	oldConfig := config.Config
+	t.Cleanup(func() {
+		StopVisitRecorder()
+		visitBuffer = nil
+		config.Config = oldConfig
+	})
+	config.Config.VisitBuffer.BatchSize = 1
+	config.Config.VisitBuffer.FlushInterval = int(time.Hour / time.Millisecond)
+	config.Config.VisitBuffer.Overflow = overflowDrop
+
+	failing := &failingVisitsStore{Store: store, fail: 1}
+	visitBuffer = &visitRecorder{store: failing, queue: make(chan stores.VisitRecord, 10), stop: make(chan struct{}), done: make(chan struct{}), pending: map[string]int{}}
+	go visitBuffer.run()
+
+	err := recordVisit(store, testVisit("example", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(visitBuffer.queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The batch couldn't be written, so the visit still counts towards the short URL's limit
+	if _, visits, _ := getURLWithVisits(store, "example"); visits != 1 {
+		t.Errorf("after a failed write: got %d visits, want 1", visits)
+	}
+
+	// And is written once the store's working again
+	atomic.StoreInt32(&failing.fail, 0)
+	StopVisitRecorder()
+	if visits := storedVisitCount(t, store, "example"); visits != 1 {
+		t.Errorf("after stopping: got %d stored visits, want 1", visits)
+	}
+	if pending := pendingVisits("example"); pending != 0 {
+		t.Errorf("after stopping: got %d pending visits, want 0", pending)
+	}
+}
+
+func TestVisitsToDeletedURLsDropped(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestStore(t, storeType)
+			newTestURL(t, store, stores.ShortURL{Slug: "example", URL: "https://example.com", Owner: "alice"})
+			err := store.DeleteURL("example")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// e.g. visits buffered before it was deleted
+			err = store.RecordVisits([]stores.VisitRecord{testVisit("example", false), testVisit("example", true)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			newTestURL(t, store, stores.ShortURL{Slug: "example", URL: "https://example.org", Owner: "bob"})
+			url, err := store.GetURL("example", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(url.Visits) != 0 || url.VisitCount != 0 {
+				t.Errorf("new short URL with the same slug: got %d visits and a count of %d, want none", len(url.Visits), url.VisitCount)
+			}
+		})
+	}
+}
+
+// slowVisitsStore - a store that takes a while to return after recording visits
+type slowVisitsStore struct {
+	stores.Store
+}
+
+func (s slowVisitsStore) RecordVisits(visits []stores.VisitRecord) error {
+	err := s.Store.RecordVisits(visits)
+	time.Sleep(5 * time.Millisecond)
+	return err
+}
+
+func TestVisitBufferCountsFlushingVisitsOnce(t *testing.T) {
+	store := setUpTestStore(t, "sqlite")
+	newTestURL(t, store, stores.ShortURL{Slug: "example", URL: "https://example.com", Owner: "alice"})
+
+	// Not started, so the test flushes each visit itself
+	buffer := &visitRecorder{store: slowVisitsStore{store}, queue: make(chan stores.VisitRecord, 10), pending: map[string]int{}}
+	visitBuffer = buffer
+	t.Cleanup(func() { visitBuffer = nil })
+
+	// Visits recording has started and finished for
+	var started, finished int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			atomic.AddInt64(&started, 1)
+			recordVisit(store, testVisit("example", false))
+			buffer.flush([]stores.VisitRecord{<-buffer.queue})
+			atomic.AddInt64(&finished, 1)
+		}
+	}()
+
+	// However a read lines up with a flush, each visit is counted once
+	for {
+		select {
+		case <-done:
+			if _, visits, _ := getURLWithVisits(store, "example"); visits != 20 {
+				t.Errorf("after flushes: got %d visits, want 20", visits)
+			}
+			return
+		default:
+		}
+
+		before := atomic.LoadInt64(&finished)
+		_, visits, err := getURLWithVisits(store, "example")
+		after := atomic.LoadInt64(&started)
+		if err == nil && (int64(visits) < before || int64(visits) > after) {
+			err = fmt.Errorf("got %d visits, with %d recorded before and %d after", visits, before, after)
+		}
+		if err != nil {
+			<-done
+			t.Fatalf("during flushes: %v", err)
+		}
+	}
+}
+
+func TestVisitBufferBlockingStop(t *testing.T) {
+	store := setUpTestStore(t, "sqlite")
+	newTestURL(t, store, stores.ShortURL{Slug: "example", URL: "https://example.com", Owner: "alice"})
+	startTestVisitRecorder(t, "sqlite", 1, 100, overflowBlock)
+
+	// Visits sent to a full buffer while it stops are written, rather than blocking forever
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := recordVisit(store, testVisit("example", false))
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	StopVisitRecorder()
+
+	recorded := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(recorded)
+	}()
+	select {
+	case <-recorded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording visits while stopping: blocked")
+	}
+
+	if visits := storedVisitCount(t, store, "example"); visits != 20 {
+		t.Errorf("after stopping: got %d stored visits, want 20", visits)
+	}
+}
+
+func TestCompactVisits(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestStore(t, storeType)
+			newTestURL(t, store, stores.ShortURL{Slug: "example", URL: "https://example.com", Owner: "alice"})
+
+			old := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+			visits := []stores.VisitRecord{testVisit("example", false), testVisit("example", false), testVisit("example", true), testVisit("example", false)}
+			for i := range visits[:3] {
+				visits[i].Visit.Time = &old
+			}
+			err := store.RecordVisits(visits)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			compacted, err := store.CompactVisits(old.Add(24 * time.Hour))
+			if err != nil || compacted != 3 {
+				t.Fatalf("compacting: got %d visits compacted and error %v, want 3", compacted, err)
+			}
+
+			rollups, err := store.GetVisitRollups("example")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[bool]int{false: 2, true: 1}
+			if len(*rollups) != 2 {
+				t.Fatalf("after compacting: got %d rollups, want 2", len(*rollups))
+			}
+			for _, rollup := range *rollups {
+				if rollup.Date != "2020-03-01" || rollup.Visits != want[rollup.Bot] {
+					t.Errorf("after compacting: got rollup %+v", rollup)
+				}
+			}
+
+			url, err := store.GetURL("example", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(url.Visits) != 1 || url.VisitCount != 3 {
+				t.Errorf("after compacting: got %d visits kept and a count of %d, want 1 and 3", len(url.Visits), url.VisitCount)
+			}
+
+			// Compacting again finds nothing new
+			compacted, err = store.CompactVisits(old.Add(24 * time.Hour))
+			if err != nil || compacted != 0 {
+				t.Errorf("compacting again: got %d visits compacted and error %v, want 0", compacted, err)
+			}
+		})
+	}
+}
+
+func TestJSONStoreConcurrentVisits(t *testing.T) {
+	store := setUpTestStore(t, "json")
+	newTestURL(t, store, stores.ShortURL{Slug: "example", URL: "https://example.com", Owner: "alice"})
+
+	// Visits written while the short URL is being changed aren't lost to its rewrite of the file, or the other way round
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			err := store.RecordVisits([]stores.VisitRecord{testVisit("example", false)})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := store.AddRevision("example", stores.Revision{URL: "https://example.com", Editor: "alice"})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if visits := storedVisitCount(t, store, "example"); visits != 20 {
+		t.Errorf("got %d stored visits, want 20", visits)
+	}
+	revisions, err := store.GetRevisions("example")
+	if err != nil || len(*revisions) != 21 {
+		t.Errorf("got %d revisions and error %v, want 21", len(*revisions), err)
+	}
+}
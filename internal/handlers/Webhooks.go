@@ -0,0 +1,858 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/shu8/linkener/internal/cache"
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/db"
+	"github.com/shu8/linkener/internal/stores"
+
+	"github.com/gorilla/mux"
+)
+
+// Events webhooks can subscribe to
+const (
+	eventLinkCreated       = "link.created"
+	eventLinkUpdated       = "link.updated"
+	eventLinkDeleted       = "link.deleted"
+	eventLinkRestored      = "link.restored"
+	eventVisitRecorded     = "visit.recorded"
+	eventVisitLimitReached = "visit.limit_reached"
+	eventLinkExpired       = "link.expired"
+	// Only sent by POST /webhooks/{id}/ping
+	eventPing = "ping"
+)
+
+var webhookEvents = map[string]bool{
+	eventLinkCreated:       true,
+	eventLinkUpdated:       true,
+	eventLinkDeleted:       true,
+	eventLinkRestored:      true,
+	eventVisitRecorded:     true,
+	eventVisitLimitReached: true,
+	eventLinkExpired:       true,
+}
+
+const webhookWorkers = 4
+const webhookQueueSize = 1000
+const webhookMaxAttempts = 6
+
+// webhookRetryDelay - how long to wait before retrying a failed delivery, doubling after each attempt
+const webhookRetryDelay = 10 * time.Second
+
+const maxWebhookDeliveries = 100
+
+// How many link owners' and workspaces' webhook subscriptions are cached, and for how long
+const webhookSubscriptionsCacheSize = 1000
+const webhookSubscriptionsCacheTTL = 5 * time.Minute
+
+// webhookSubscriptions caches the enabled webhooks the events of each link owner and workspace go to, so most events
+// (like visits to links nobody has webhooks for) don't need the auth database. Emptied whenever a webhook changes
+var webhookSubscriptions = cache.NewLRU(webhookSubscriptionsCacheSize, webhookSubscriptionsCacheTTL)
+
+// Bumped whenever webhookSubscriptions is emptied, so subscriptions read before then aren't cached after
+var webhookSubscriptionsVersion uint64
+var webhookSubscriptionsLock sync.Mutex
+
+var webhookHTTPClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		// Not via a proxy from the environment, as its address would be checked instead of the receiver's
+		Proxy:               nil,
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: checkWebhookAddress}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// webhookBlockedNetworks - where webhooks can't be delivered unless the webhooks.allowed_networks config option allows
+// it: unspecified, loopback, private, shared (carrier-grade NAT) and link-local addresses, the last including cloud
+// metadata services. IPv4-mapped IPv6 addresses are matched as IPv4
+var webhookBlockedNetworks = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10",
+}
+
+type webhookRequest struct {
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Workspace int64    `json:"workspace"`
+	Enabled   *bool    `json:"enabled"`
+}
+
+type webhookInfo struct {
+	ID          int64     `json:"id"`
+	CreatedBy   string    `json:"created_by"`
+	Workspace   int64     `json:"workspace"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Enabled     bool      `json:"enabled"`
+	DateCreated time.Time `json:"date_created"`
+	Secret      string    `json:"secret,omitempty"`
+}
+
+type webhookDeliveryInfo struct {
+	ID          int64           `json:"id"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	Delivered   bool            `json:"delivered"`
+	StatusCode  int             `json:"status_code"`
+	Error       string          `json:"error"`
+	DateCreated time.Time       `json:"date_created"`
+	LastAttempt *time.Time      `json:"last_attempt"`
+}
+
+type webhookPayload struct {
+	Event string                 `json:"event"`
+	Time  time.Time              `json:"time"`
+	Link  map[string]interface{} `json:"link,omitempty"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+}
+
+// webhookJob - one delivery waiting to be attempted
+type webhookJob struct {
+	deliveryID int64
+	url        string
+	secret     string
+	event      string
+	payload    []byte
+	attempts   int
+}
+
+var webhookQueue = make(chan webhookJob, webhookQueueSize)
+
+// webhookSignature - the hex HMAC-SHA256 of the payload, sent as "sha256=..." in the X-Linkener-Signature header
+func webhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// queueWebhookJob - add a delivery to the queue without blocking; if it's full, the delivery is logged as failed
+func queueWebhookJob(job webhookJob) {
+	select {
+	case webhookQueue <- job:
+	default:
+		println("Webhook queue full, dropping delivery " + strconv.FormatInt(job.deliveryID, 10))
+		_, err := db.DBCon.Exec("update webhook_deliveries set error='Delivery queue full' where id=?", job.deliveryID)
+		if err != nil {
+			println(err.Error())
+		}
+	}
+}
+
+// parseNetwork - a CIDR network, or a single IP address as a network of just it
+func parseNetwork(network string) (*net.IPNet, error) {
+	if ip := net.ParseIP(network); ip != nil {
+		bits := 8 * len(ip)
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, parsed, err := net.ParseCIDR(network)
+	return parsed, err
+}
+
+// inNetworks - whether the IP address is in any of the networks
+func inNetworks(ip net.IP, networks []string) bool {
+	for _, network := range networks {
+		parsed, err := parseNetwork(network)
+		if err == nil && parsed.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// webhookAddressAllowed - whether webhooks can be delivered to the IP address
+func webhookAddressAllowed(ip net.IP) bool {
+	return !inNetworks(ip, webhookBlockedNetworks) || inNetworks(ip, config.Config.Webhooks.AllowedNetworks)
+}
+
+// checkWebhookAddress - refuse to connect to receivers at addresses webhooks can't be delivered to. Checked as each
+// connection is made, after the receiver's hostname is resolved, so it can't resolve to a public address when the
+// webhook is created and a private one when it's delivered
+func checkWebhookAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !webhookAddressAllowed(ip) {
+		return errors.New("Webhook receiver " + host + " is a private address (see webhooks.allowed_networks)")
+	}
+	return nil
+}
+
+// validateWebhooksConfig - check the networks webhooks can be delivered to despite being private, and how long
+// deliveries are kept for, are valid
+func validateWebhooksConfig() error {
+	for _, network := range config.Config.Webhooks.AllowedNetworks {
+		if _, err := parseNetwork(network); err != nil {
+			return errors.New("Invalid webhooks allowed network: " + network)
+		}
+	}
+
+	if config.Config.Webhooks.DeliveryRetention < 0 {
+		return errors.New("Invalid webhooks delivery_retention")
+	}
+
+	if config.Config.Webhooks.PruneInterval <= 0 {
+		return errors.New("Invalid webhooks prune_interval")
+	}
+
+	return nil
+}
+
+// sendWebhook - make one attempt at a delivery, returning the receiver's status code
+func sendWebhook(job webhookJob) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, job.url, bytes.NewReader(job.payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Linkener-Webhook")
+	req.Header.Set("X-Linkener-Event", job.event)
+	req.Header.Set("X-Linkener-Delivery", strconv.FormatInt(job.deliveryID, 10))
+	req.Header.Set("X-Linkener-Signature", "sha256="+webhookSignature(job.secret, job.payload))
+
+	res, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("Receiver responded with status %d", res.StatusCode)
+	}
+
+	return res.StatusCode, nil
+}
+
+// deliverWebhook - attempt a delivery, logging the result and scheduling a retry if it failed
+func deliverWebhook(job webhookJob) {
+	// The webhook may have been deleted, disabled or changed since, e.g. while waiting to retry, so each attempt goes to
+	// its current URL, signed with its current secret
+	var enabled bool
+	err := db.DBCon.QueryRow(`select webhooks.enabled, webhooks.url, webhooks.secret from webhook_deliveries
+		join webhooks on webhooks.id=webhook_deliveries.webhook_id where webhook_deliveries.id=?`, job.deliveryID).Scan(&enabled, &job.url, &job.secret)
+	if err != nil || !enabled {
+		if err != nil && err != sql.ErrNoRows {
+			println(err.Error())
+		}
+		return
+	}
+
+	job.attempts++
+	statusCode, err := sendWebhook(job)
+
+	errorMessage := ""
+	if err != nil {
+		errorMessage = err.Error()
+	}
+
+	_, dbErr := db.DBCon.Exec("update webhook_deliveries set attempts=?, delivered=?, status_code=?, error=?, last_attempt=CURRENT_TIMESTAMP where id=?",
+		job.attempts, err == nil, statusCode, errorMessage, job.deliveryID)
+	if dbErr != nil {
+		println(dbErr.Error())
+	}
+
+	if err != nil && job.attempts < webhookMaxAttempts {
+		time.AfterFunc(webhookRetryDelay<<(job.attempts-1), func() {
+			queueWebhookJob(job)
+		})
+	}
+}
+
+// queueWebhookDelivery - log a new delivery of the payload to the webhook, and queue it
+func queueWebhookDelivery(webhookID int64, webhookURL, secret, event string, payload []byte) (int64, error) {
+	result, err := db.DBCon.Exec("insert into webhook_deliveries(webhook_id, event, payload) values(?, ?, ?)", webhookID, event, string(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	deliveryID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	queueWebhookJob(webhookJob{deliveryID: deliveryID, url: webhookURL, secret: secret, event: event, payload: payload})
+	return deliveryID, nil
+}
+
+func webhookSubscriptionsKey(shortURL stores.ShortURL) string {
+	if shortURL.Workspace != 0 {
+		return "workspace/" + strconv.FormatInt(shortURL.Workspace, 10)
+	}
+	return "user/" + shortURL.Owner
+}
+
+// cachedWebhookSubscriptions - the enabled webhooks the link's events go to, if they're cached
+func cachedWebhookSubscriptions(shortURL stores.ShortURL) ([]webhookInfo, bool) {
+	webhookSubscriptionsLock.Lock()
+	subscriptions := webhookSubscriptions
+	webhookSubscriptionsLock.Unlock()
+
+	webhooks, ok := subscriptions.Get(webhookSubscriptionsKey(shortURL))
+	if !ok {
+		return nil, false
+	}
+	return webhooks.([]webhookInfo), true
+}
+
+// webhookSubscriptionsFor - the enabled webhooks the link's events go to: its workspace's if it's in one, and otherwise
+// its owner's. Links in workspaces stay there when their creator leaves, so their events don't go to the creator
+func webhookSubscriptionsFor(shortURL stores.ShortURL) ([]webhookInfo, error) {
+	if webhooks, ok := cachedWebhookSubscriptions(shortURL); ok {
+		return webhooks, nil
+	}
+
+	webhookSubscriptionsLock.Lock()
+	version := webhookSubscriptionsVersion
+	webhookSubscriptionsLock.Unlock()
+
+	rows, err := db.DBCon.Query(`select id, url, secret, events from webhooks
+		where enabled=1 and ((?=0 and workspace_id=0 and username=?) or (workspace_id!=0 and workspace_id=?))`,
+		shortURL.Workspace, shortURL.Owner, shortURL.Workspace)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := []webhookInfo{}
+	for rows.Next() {
+		var webhook webhookInfo
+		var events string
+		err := rows.Scan(&webhook.ID, &webhook.URL, &webhook.Secret, &events)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		webhook.Events = strings.Split(events, ",")
+		webhooks = append(webhooks, webhook)
+	}
+	rows.Close()
+
+	webhookSubscriptionsLock.Lock()
+	defer webhookSubscriptionsLock.Unlock()
+	if version == webhookSubscriptionsVersion {
+		webhookSubscriptions.Set(webhookSubscriptionsKey(shortURL), webhooks)
+	}
+	return webhooks, nil
+}
+
+// invalidateWebhookSubscriptions - forget every cached subscription; called whenever webhooks are created, changed or
+// deleted
+func invalidateWebhookSubscriptions() {
+	webhookSubscriptionsLock.Lock()
+	defer webhookSubscriptionsLock.Unlock()
+
+	webhookSubscriptionsVersion++
+	webhookSubscriptions = cache.NewLRU(webhookSubscriptionsCacheSize, webhookSubscriptionsCacheTTL)
+}
+
+// subscribedWebhooks - the webhooks subscribed to the event
+func subscribedWebhooks(webhooks []webhookInfo, event string) []webhookInfo {
+	subscribed := []webhookInfo{}
+	for _, webhook := range webhooks {
+		for _, webhookEvent := range webhook.Events {
+			if webhookEvent == event {
+				subscribed = append(subscribed, webhook)
+			}
+		}
+	}
+
+	return subscribed
+}
+
+// queueWebhookEvent - queue deliveries of an event to every webhook subscribed to it
+func queueWebhookEvent(event string, shortURL stores.ShortURL, data map[string]interface{}) error {
+	webhooks, err := webhookSubscriptionsFor(shortURL)
+	if err != nil {
+		return err
+	}
+
+	webhooks = subscribedWebhooks(webhooks, event)
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(webhookPayload{Event: event, Time: time.Now().UTC(), Link: auditURL(shortURL), Data: data})
+	if err != nil {
+		return err
+	}
+
+	for _, webhook := range webhooks {
+		_, err := queueWebhookDelivery(webhook.ID, webhook.URL, webhook.Secret, event, payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dispatchWebhookEvent - queue deliveries of an event in the background, so the request isn't held up. Nothing is
+// started if the link's subscriptions are cached and none are to the event
+func dispatchWebhookEvent(event string, shortURL stores.ShortURL, data map[string]interface{}) {
+	if webhooks, ok := cachedWebhookSubscriptions(shortURL); ok && len(subscribedWebhooks(webhooks, event)) == 0 {
+		return
+	}
+
+	go func() {
+		err := queueWebhookEvent(event, shortURL, data)
+		if err != nil {
+			println("Failed to queue webhook event: " + err.Error())
+		}
+	}()
+}
+
+// StartWebhookWorkers - start delivering webhooks in the background, including those left undelivered when Linkener
+// last stopped
+func StartWebhookWorkers() error {
+	err := validateWebhooksConfig()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for job := range webhookQueue {
+				deliverWebhook(job)
+			}
+		}()
+	}
+
+	rows, err := db.DBCon.Query(`select webhook_deliveries.id, webhooks.url, webhooks.secret, webhook_deliveries.event,
+		webhook_deliveries.payload, webhook_deliveries.attempts from webhook_deliveries
+		join webhooks on webhooks.id=webhook_deliveries.webhook_id
+		where webhook_deliveries.delivered=0 and webhook_deliveries.attempts<? and webhooks.enabled=1
+		order by webhook_deliveries.id`, webhookMaxAttempts)
+	if err != nil {
+		println(err.Error())
+		return errors.New("Failed to read pending webhook deliveries")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var job webhookJob
+		var payload string
+		err := rows.Scan(&job.deliveryID, &job.url, &job.secret, &job.event, &payload, &job.attempts)
+		if err != nil {
+			println(err.Error())
+			return errors.New("Failed to read pending webhook deliveries")
+		}
+		job.payload = []byte(payload)
+		queueWebhookJob(job)
+	}
+
+	go func() {
+		for {
+			err := pruneWebhookDeliveries()
+			if err != nil {
+				println("Failed to prune webhook deliveries: " + err.Error())
+			}
+			time.Sleep(time.Duration(config.Config.Webhooks.PruneInterval) * time.Second)
+		}
+	}()
+
+	return nil
+}
+
+// pruneWebhookDeliveries - delete the deliveries that were delivered or given up on longer ago than the retention
+// period. Those still being retried are kept
+func pruneWebhookDeliveries() error {
+	_, err := db.DBCon.Exec(`delete from webhook_deliveries where (delivered=1 or attempts>=?)
+		and coalesce(last_attempt, date_created)<datetime('now', ?)`,
+		webhookMaxAttempts, "-"+strconv.Itoa(config.Config.Webhooks.DeliveryRetention)+" seconds")
+	if err != nil {
+		println(err.Error())
+		return errors.New("Failed to delete old webhook deliveries")
+	}
+
+	return nil
+}
+
+// validWebhookRequest - returns an error message if the webhook's URL or events aren't valid
+func validWebhookRequest(request webhookRequest) string {
+	parsed, err := url.Parse(request.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "Invalid webhook URL"
+	}
+
+	// Hostnames are checked when deliveries are made, once they're resolved
+	if ip := net.ParseIP(parsed.Hostname()); ip != nil && !webhookAddressAllowed(ip) {
+		return "Webhook URL can't be a private address"
+	}
+
+	if len(request.Events) == 0 {
+		return "At least one event required"
+	}
+
+	for _, event := range request.Events {
+		if !webhookEvents[event] {
+			return "Invalid event: " + event
+		}
+	}
+
+	return ""
+}
+
+// webhookAllowed - whether the authorized user can manage the webhook: their own, or any of a workspace they're an
+// admin of
+func webhookAllowed(r *http.Request, webhook *webhookInfo) (bool, error) {
+	if webhook.Workspace == 0 {
+		return isAdmin(r) || webhook.CreatedBy == r.Context().Value(UsernameContextKey).(string), nil
+	}
+	return workspaceAllows(r, webhook.Workspace, workspaceAdmin)
+}
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*webhookInfo, error) {
+	var webhook webhookInfo
+	var events string
+	err := row.Scan(&webhook.ID, &webhook.CreatedBy, &webhook.Workspace, &webhook.URL, &events, &webhook.Enabled, &webhook.DateCreated)
+	if err != nil {
+		return nil, err
+	}
+
+	webhook.Events = strings.Split(events, ",")
+	return &webhook, nil
+}
+
+// requireWebhook - the webhook in the route, writing an error response if the authorized user can't manage it
+func requireWebhook(w http.ResponseWriter, r *http.Request) (*webhookInfo, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	webhook, err := scanWebhook(db.DBCon.QueryRow("select id, username, workspace_id, url, events, enabled, date_created from webhooks where id=?", id))
+	allowed := false
+	if err == nil {
+		allowed, err = webhookAllowed(r, webhook)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		println(err.Error())
+		http.Error(w, "Failed to fetch webhook", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if !allowed {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return webhook, true
+}
+
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && !requireFullScope(w, r) {
+		return
+	}
+
+	username := r.Context().Value(UsernameContextKey).(string)
+
+	switch r.Method {
+	case http.MethodGet:
+		// Admins see everyone's webhooks
+		var rows *sql.Rows
+		var err error
+		if isAdmin(r) {
+			rows, err = db.DBCon.Query("select id, username, workspace_id, url, events, enabled, date_created from webhooks order by id")
+		} else {
+			rows, err = db.DBCon.Query(`select id, username, workspace_id, url, events, enabled, date_created from webhooks
+				where (workspace_id=0 and username=?) or workspace_id in
+				(select workspace_id from workspace_members where username=? and permission=?) order by id`, username, username, workspaceAdmin)
+		}
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to fetch webhooks", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		webhooks := []webhookInfo{}
+		for rows.Next() {
+			webhook, err := scanWebhook(rows)
+			if err != nil {
+				println(err.Error())
+				http.Error(w, "Failed to fetch webhooks", http.StatusInternalServerError)
+				return
+			}
+			webhooks = append(webhooks, *webhook)
+		}
+
+		json.NewEncoder(w).Encode(webhooks)
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var decodedBody webhookRequest
+		err = json.Unmarshal(body, &decodedBody)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+			return
+		}
+
+		if message := validWebhookRequest(decodedBody); message != "" {
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+
+		if decodedBody.Workspace != 0 {
+			allowed, err := workspaceAllows(r, decodedBody.Workspace, workspaceAdmin)
+			if err != nil {
+				println(err.Error())
+				http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+				return
+			}
+
+			if !allowed {
+				http.Error(w, "Only workspace admins can add webhooks to it", http.StatusForbidden)
+				return
+			}
+		}
+
+		secret, err := randomURLString(32)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+
+		enabled := decodedBody.Enabled == nil || *decodedBody.Enabled
+		result, err := db.DBCon.Exec("insert into webhooks(username, workspace_id, url, secret, events, enabled) values(?, ?, ?, ?, ?, ?)",
+			username, decodedBody.Workspace, decodedBody.URL, secret, strings.Join(decodedBody.Events, ","), enabled)
+		var id int64
+		if err == nil {
+			id, err = result.LastInsertId()
+		}
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+		invalidateWebhookSubscriptions()
+
+		webhook := webhookInfo{
+			ID:          id,
+			CreatedBy:   username,
+			Workspace:   decodedBody.Workspace,
+			URL:         decodedBody.URL,
+			Events:      decodedBody.Events,
+			Enabled:     enabled,
+			DateCreated: time.Now().UTC().Truncate(time.Second),
+		}
+		recordAudit(r, username, "webhook.create", strconv.FormatInt(id, 10), nil, webhook)
+
+		// The secret is only ever shown here
+		webhook.Secret = secret
+		json.NewEncoder(w).Encode(webhook)
+	}
+}
+
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && !requireFullScope(w, r) {
+		return
+	}
+
+	webhook, ok := requireWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(webhook)
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var decodedBody webhookRequest
+		err = json.Unmarshal(body, &decodedBody)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+			return
+		}
+
+		if message := validWebhookRequest(decodedBody); message != "" {
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+
+		updated := *webhook
+		updated.URL = decodedBody.URL
+		updated.Events = decodedBody.Events
+		if decodedBody.Enabled != nil {
+			updated.Enabled = *decodedBody.Enabled
+		}
+
+		_, err = db.DBCon.Exec("update webhooks set url=?, events=?, enabled=? where id=?",
+			updated.URL, strings.Join(updated.Events, ","), updated.Enabled, updated.ID)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to update webhook", http.StatusInternalServerError)
+			return
+		}
+		invalidateWebhookSubscriptions()
+
+		recordAudit(r, r.Context().Value(UsernameContextKey).(string), "webhook.update", strconv.FormatInt(webhook.ID, 10), webhook, updated)
+		json.NewEncoder(w).Encode(updated)
+	case http.MethodDelete:
+		tx, err := db.DBCon.Begin()
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+			return
+		}
+
+		_, err = tx.Exec("delete from webhook_deliveries where webhook_id=?", webhook.ID)
+		if err == nil {
+			_, err = tx.Exec("delete from webhooks where id=?", webhook.ID)
+		}
+		if err != nil {
+			tx.Rollback()
+			println(err.Error())
+			http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+			return
+		}
+		invalidateWebhookSubscriptions()
+
+		recordAudit(r, r.Context().Value(UsernameContextKey).(string), "webhook.delete", strconv.FormatInt(webhook.ID, 10), webhook, nil)
+		http.ResponseWriter.Write(w, []byte("Success!"))
+	}
+}
+
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := requireWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.DBCon.Query(`select id, event, payload, attempts, delivered, status_code, error, date_created, last_attempt
+		from webhook_deliveries where webhook_id=? order by id desc limit ?`, webhook.ID, maxWebhookDeliveries)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to fetch deliveries", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []webhookDeliveryInfo{}
+	for rows.Next() {
+		var delivery webhookDeliveryInfo
+		var payload string
+		err := rows.Scan(&delivery.ID, &delivery.Event, &payload, &delivery.Attempts, &delivery.Delivered, &delivery.StatusCode,
+			&delivery.Error, &delivery.DateCreated, &delivery.LastAttempt)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to fetch deliveries", http.StatusInternalServerError)
+			return
+		}
+		delivery.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, delivery)
+	}
+
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func pingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
+	webhook, ok := requireWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	if !webhook.Enabled {
+		http.Error(w, "Webhook is disabled", http.StatusConflict)
+		return
+	}
+
+	var secret string
+	err := db.DBCon.QueryRow("select secret from webhooks where id=?", webhook.ID).Scan(&secret)
+	var payload []byte
+	if err == nil {
+		payload, err = json.Marshal(webhookPayload{
+			Event: eventPing,
+			Time:  time.Now().UTC(),
+			Data:  map[string]interface{}{"webhook": webhook.ID},
+		})
+	}
+	var deliveryID int64
+	if err == nil {
+		deliveryID, err = queueWebhookDelivery(webhook.ID, webhook.URL, secret, eventPing, payload)
+	}
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to ping webhook", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]int64{"delivery_id": deliveryID})
+}
+
+// SetUpWebhooksHandlers - set up the /webhooks REST handlers
+func SetUpWebhooksHandlers(subrouter *mux.Router) error {
+	subrouter.HandleFunc("/{id}/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		webhookDeliveriesHandler(w, r)
+	}).Methods("GET")
+
+	subrouter.HandleFunc("/{id}/ping", func(w http.ResponseWriter, r *http.Request) {
+		pingWebhookHandler(w, r)
+	}).Methods("POST")
+
+	subrouter.HandleFunc("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		webhookHandler(w, r)
+	}).Methods("GET", "PUT", "DELETE")
+
+	subrouter.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		webhooksHandler(w, r)
+	}).Methods("GET", "POST")
+
+	return nil
+}
@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/db"
+	"github.com/shu8/linkener/internal/stores"
+)
+
+func allowWebhookNetworks(t *testing.T, networks ...string) {
+	oldNetworks := config.Config.Webhooks.AllowedNetworks
+	t.Cleanup(func() { config.Config.Webhooks.AllowedNetworks = oldNetworks })
+	config.Config.Webhooks.AllowedNetworks = networks
+}
+
+func TestWebhookAddressAllowed(t *testing.T) {
+	allowWebhookNetworks(t)
+
+	for _, address := range []string{"127.0.0.1", "::1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "::ffff:169.254.169.254", "fe80::1", "fd00::1", "0.0.0.0", "100.64.0.1"} {
+		if webhookAddressAllowed(net.ParseIP(address)) {
+			t.Errorf("%s: allowed, want blocked", address)
+		}
+	}
+	for _, address := range []string{"93.184.216.34", "2606:2800:220:1::1"} {
+		if !webhookAddressAllowed(net.ParseIP(address)) {
+			t.Errorf("%s: blocked, want allowed", address)
+		}
+	}
+
+	allowWebhookNetworks(t, "127.0.0.1", "10.0.0.0/8")
+	for _, address := range []string{"127.0.0.1", "10.1.2.3"} {
+		if !webhookAddressAllowed(net.ParseIP(address)) {
+			t.Errorf("%s with allowed_networks: blocked, want allowed", address)
+		}
+	}
+	if webhookAddressAllowed(net.ParseIP("127.0.0.2")) {
+		t.Error("127.0.0.2 with 127.0.0.1 allowed: allowed, want blocked")
+	}
+}
+
+func TestWebhookDeliveryBlockedAtDial(t *testing.T) {
+	allowWebhookNetworks(t)
+
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer server.Close()
+
+	// localhost is a hostname, so it's only caught once it's resolved
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	job := webhookJob{url: "http://localhost:" + port + "/", event: eventPing, payload: []byte("{}")}
+	if _, err := sendWebhook(job); err == nil || received != 0 {
+		t.Fatalf("delivering to localhost: got error %v and %d deliveries, want it blocked", err, received)
+	}
+
+	allowWebhookNetworks(t, "127.0.0.1/32", "::1")
+	if status, err := sendWebhook(job); err != nil || status != http.StatusOK || received != 1 {
+		t.Fatalf("delivering to allowed localhost: got status %d and error %v, want it delivered", status, err)
+	}
+}
+
+func TestValidWebhookRequestPrivateAddress(t *testing.T) {
+	allowWebhookNetworks(t)
+
+	for _, url := range []string{"http://169.254.169.254/latest/meta-data/", "http://127.0.0.1:4000/", "http://[::1]/"} {
+		if message := validWebhookRequest(webhookRequest{URL: url, Events: []string{eventPing}}); message == "" {
+			t.Errorf("%s: valid, want rejected", url)
+		}
+	}
+	if message := validWebhookRequest(webhookRequest{URL: "https://example.com/hook", Events: []string{eventLinkCreated}}); message != "" {
+		t.Errorf("public URL: got %q, want valid", message)
+	}
+}
+
+func TestWebhookSubscriptionsCache(t *testing.T) {
+	setUpTestAuthDB(t)
+	token := newTestUser(t, "alice", scopeFull)
+	link := stores.ShortURL{Slug: "example", Owner: "alice"}
+
+	webhooks, err := webhookSubscriptionsFor(link)
+	if err != nil || len(webhooks) != 0 {
+		t.Fatalf("no webhooks: got %d subscriptions and error %v", len(webhooks), err)
+	}
+	if webhooks, ok := cachedWebhookSubscriptions(link); !ok || len(webhooks) != 0 {
+		t.Fatal("no webhooks: subscriptions weren't cached")
+	}
+
+	w := serveAuthorized(webhooksHandler, http.MethodPost, "/api/webhooks/", `{"url": "https://example.com/hook", "events": ["visit.recorded"]}`, token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("creating webhook: got status %d: %s", w.Code, w.Body.String())
+	}
+	if _, ok := cachedWebhookSubscriptions(link); ok {
+		t.Fatal("creating webhook: cached subscriptions weren't invalidated")
+	}
+
+	webhooks, err = webhookSubscriptionsFor(link)
+	if err != nil || len(webhooks) != 1 {
+		t.Fatalf("one webhook: got %d subscriptions and error %v", len(webhooks), err)
+	}
+	if len(subscribedWebhooks(webhooks, eventVisitRecorded)) != 1 || len(subscribedWebhooks(webhooks, eventLinkCreated)) != 0 {
+		t.Errorf("one webhook: subscribed to the wrong events: %v", webhooks[0].Events)
+	}
+
+}
+
+// newTestWebhook - add an enabled webhook, returning its ID
+func newTestWebhook(t *testing.T, username string, workspace int64, url, secret, events string) int64 {
+	result, err := db.DBCon.Exec("insert into webhooks(username, workspace_id, url, secret, events) values(?, ?, ?, ?, ?)",
+		username, workspace, url, secret, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestWebhookSubscriptionsWorkspaceLinks(t *testing.T) {
+	setUpTestAuthDB(t)
+	personal := newTestWebhook(t, "alice", 0, "https://example.com/alice", "secret", eventLinkCreated)
+	workspace := newTestWebhook(t, "bob", 1, "https://example.com/workspace", "secret", eventLinkCreated)
+
+	// Links alice created in the workspace belong to it, so only go to its webhooks
+	for _, test := range []struct {
+		link stores.ShortURL
+		want int64
+	}{
+		{stores.ShortURL{Slug: "mine", Owner: "alice"}, personal},
+		{stores.ShortURL{Slug: "shared", Owner: "alice", Workspace: 1}, workspace},
+	} {
+		webhooks, err := webhookSubscriptionsFor(test.link)
+		if err != nil || len(webhooks) != 1 || webhooks[0].ID != test.want {
+			t.Errorf("%s: got subscriptions %+v and error %v, want only webhook %d", test.link.Slug, webhooks, err, test.want)
+		}
+	}
+}
+
+func TestWebhookRetryUsesCurrentSettings(t *testing.T) {
+	setUpTestAuthDB(t)
+	allowWebhookNetworks(t, "127.0.0.1/32", "::1")
+
+	received := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received[r.URL.Path] = r.Header.Get("X-Linkener-Signature")
+	}))
+	defer server.Close()
+
+	id := newTestWebhook(t, "alice", 0, server.URL+"/old", "old secret", eventPing)
+	result, err := db.DBCon.Exec("insert into webhook_deliveries(webhook_id, event, payload, attempts) values(?, ?, '{}', 1)", id, eventPing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveryID, _ := result.LastInsertId()
+
+	// The webhook is changed while the delivery is waiting to be retried
+	_, err = db.DBCon.Exec("update webhooks set url=?, secret=? where id=?", server.URL+"/new", "new secret", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverWebhook(webhookJob{deliveryID: deliveryID, url: server.URL + "/old", secret: "old secret", event: eventPing, payload: []byte("{}"), attempts: 1})
+
+	if _, ok := received["/old"]; ok || received["/new"] != "sha256="+webhookSignature("new secret", []byte("{}")) {
+		t.Errorf("retrying: got deliveries %v, want one to the new URL signed with the new secret", received)
+	}
+}
+
+// webhookDeliveryCount - how many deliveries of the event have been logged
+func webhookDeliveryCount(t *testing.T, event string) int {
+	var count int
+	err := db.DBCon.QueryRow("select count(*) from webhook_deliveries where event=?", event).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestLinkExpiredSentOnce(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestStore(t, storeType)
+			newTestWebhook(t, "alice", 0, "https://example.com/hook", "secret", eventLinkExpired)
+			newTestURL(t, store, stores.ShortURL{Slug: "once", URL: "https://example.com", Owner: "alice", AllowedVisits: 1})
+
+			for i := 0; i < 3; i++ {
+				visitShortURL(store, http.MethodGet, "once", testBrowserUserAgent, nil)
+			}
+
+			// Events are queued in the background
+			deadline := time.Now().Add(5 * time.Second)
+			for webhookDeliveryCount(t, eventLinkExpired) == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if deliveries := webhookDeliveryCount(t, eventLinkExpired); deliveries != 1 {
+				t.Fatalf("after two refused visits: got %d link.expired deliveries, want 1", deliveries)
+			}
+
+			// Until the link is changed, e.g. to allow more visits
+			url, err := store.GetURL("once", false)
+			if err != nil || !url.ExpiredNotified {
+				t.Fatalf("after expiring: got %+v and error %v, want it marked as notified", url, err)
+			}
+			err = store.UpdateURL(*url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if notify, err := store.MarkExpiredNotified("once"); err != nil || !notify {
+				t.Errorf("after editing: got %v and error %v, want it to be notified again", notify, err)
+			}
+		})
+	}
+}
+
+func TestPruneWebhookDeliveries(t *testing.T) {
+	setUpTestAuthDB(t)
+	oldWebhooks := config.Config.Webhooks
+	t.Cleanup(func() { config.Config.Webhooks = oldWebhooks })
+	config.Config.Webhooks.DeliveryRetention = 60 * 60
+
+	id := newTestWebhook(t, "alice", 0, "https://example.com/hook", "secret", eventPing)
+	for _, delivery := range []struct {
+		event     string
+		attempts  int
+		delivered bool
+		age       string
+	}{
+		{"old.delivered", 1, true, "-2 hours"},
+		{"old.dead", webhookMaxAttempts, false, "-2 hours"},
+		{"old.retrying", 2, false, "-2 hours"},
+		{"new.delivered", 1, true, "-1 minutes"},
+		{"new.dead", webhookMaxAttempts, false, "-1 minutes"},
+	} {
+		_, err := db.DBCon.Exec(`insert into webhook_deliveries(webhook_id, event, payload, attempts, delivered, last_attempt)
+			values(?, ?, '{}', ?, ?, datetime('now', ?))`, id, delivery.event, delivery.attempts, delivery.delivered, delivery.age)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := pruneWebhookDeliveries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for event, want := range map[string]int{"old.delivered": 0, "old.dead": 0, "old.retrying": 1, "new.delivered": 1, "new.dead": 1} {
+		if count := webhookDeliveryCount(t, event); count != want {
+			t.Errorf("%s: got %d deliveries after pruning, want %d", event, count, want)
+		}
+	}
+}
@@ -0,0 +1,600 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/db"
+	"github.com/shu8/linkener/internal/stores"
+
+	"github.com/gorilla/mux"
+)
+
+// Workspace member permissions, each allowing everything the one before it does
+const (
+	workspaceView  = "view"
+	workspaceEdit  = "edit"
+	workspaceAdmin = "admin"
+)
+
+var workspacePermissionRanks = map[string]int{workspaceView: 1, workspaceEdit: 2, workspaceAdmin: 3}
+
+type workspaceRequest struct {
+	Name string `json:"name"`
+}
+
+type workspaceMemberRequest struct {
+	Permission string `json:"permission"`
+}
+
+type transferLinksRequest struct {
+	From  string   `json:"from"`
+	To    string   `json:"to"`
+	Slugs []string `json:"slugs"`
+}
+
+type workspaceMember struct {
+	Username   string `json:"username"`
+	Permission string `json:"permission"`
+}
+
+type workspaceInfo struct {
+	ID          int64             `json:"id"`
+	Name        string            `json:"name"`
+	DateCreated time.Time         `json:"date_created"`
+	Permission  string            `json:"permission,omitempty"`
+	Members     []workspaceMember `json:"members,omitempty"`
+}
+
+// workspacePermission - the user's permission in the workspace, or "" if they aren't a member
+func workspacePermission(workspaceID int64, username string) (string, error) {
+	var permission string
+	err := db.DBCon.QueryRow("select permission from workspace_members where workspace_id=? and username=?", workspaceID, username).Scan(&permission)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return permission, err
+}
+
+// workspaceAllows - whether the authorized user has at least the given permission in the workspace. Admins can
+// manage every workspace, as can everyone when authentication is disabled
+func workspaceAllows(r *http.Request, workspaceID int64, permission string) (bool, error) {
+	username := requestUsername(r)
+	if username == "" || isAdmin(r) {
+		var exists bool
+		err := db.DBCon.QueryRow("select count(*) > 0 from workspaces where id=?", workspaceID).Scan(&exists)
+		return exists, err
+	}
+
+	userPermission, err := workspacePermission(workspaceID, username)
+	if err != nil {
+		return false, err
+	}
+
+	return userPermission != "" && workspacePermissionRanks[userPermission] >= workspacePermissionRanks[permission], nil
+}
+
+// urlAllows - whether the authorized user has at least the given permission on a short URL. Links outside workspaces
+// are available to every user
+func urlAllows(r *http.Request, url *stores.ShortURL, permission string) (bool, error) {
+	if url.Workspace == 0 {
+		return true, nil
+	}
+	return workspaceAllows(r, url.Workspace, permission)
+}
+
+// workspaceIDFromRequest - the {id} in the route, writing an error response if it's invalid
+func workspaceIDFromRequest(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid workspace ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// requireWorkspacePermission - ensure the authorized user has at least the given permission in the workspace in the
+// route, writing an error response if not. Workspaces the user can't see at all are reported as not found
+func requireWorkspacePermission(w http.ResponseWriter, r *http.Request, permission string) (int64, bool) {
+	id, ok := workspaceIDFromRequest(w, r)
+	if !ok {
+		return 0, false
+	}
+
+	allowed, err := workspaceAllows(r, id, permission)
+	if err == nil && !allowed && permission != workspaceView {
+		var canView bool
+		canView, err = workspaceAllows(r, id, workspaceView)
+		if err == nil && canView {
+			http.Error(w, "Unauthorized access", http.StatusForbidden)
+			return 0, false
+		}
+	}
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to fetch workspace", http.StatusInternalServerError)
+		return 0, false
+	}
+
+	if !allowed {
+		http.Error(w, "Workspace not found", http.StatusNotFound)
+		return 0, false
+	}
+
+	return id, true
+}
+
+func workspacesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && !requireFullScope(w, r) {
+		return
+	}
+
+	username := r.Context().Value(UsernameContextKey).(string)
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.DBCon.Query(`select workspaces.id, workspaces.name, workspaces.date_created, workspace_members.permission
+			from workspaces join workspace_members on workspace_members.workspace_id=workspaces.id
+			where workspace_members.username=? order by workspaces.id`, username)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to fetch workspaces", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		workspaces := []workspaceInfo{}
+		for rows.Next() {
+			var workspace workspaceInfo
+			err := rows.Scan(&workspace.ID, &workspace.Name, &workspace.DateCreated, &workspace.Permission)
+			if err != nil {
+				println(err.Error())
+				http.Error(w, "Failed to fetch workspaces", http.StatusInternalServerError)
+				return
+			}
+			workspaces = append(workspaces, workspace)
+		}
+
+		json.NewEncoder(w).Encode(workspaces)
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var decodedBody workspaceRequest
+		err = json.Unmarshal(body, &decodedBody)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+			return
+		}
+
+		if decodedBody.Name == "" {
+			http.Error(w, "Workspace name required", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.DBCon.Begin()
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to create workspace", http.StatusInternalServerError)
+			return
+		}
+
+		// The creator is the workspace's first admin
+		result, err := tx.Exec("insert into workspaces(name) values(?)", decodedBody.Name)
+		var id int64
+		if err == nil {
+			id, err = result.LastInsertId()
+		}
+		if err == nil {
+			_, err = tx.Exec("insert into workspace_members(workspace_id, username, permission) values(?, ?, ?)", id, username, workspaceAdmin)
+		}
+		if err != nil {
+			tx.Rollback()
+			println(err.Error())
+			http.Error(w, "Failed to create workspace", http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to create workspace", http.StatusInternalServerError)
+			return
+		}
+
+		recordAudit(r, username, "workspace.create", strconv.FormatInt(id, 10), nil, map[string]string{"name": decodedBody.Name})
+		json.NewEncoder(w).Encode(workspaceInfo{
+			ID:          id,
+			Name:        decodedBody.Name,
+			DateCreated: time.Now().UTC().Truncate(time.Second),
+			Permission:  workspaceAdmin,
+			Members:     []workspaceMember{{Username: username, Permission: workspaceAdmin}},
+		})
+	}
+}
+
+func workspaceHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
+	if r.Method != http.MethodGet && !requireFullScope(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		id, ok := requireWorkspacePermission(w, r, workspaceView)
+		if !ok {
+			return
+		}
+
+		var workspace workspaceInfo
+		err := db.DBCon.QueryRow("select id, name, date_created from workspaces where id=?", id).Scan(&workspace.ID, &workspace.Name, &workspace.DateCreated)
+		if err == nil {
+			workspace.Permission, err = workspacePermission(id, r.Context().Value(UsernameContextKey).(string))
+		}
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to fetch workspace", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.DBCon.Query("select username, permission from workspace_members where workspace_id=? order by username", id)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to fetch workspace", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		workspace.Members = []workspaceMember{}
+		for rows.Next() {
+			var member workspaceMember
+			err := rows.Scan(&member.Username, &member.Permission)
+			if err != nil {
+				println(err.Error())
+				http.Error(w, "Failed to fetch workspace", http.StatusInternalServerError)
+				return
+			}
+			workspace.Members = append(workspace.Members, member)
+		}
+
+		json.NewEncoder(w).Encode(workspace)
+	case http.MethodPut:
+		id, ok := requireWorkspacePermission(w, r, workspaceAdmin)
+		if !ok {
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var decodedBody workspaceRequest
+		err = json.Unmarshal(body, &decodedBody)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+			return
+		}
+
+		if decodedBody.Name == "" {
+			http.Error(w, "Workspace name required", http.StatusBadRequest)
+			return
+		}
+
+		var oldName string
+		err = db.DBCon.QueryRow("select name from workspaces where id=?", id).Scan(&oldName)
+		if err == nil {
+			_, err = db.DBCon.Exec("update workspaces set name=? where id=?", decodedBody.Name, id)
+		}
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to update workspace", http.StatusInternalServerError)
+			return
+		}
+
+		recordAudit(r, requestUsername(r), "workspace.update", strconv.FormatInt(id, 10), map[string]string{"name": oldName}, map[string]string{"name": decodedBody.Name})
+		http.ResponseWriter.Write(w, []byte("Success!"))
+	case http.MethodDelete:
+		id, ok := requireWorkspacePermission(w, r, workspaceAdmin)
+		if !ok {
+			return
+		}
+
+		// Deleting the links too would be too easy to do by accident. Trashed links count, as they could be restored
+		urls, err := store.GetURLs(false)
+		if err == nil {
+			var trashed *[]stores.ShortURL
+			trashed, err = store.GetTrashedURLs(false)
+			if err == nil {
+				*urls = append(*urls, *trashed...)
+			}
+		}
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to delete workspace", http.StatusInternalServerError)
+			return
+		}
+
+		for _, url := range *urls {
+			if url.Workspace == id {
+				http.Error(w, "Workspace still has links (including in the trash); delete or move them first", http.StatusConflict)
+				return
+			}
+		}
+
+		tx, err := db.DBCon.Begin()
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to delete workspace", http.StatusInternalServerError)
+			return
+		}
+
+		_, err = tx.Exec("delete from workspace_members where workspace_id=?", id)
+		if err == nil {
+			_, err = tx.Exec("delete from webhook_deliveries where webhook_id in (select id from webhooks where workspace_id=?)", id)
+		}
+		if err == nil {
+			_, err = tx.Exec("delete from webhooks where workspace_id=?", id)
+		}
+		if err == nil {
+			_, err = tx.Exec("delete from workspaces where id=?", id)
+		}
+		if err != nil {
+			tx.Rollback()
+			println(err.Error())
+			http.Error(w, "Failed to delete workspace", http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to delete workspace", http.StatusInternalServerError)
+			return
+		}
+		invalidateWebhookSubscriptions()
+
+		recordAudit(r, requestUsername(r), "workspace.delete", strconv.FormatInt(id, 10), nil, nil)
+		http.ResponseWriter.Write(w, []byte("Success!"))
+	}
+}
+
+// otherWorkspaceAdmins - how many admins the workspace has besides the given user
+func otherWorkspaceAdmins(workspaceID int64, username string) (int, error) {
+	var count int
+	err := db.DBCon.QueryRow("select count(*) from workspace_members where workspace_id=? and username!=? and permission=?",
+		workspaceID, username, workspaceAdmin).Scan(&count)
+	return count, err
+}
+
+func workspaceMemberHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
+	member := mux.Vars(r)["username"]
+
+	switch r.Method {
+	case http.MethodPut:
+		id, ok := requireWorkspacePermission(w, r, workspaceAdmin)
+		if !ok {
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var decodedBody workspaceMemberRequest
+		err = json.Unmarshal(body, &decodedBody)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+			return
+		}
+
+		if decodedBody.Permission == "" {
+			decodedBody.Permission = workspaceEdit
+		}
+		if _, ok := workspacePermissionRanks[decodedBody.Permission]; !ok {
+			http.Error(w, "Invalid permission", http.StatusBadRequest)
+			return
+		}
+
+		var userExists bool
+		var oldPermission string
+		otherAdmins := 1
+		err = db.DBCon.QueryRow("select count(*) > 0 from users where username=?", member).Scan(&userExists)
+		if err == nil {
+			oldPermission, err = workspacePermission(id, member)
+		}
+		if err == nil && decodedBody.Permission != workspaceAdmin {
+			otherAdmins, err = otherWorkspaceAdmins(id, member)
+		}
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to update workspace member", http.StatusInternalServerError)
+			return
+		}
+
+		if !userExists {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		if otherAdmins == 0 {
+			http.Error(w, "Workspaces must have at least one admin", http.StatusConflict)
+			return
+		}
+
+		_, err = db.DBCon.Exec(`insert into workspace_members(workspace_id, username, permission) values(?, ?, ?)
+			on conflict(workspace_id, username) do update set permission=excluded.permission`, id, member, decodedBody.Permission)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to update workspace member", http.StatusInternalServerError)
+			return
+		}
+
+		recordAudit(r, requestUsername(r), "workspace.member_update", strconv.FormatInt(id, 10)+"/"+member,
+			map[string]string{"permission": oldPermission}, map[string]string{"permission": decodedBody.Permission})
+		http.ResponseWriter.Write(w, []byte("Success!"))
+	case http.MethodDelete:
+		// Members can leave by themselves
+		permission := workspaceAdmin
+		if member == r.Context().Value(UsernameContextKey).(string) {
+			permission = workspaceView
+		}
+
+		id, ok := requireWorkspacePermission(w, r, permission)
+		if !ok {
+			return
+		}
+
+		otherAdmins, err := otherWorkspaceAdmins(id, member)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to remove workspace member", http.StatusInternalServerError)
+			return
+		}
+
+		if otherAdmins == 0 {
+			http.Error(w, "Workspaces must have at least one admin", http.StatusConflict)
+			return
+		}
+
+		// Their links stay in the workspace, so its admins can transfer them to someone else
+		result, err := db.DBCon.Exec("delete from workspace_members where workspace_id=? and username=?", id, member)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to remove workspace member", http.StatusInternalServerError)
+			return
+		}
+
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			http.Error(w, "Member not found", http.StatusNotFound)
+			return
+		}
+
+		recordAudit(r, requestUsername(r), "workspace.member_remove", strconv.FormatInt(id, 10)+"/"+member, nil, nil)
+		http.ResponseWriter.Write(w, []byte("Success!"))
+	}
+}
+
+func transferLinksHandler(w http.ResponseWriter, r *http.Request, store stores.Store) {
+	if !requireFullScope(w, r) {
+		return
+	}
+
+	id, ok := requireWorkspacePermission(w, r, workspaceAdmin)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var decodedBody transferLinksRequest
+	err = json.Unmarshal(body, &decodedBody)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+		return
+	}
+
+	if decodedBody.From == "" && len(decodedBody.Slugs) == 0 {
+		http.Error(w, "One of from, slugs required", http.StatusBadRequest)
+		return
+	}
+
+	toPermission, err := workspacePermission(id, decodedBody.To)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to transfer links", http.StatusInternalServerError)
+		return
+	}
+
+	if toPermission == "" {
+		http.Error(w, "Links can only be transferred to workspace members", http.StatusBadRequest)
+		return
+	}
+
+	urls, err := store.GetURLs(false)
+	if err != nil {
+		println(err.Error())
+		http.Error(w, "Failed to transfer links", http.StatusInternalServerError)
+		return
+	}
+
+	slugs := map[string]bool{}
+	for _, slug := range decodedBody.Slugs {
+		slugs[slug] = true
+	}
+
+	// Only links in this workspace, optionally only those from one member
+	transferred := []string{}
+	for _, url := range *urls {
+		if url.Workspace != id || (decodedBody.From != "" && url.Owner != decodedBody.From) ||
+			(len(slugs) > 0 && !slugs[url.Slug]) {
+			continue
+		}
+
+		before := auditURL(url)
+		url.Owner = decodedBody.To
+		err = store.UpdateURL(url)
+		if err != nil {
+			println(err.Error())
+			http.Error(w, "Failed to transfer links", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r, requestUsername(r), "url.update", url.Slug, before, auditURL(url))
+		dispatchWebhookEvent(eventLinkUpdated, url, nil)
+		transferred = append(transferred, url.Slug)
+	}
+
+	json.NewEncoder(w).Encode(transferred)
+}
+
+// SetUpWorkspacesHandlers - set up the /workspaces REST handlers
+func SetUpWorkspacesHandlers(subrouter *mux.Router) error {
+	store, err := stores.StoreFactory(config.Config.StoreType)
+	if err != nil {
+		return err
+	}
+
+	subrouter.HandleFunc("/{id}/members/{username}", func(w http.ResponseWriter, r *http.Request) {
+		workspaceMemberHandler(w, r)
+	}).Methods("PUT", "DELETE")
+
+	subrouter.HandleFunc("/{id}/transfer", func(w http.ResponseWriter, r *http.Request) {
+		transferLinksHandler(w, r, store)
+	}).Methods("POST")
+
+	subrouter.HandleFunc("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		workspaceHandler(w, r, store)
+	}).Methods("GET", "PUT", "DELETE")
+
+	subrouter.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		workspacesHandler(w, r)
+	}).Methods("GET", "POST")
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/shu8/linkener/internal/db"
+	"github.com/shu8/linkener/internal/stores"
+)
+
+// newTestWorkspace - add a workspace with the given members and their permissions, returning its ID
+func newTestWorkspace(t *testing.T, name string, members map[string]string) int64 {
+	result, err := db.DBCon.Exec("insert into workspaces(name) values(?)", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for username, permission := range members {
+		_, err := db.DBCon.Exec("insert into workspace_members(workspace_id, username, permission) values(?, ?, ?)", id, username, permission)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return id
+}
+
+func TestWorkspacePermissions(t *testing.T) {
+	for _, storeType := range testStoreTypes {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestStore(t, storeType)
+			router := newTestRouter(t, storeType)
+
+			tokens := map[string]string{}
+			for _, username := range []string{"alice", "bob", "carol", "dave"} {
+				tokens[username] = newTestUser(t, username, scopeFull)
+			}
+			newTestWorkspace(t, "Team", map[string]string{"alice": workspaceAdmin, "bob": workspaceEdit, "carol": workspaceView})
+			newTestURL(t, store, stores.ShortURL{Slug: "team", URL: "https://example.com/team", Owner: "bob", Workspace: 1})
+			newTestURL(t, store, stores.ShortURL{Slug: "mine", URL: "https://example.com/mine", Owner: "dave"})
+
+			// Only members see the workspace's links
+			for username, want := range map[string]int{"carol": 2, "dave": 1} {
+				w := serveRoute(router, http.MethodGet, "/urls/?visits=false", "", tokens[username])
+				var urls []stores.ShortURL
+				if err := json.Unmarshal(w.Body.Bytes(), &urls); err != nil || len(urls) != want {
+					t.Errorf("%s listing links: got %d links (status %d), want %d", username, len(urls), w.Code, want)
+				}
+			}
+
+			// Members who can't see a workspace are told it doesn't exist, and those who can but not change it are forbidden
+			for _, request := range []struct {
+				username, method, target, body string
+				want                           int
+			}{
+				{"dave", http.MethodGet, "/urls/team", "", http.StatusNotFound},
+				{"carol", http.MethodGet, "/urls/team", "", http.StatusOK},
+				{"dave", http.MethodDelete, "/urls/team", "", http.StatusNotFound},
+				{"carol", http.MethodDelete, "/urls/team", "", http.StatusForbidden},
+				{"dave", http.MethodGet, "/workspaces/1", "", http.StatusNotFound},
+				{"carol", http.MethodPut, "/workspaces/1", `{"name": "Renamed"}`, http.StatusForbidden},
+				{"bob", http.MethodPut, "/workspaces/1/members/dave", `{"permission": "view"}`, http.StatusForbidden},
+				{"bob", http.MethodPost, "/workspaces/1/transfer", `{"from": "bob", "to": "carol"}`, http.StatusForbidden},
+				{"alice", http.MethodPost, "/workspaces/1/transfer", `{"from": "bob", "to": "dave"}`, http.StatusBadRequest},
+				{"alice", http.MethodDelete, "/workspaces/1/members/alice", "", http.StatusConflict},
+				{"alice", http.MethodPut, "/workspaces/1/members/alice", `{"permission": "edit"}`, http.StatusConflict},
+				{"alice", http.MethodPut, "/workspaces/1/members/dave", `{"permission": "view"}`, http.StatusOK},
+				{"dave", http.MethodGet, "/urls/team", "", http.StatusOK},
+				{"alice", http.MethodPost, "/workspaces/1/transfer", `{"from": "bob", "to": "carol"}`, http.StatusOK},
+				{"carol", http.MethodDelete, "/workspaces/1/members/carol", "", http.StatusOK},
+			} {
+				w := serveRoute(router, request.method, request.target, request.body, tokens[request.username])
+				if w.Code != request.want {
+					t.Errorf("%s %s %s: got status %d, want %d: %s", request.username, request.method, request.target, w.Code, request.want, w.Body.String())
+				}
+			}
+
+			// Transferred links stay in the workspace after their new owner leaves it
+			url, err := store.GetURL("team", false)
+			if err != nil || url == nil || url.Owner != "carol" || url.Workspace != 1 {
+				t.Errorf("after transferring: got %+v and error %v, want it owned by carol in workspace 1", url, err)
+			}
+		})
+	}
+}
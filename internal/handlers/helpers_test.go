@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shu8/linkener/internal/config"
+	"github.com/shu8/linkener/internal/db"
+	"github.com/shu8/linkener/internal/stores"
+	"github.com/shu8/linkener/internal/totp"
+
+	"github.com/gorilla/mux"
+)
+
+// setUpTestAuthDB - point db.DBCon at a new auth database with the initial schema and every migration applied
+func setUpTestAuthDB(t *testing.T) {
+	setUpUnmigratedTestAuthDB(t)
+	err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalidateWebhookSubscriptions()
+}
+
+// setUpUnmigratedTestAuthDB - point db.DBCon at a new auth database with only the initial schema, as from before any
+// migrations
+func setUpUnmigratedTestAuthDB(t *testing.T) {
+	schema, err := ioutil.ReadFile(filepath.Join("..", "..", "schema.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	con, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { con.Close() })
+
+	// schema.sql is written for the sqlite3 shell, so leave out its dot commands
+	statements := []string{}
+	for _, line := range strings.Split(string(schema), "\n") {
+		if !strings.HasPrefix(line, ".") {
+			statements = append(statements, line)
+		}
+	}
+	_, err = con.Exec(strings.Join(statements, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.DBCon = con
+}
+
+// newTestUser - add a user, returning an access token for them with the given scope
+func newTestUser(t *testing.T, username, scope string) string {
+	_, err := db.DBCon.Exec("insert into users(username, password) values(?, '')", username)
+	if err != nil && !strings.Contains(err.Error(), "UNIQUE") {
+		t.Fatal(err)
+	}
+
+	return newTestToken(t, username, scope)
+}
+
+// newTestToken - a new access token for an existing user, with the given scope
+func newTestToken(t *testing.T, username, scope string) string {
+	tx, err := db.DBCon.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err := insertAccessToken(tx, username, "Test", scope, time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// serveAuthorized - send a request with the access token through AuthMiddleware to the handler
+func serveAuthorized(handler http.HandlerFunc, method, target, body, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	AuthMiddleware(handler).ServeHTTP(w, r)
+	return w
+}
+
+// enableTestTOTP - turn on two-factor authentication for an existing user, returning a recovery code they can use
+func enableTestTOTP(t *testing.T, username string) string {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recoveryCode, err := generateRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.DBCon.Exec("update users set totp_secret=?, totp_enabled=1 where username=?", secret, username)
+	if err == nil {
+		_, err = db.DBCon.Exec("insert into recovery_codes(username, code_hash) values(?, ?)", username, hashToken(recoveryCode))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recoveryCode
+}
+
+// testStoreTypes - the store types tests of stored short URLs run against
+var testStoreTypes = []string{"json", "sqlite"}
+
+// setUpTestStore - a store of the given type in a new file, with a new auth database alongside it
+func setUpTestStore(t *testing.T, storeType string) stores.Store {
+	setUpTestAuthDB(t)
+
+	oldJSONLocation, oldSQLiteLocation := config.Config.JSONStoreLocation, config.Config.SQLiteStoreLocation
+	t.Cleanup(func() {
+		config.Config.JSONStoreLocation = oldJSONLocation
+		config.Config.SQLiteStoreLocation = oldSQLiteLocation
+	})
+	config.Config.JSONStoreLocation = filepath.Join(t.TempDir(), "urls.json")
+	config.Config.SQLiteStoreLocation = filepath.Join(t.TempDir(), "urls.db")
+
+	store, err := stores.StoreFactory(storeType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// newTestURL - add a short URL, with a revision for its initial state as if it was created via the API
+func newTestURL(t *testing.T, store stores.Store, url stores.ShortURL) {
+	inserted, err := store.InsertURL(url)
+	if err == nil {
+		err = addRevision(store, nil, *inserted, inserted.Owner, 0)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveURLRoute - send a request for a /urls route with the given path variables through AuthMiddleware to the handler
+func serveURLRoute(handler func(http.ResponseWriter, *http.Request, stores.Store), store stores.Store, method string, vars map[string]string, token string) *httptest.ResponseRecorder {
+	return serveAuthorized(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, mux.SetURLVars(r, vars), store)
+	}, method, "/api/urls", "", token)
+}
+
+// newTestRouter - the /urls, /webhooks and /workspaces routes for the store type, behind AuthMiddleware
+func newTestRouter(t *testing.T, storeType string) *mux.Router {
+	oldStoreType := config.Config.StoreType
+	t.Cleanup(func() { config.Config.StoreType = oldStoreType })
+	config.Config.StoreType = storeType
+
+	router := mux.NewRouter()
+	for prefix, setUp := range map[string]func(*mux.Router) error{
+		"/urls":       SetUpUrlsHandlers,
+		"/webhooks":   SetUpWebhooksHandlers,
+		"/workspaces": SetUpWorkspacesHandlers,
+	} {
+		subrouter := router.PathPrefix(prefix).Subrouter()
+		subrouter.Use(AuthMiddleware)
+		err := setUp(subrouter)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return router
+}
+
+// serveRoute - send a request with the access token through the router
+func serveRoute(router *mux.Router, method, target, body, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
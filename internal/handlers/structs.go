@@ -1,6 +1,15 @@
 package handlers
 
-type usernameContext string
+type contextKey string
 
 // UsernameContextKey - identify the http Context for the username that is passed into handlers
-var UsernameContextKey = usernameContext("username")
+var UsernameContextKey = contextKey("username")
+
+// TokenIDContextKey - identify the http Context for the ID of the access token used to authorize the request
+var TokenIDContextKey = contextKey("token_id")
+
+// ScopeContextKey - identify the http Context for the scope of the access token used to authorize the request
+var ScopeContextKey = contextKey("scope")
+
+// RoleContextKey - identify the http Context for the role (e.g. admin) of the authorized user
+var RoleContextKey = contextKey("role")
@@ -0,0 +1,4 @@
+package static
+
+// PreviewTemplate is a minified HTML string defining the HTML for the Open Graph preview template served to bots
+var PreviewTemplate = `<html><head> <meta charset="utf-8"> <title>{{.Title}}</title> <meta property="og:type" content="website"> <meta property="og:title" content="{{.Title}}"> {{if .URL}}<meta property="og:url" content="{{.URL}}"> {{end}}<meta name="twitter:card" content="summary"> <meta name="twitter:title" content="{{.Title}}"> {{if .URL}}<meta http-equiv="refresh" content="0; url={{.URL}}">{{end}}</head><body> {{if .URL}}<a href="{{.URL}}">{{.URL}}</a>{{else}}<p>Open this link in a browser to continue.</p>{{end}}</body></html>`
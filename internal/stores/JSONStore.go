@@ -5,12 +5,19 @@ import (
 	"errors"
 	"github.com/shu8/linkener/internal/config"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 // JSONStore - simple Store based on a JSON file
 type JSONStore struct{}
 
+// jsonStoreLock - held while the file is read or rewritten, so a change can't be lost to another made at the same
+// time (like visits being flushed while a URL is updated), nor a read see a half written file
+var jsonStoreLock sync.Mutex
+
 func openFile(write bool) (*os.File, error) {
 	var fileNeedsInit = false
 	var err error
@@ -97,14 +104,68 @@ func getAllURLs(decoder *json.Decoder) ([]ShortURL, error) {
 			println(err.Error())
 			return nil, errors.New("Failed to parse URLs JSON file: invalid JSON")
 		}
+		countVisits(&parsedURL)
 		urls = append(urls, parsedURL)
 	}
 
 	return urls, nil
 }
 
+// countVisits - files from before visits were counted only have the visits themselves
+func countVisits(url *ShortURL) {
+	visits := 0
+	for _, visit := range url.Visits {
+		if !visit.Bot {
+			visits++
+		}
+	}
+
+	if url.VisitCount < visits {
+		url.VisitCount = visits
+	}
+}
+
+// filterURLs - the URLs either in or out of the trash, without their revisions or, unless asked for, their visits
+func filterURLs(urls []ShortURL, trashed, withVisits bool) *[]ShortURL {
+	filtered := []ShortURL{}
+	for _, url := range urls {
+		if (url.DateDeleted != nil) == trashed {
+			url.Revisions = nil
+			url.Rollups = nil
+			if !withVisits {
+				url.Visits = nil
+			}
+			filtered = append(filtered, url)
+		}
+	}
+
+	return &filtered
+}
+
 // GetURLs - GET requests
-func (e JSONStore) GetURLs() (*[]ShortURL, error) {
+func (e JSONStore) GetURLs(withVisits bool) (*[]ShortURL, error) {
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
+	file, decoder, err := getFileAndDecoder(false)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	urls, err := getAllURLs(decoder)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterURLs(urls, false, withVisits), nil
+}
+
+// GetTrashedURLs - URLs in the trash
+func (e JSONStore) GetTrashedURLs(withVisits bool) (*[]ShortURL, error) {
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
 	file, decoder, err := getFileAndDecoder(false)
 	if err != nil {
 		return nil, err
@@ -116,11 +177,14 @@ func (e JSONStore) GetURLs() (*[]ShortURL, error) {
 		return nil, err
 	}
 
-	return &urls, nil
+	return filterURLs(urls, true, withVisits), nil
 }
 
 // GetURL - GET /slug requests
-func (e JSONStore) GetURL(slug string) (*ShortURL, error) {
+func (e JSONStore) GetURL(slug string, withVisits bool) (*ShortURL, error) {
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
 	file, decoder, err := getFileAndDecoder(false)
 	if err != nil {
 		return nil, err
@@ -135,7 +199,13 @@ func (e JSONStore) GetURL(slug string) (*ShortURL, error) {
 			println(err.Error())
 			return nil, errors.New("Failed to parse URLs JSON file: invalid JSON")
 		}
-		if url.Slug == slug {
+		if url.Slug == slug && url.DateDeleted == nil {
+			countVisits(&url)
+			url.Revisions = nil
+			url.Rollups = nil
+			if !withVisits {
+				url.Visits = nil
+			}
 			return &url, nil
 		}
 	}
@@ -143,8 +213,45 @@ func (e JSONStore) GetURL(slug string) (*ShortURL, error) {
 	return nil, nil
 }
 
+// GetPrefixURL - the prefix link with the longest slug that the path starts with, followed by a /
+func (e JSONStore) GetPrefixURL(path string) (*ShortURL, error) {
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
+	file, decoder, err := getFileAndDecoder(false)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	urls, err := getAllURLs(decoder)
+	if err != nil {
+		return nil, err
+	}
+
+	var longest *ShortURL
+	for i, url := range urls {
+		if url.Prefix && url.DateDeleted == nil && strings.HasPrefix(path, url.Slug+"/") &&
+			(longest == nil || len(url.Slug) > len(longest.Slug)) {
+			longest = &urls[i]
+		}
+	}
+
+	if longest != nil {
+		longest.Visits = nil
+		longest.Revisions = nil
+		longest.Rollups = nil
+	}
+	return longest, nil
+}
+
 // InsertURL - POST requests
-func (e JSONStore) InsertURL(slug, url, password string, allowedVisits int) (*ShortURL, error) {
+func (e JSONStore) InsertURL(url ShortURL) (*ShortURL, error) {
+	defer invalidateLink(url.Slug)
+
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
 	file, decoder, err := getFileAndDecoder(true)
 	if err != nil {
 		return nil, err
@@ -156,7 +263,9 @@ func (e JSONStore) InsertURL(slug, url, password string, allowedVisits int) (*Sh
 		return nil, err
 	}
 
-	newURL := ShortURL{DateCreated: time.Now(), URL: url, Slug: slug, AllowedVisits: allowedVisits, Password: password, Visits: []Visit{}}
+	newURL := url
+	newURL.DateCreated = time.Now()
+	newURL.Visits = []Visit{}
 	urls = append(urls, newURL)
 
 	if err := writeURLsToFile(file, urls); err != nil {
@@ -168,6 +277,11 @@ func (e JSONStore) InsertURL(slug, url, password string, allowedVisits int) (*Sh
 
 // DeleteURL - DELETE requests
 func (e JSONStore) DeleteURL(slug string) error {
+	defer invalidateLink(slug)
+
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
 	file, decoder, err := getFileAndDecoder(true)
 	if err != nil {
 		return err
@@ -206,7 +320,12 @@ func (e JSONStore) DeleteURL(slug string) error {
 }
 
 // UpdateURL - PUT requests
-func (e JSONStore) UpdateURL(slug, url, password string, allowedVisits int) error {
+func (e JSONStore) UpdateURL(url ShortURL) error {
+	defer invalidateLink(url.Slug)
+
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
 	file, decoder, err := getFileAndDecoder(true)
 	if err != nil {
 		return err
@@ -224,10 +343,18 @@ func (e JSONStore) UpdateURL(slug, url, password string, allowedVisits int) erro
 			println(err.Error())
 			return errors.New("Failed to parse URLs JSON file: invalid JSON")
 		}
-		if parsedURL.Slug == slug {
-			(&parsedURL).URL = url
-			(&parsedURL).AllowedVisits = allowedVisits
-			(&parsedURL).Password = password
+		if parsedURL.Slug == url.Slug {
+			(&parsedURL).URL = url.URL
+			(&parsedURL).AllowedVisits = url.AllowedVisits
+			(&parsedURL).Password = url.Password
+			(&parsedURL).Owner = url.Owner
+			(&parsedURL).Workspace = url.Workspace
+			(&parsedURL).Prefix = url.Prefix
+			(&parsedURL).Template = url.Template
+			(&parsedURL).ForwardQuery = url.ForwardQuery
+			(&parsedURL).UTM = url.UTM
+			(&parsedURL).Rules = url.Rules
+			(&parsedURL).ExpiredNotified = false
 			found = true
 		}
 
@@ -245,40 +372,319 @@ func (e JSONStore) UpdateURL(slug, url, password string, allowedVisits int) erro
 	return nil
 }
 
-// RecordVisit - record a visit to a short URL
-func (e JSONStore) RecordVisit(slug, referer string) error {
+// MarkExpiredNotified - record that link.expired has been sent for the URL; false if it already had been
+func (e JSONStore) MarkExpiredNotified(slug string) (bool, error) {
+	defer invalidateLink(slug)
+
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
 	file, decoder, err := getFileAndDecoder(true)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer file.Close()
 
-	found := false
-	urls := []ShortURL{}
+	urls, err := getAllURLs(decoder)
+	if err != nil {
+		return false, err
+	}
 
-	for decoder.More() {
-		parsedURL := ShortURL{}
-		parsedURL.Visits = []Visit{}
-		err := decoder.Decode(&parsedURL)
-		if err != nil {
-			println(err.Error())
-			return errors.New("Failed to parse URLs JSON file: invalid JSON")
+	marked := false
+	for i := range urls {
+		if urls[i].Slug == slug && !urls[i].ExpiredNotified {
+			urls[i].ExpiredNotified = true
+			marked = true
 		}
-		if parsedURL.Slug == slug {
-			(&parsedURL).AddVisit(referer)
+	}
+
+	if !marked {
+		return false, nil
+	}
+
+	return true, writeURLsToFile(file, urls)
+}
+
+// setJSONDateDeleted - move a URL in or out of the trash
+func setJSONDateDeleted(slug string, dateDeleted *time.Time) error {
+	defer invalidateLink(slug)
+
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
+	file, decoder, err := getFileAndDecoder(true)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	urls, err := getAllURLs(decoder)
+	if err != nil {
+		return err
+	}
+
+	// Only URLs that aren't already where they're being moved to
+	found := false
+	for i := range urls {
+		if urls[i].Slug == slug && (urls[i].DateDeleted == nil) == (dateDeleted != nil) {
+			urls[i].DateDeleted = dateDeleted
 			found = true
 		}
-
-		urls = append(urls, parsedURL)
 	}
 
 	if !found {
 		return errors.New("URL not found")
 	}
 
+	return writeURLsToFile(file, urls)
+}
+
+// TrashURL - soft DELETE requests
+func (e JSONStore) TrashURL(slug string) error {
+	now := time.Now().UTC()
+	return setJSONDateDeleted(slug, &now)
+}
+
+// RestoreURL - move a URL back out of the trash
+func (e JSONStore) RestoreURL(slug string) error {
+	return setJSONDateDeleted(slug, nil)
+}
+
+// RecordVisits - record a batch of visits to short URLs, rewriting the file once. Visits to URLs that have been deleted
+// since are dropped
+func (e JSONStore) RecordVisits(visits []VisitRecord) error {
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
+	file, decoder, err := getFileAndDecoder(true)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	urls, err := getAllURLs(decoder)
+	if err != nil {
+		return err
+	}
+
+	indexes := map[string]int{}
+	for i, url := range urls {
+		indexes[url.Slug] = i
+	}
+
+	for _, visit := range visits {
+		if i, ok := indexes[visit.Slug]; ok {
+			if !visit.CountOnly {
+				urls[i].Visits = append(urls[i].Visits, visit.Visit)
+			}
+			if !visit.Visit.Bot {
+				urls[i].VisitCount++
+			}
+		}
+	}
+
+	return writeURLsToFile(file, urls)
+}
+
+// AddRevision - save a new revision of a short URL, numbered after its previous ones
+func (e JSONStore) AddRevision(slug string, revision Revision) (*Revision, error) {
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
+	file, decoder, err := getFileAndDecoder(true)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	urls, err := getAllURLs(decoder)
+	if err != nil {
+		return nil, err
+	}
+
+	var newRevision *Revision
+	for i := range urls {
+		if urls[i].Slug == slug {
+			revision.ID = len(urls[i].Revisions) + 1
+			if revision.DateCreated.IsZero() {
+				revision.DateCreated = time.Now()
+			}
+			urls[i].Revisions = append(urls[i].Revisions, revision)
+			newRevision = &revision
+		}
+	}
+
+	if newRevision == nil {
+		return nil, errors.New("URL not found")
+	}
+
 	if err := writeURLsToFile(file, urls); err != nil {
+		return nil, err
+	}
+
+	return newRevision, nil
+}
+
+// GetRevisions - a short URL's revisions, oldest first
+func (e JSONStore) GetRevisions(slug string) (*[]Revision, error) {
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
+	file, decoder, err := getFileAndDecoder(false)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	urls, err := getAllURLs(decoder)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, url := range urls {
+		if url.Slug == slug {
+			revisions := url.Revisions
+			if revisions == nil {
+				revisions = []Revision{}
+			}
+			return &revisions, nil
+		}
+	}
+
+	return nil, errors.New("URL not found")
+}
+
+// GetVisitRollups - a short URL's rolled up visits, oldest first
+func (e JSONStore) GetVisitRollups(slug string) (*[]VisitRollup, error) {
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
+	file, decoder, err := getFileAndDecoder(false)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	urls, err := getAllURLs(decoder)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, url := range urls {
+		if url.Slug == slug {
+			rollups := url.Rollups
+			if rollups == nil {
+				rollups = []VisitRollup{}
+			}
+			return &rollups, nil
+		}
+	}
+
+	return nil, errors.New("URL not found")
+}
+
+// CompactVisits - roll visits from before the given time up into daily totals, and delete them. Returns how many
+// visits were rolled up
+func (e JSONStore) CompactVisits(before time.Time) (int, error) {
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
+	file, decoder, err := getFileAndDecoder(true)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	urls, err := getAllURLs(decoder)
+	if err != nil {
+		return 0, err
+	}
+
+	compacted := 0
+	for i := range urls {
+		url := &urls[i]
+		// Index of each date, referer, bot and rule's rollup
+		indexes := map[VisitRollup]int{}
+		for j, rollup := range url.Rollups {
+			indexes[VisitRollup{Date: rollup.Date, Referer: rollup.Referer, Bot: rollup.Bot, Rule: rollup.Rule}] = j
+		}
+
+		kept := []Visit{}
+		for _, visit := range url.Visits {
+			// Visits without a time can't be rolled up into a day
+			if visit.Time == nil || !visit.Time.Before(before) {
+				kept = append(kept, visit)
+				continue
+			}
+
+			key := VisitRollup{Date: visit.Time.UTC().Format("2006-01-02"), Referer: visit.Referer, Bot: visit.Bot, Rule: visit.Rule}
+			if j, ok := indexes[key]; ok {
+				url.Rollups[j].Visits++
+			} else {
+				indexes[key] = len(url.Rollups)
+				key.Visits = 1
+				url.Rollups = append(url.Rollups, key)
+			}
+			compacted++
+		}
+
+		if len(kept) < len(url.Visits) {
+			url.Visits = kept
+			// Oldest first, like the SQLite store
+			sort.Slice(url.Rollups, func(a, b int) bool {
+				if url.Rollups[a].Date != url.Rollups[b].Date {
+					return url.Rollups[a].Date < url.Rollups[b].Date
+				}
+				if url.Rollups[a].Referer != url.Rollups[b].Referer {
+					return url.Rollups[a].Referer < url.Rollups[b].Referer
+				}
+				if url.Rollups[a].Bot != url.Rollups[b].Bot {
+					return !url.Rollups[a].Bot
+				}
+				return url.Rollups[a].Rule < url.Rollups[b].Rule
+			})
+		}
+	}
+
+	if compacted == 0 {
+		return 0, nil
+	}
+
+	if err := writeURLsToFile(file, urls); err != nil {
+		return 0, err
+	}
+
+	return compacted, nil
+}
+
+// PurgeVisits - delete all of a short URL's visits and visit rollups. Its visit count is kept, for its visit limit
+func (e JSONStore) PurgeVisits(slug string) error {
+	jsonStoreLock.Lock()
+	defer jsonStoreLock.Unlock()
+
+	file, decoder, err := getFileAndDecoder(true)
+	if err != nil {
 		return err
 	}
+	defer file.Close()
 
-	return nil
+	urls, err := getAllURLs(decoder)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for i := range urls {
+		if urls[i].Slug == slug {
+			urls[i].Visits = []Visit{}
+			urls[i].Rollups = nil
+			found = true
+		}
+	}
+
+	if !found {
+		return errors.New("URL not found")
+	}
+
+	return writeURLsToFile(file, urls)
 }
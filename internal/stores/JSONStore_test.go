@@ -0,0 +1,31 @@
+package stores
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/shu8/linkener/internal/config"
+)
+
+func TestJSONStoreCountsOldVisits(t *testing.T) {
+	store := setUpTestStore(t, "json")
+
+	// A file from before visits were counted; bot visits never counted
+	err := ioutil.WriteFile(config.Config.JSONStoreLocation, []byte(`[{"slug": "example", "url": "https://example.com",
+		"visits": [{"referer": ""}, {"referer": "", "bot": true}, {"referer": "https://example.net"}]}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if url, err := store.GetURL("example", false); err != nil || url == nil || url.VisitCount != 2 {
+		t.Fatalf("before recording: got %+v and error %v, want a count of 2", url, err)
+	}
+
+	err = store.RecordVisits([]VisitRecord{{Slug: "example", Visit: Visit{Referer: ""}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url, err := store.GetURL("example", false); err != nil || url == nil || url.VisitCount != 3 {
+		t.Errorf("after recording: got %+v and error %v, want a count of 3", url, err)
+	}
+}
@@ -0,0 +1,83 @@
+package stores
+
+import (
+	"sync"
+	"time"
+
+	"github.com/shu8/linkener/internal/cache"
+)
+
+// Link - what redirects need to know about a short URL: everything but its visits, which are only counted
+type Link struct {
+	URL    ShortURL
+	Visits int
+}
+
+// linkCache holds recently redirected-to links, by slug; nil if caching is disabled
+var linkCache *cache.LRU
+
+// Bumped whenever a link is invalidated, so a link read from a store before then isn't cached after
+var linkCacheVersion uint64
+var linkCacheLock sync.Mutex
+
+// EnableLinkCache - start caching up to size links, each for up to ttl
+func EnableLinkCache(size int, ttl time.Duration) {
+	linkCache = cache.NewLRU(size, ttl)
+}
+
+// CachedLink - the cached link for the slug, or nil. The version is passed to CacheLink if it isn't cached
+func CachedLink(slug string) (*Link, uint64) {
+	if linkCache == nil {
+		return nil, 0
+	}
+
+	linkCacheLock.Lock()
+	version := linkCacheVersion
+	linkCacheLock.Unlock()
+
+	if link, ok := linkCache.Get(slug); ok {
+		cached := link.(Link)
+		return &cached, version
+	}
+	return nil, version
+}
+
+// CacheLink - cache a link read from the store, unless it's been changed since version
+func CacheLink(link Link, version uint64) {
+	if linkCache == nil {
+		return
+	}
+
+	linkCacheLock.Lock()
+	defer linkCacheLock.Unlock()
+	if version == linkCacheVersion {
+		link.URL.Visits = nil
+		link.URL.Revisions = nil
+		linkCache.Set(link.URL.Slug, link)
+	}
+}
+
+// AddCachedVisit - count a visit in the slug's cached link, if it's cached
+func AddCachedVisit(slug string) {
+	if linkCache == nil {
+		return
+	}
+
+	linkCache.Update(slug, func(link interface{}) interface{} {
+		updated := link.(Link)
+		updated.Visits++
+		return updated
+	})
+}
+
+// invalidateLink - forget the slug's cached link; stores call this whenever they change or delete a URL
+func invalidateLink(slug string) {
+	if linkCache == nil {
+		return
+	}
+
+	linkCacheLock.Lock()
+	defer linkCacheLock.Unlock()
+	linkCacheVersion++
+	linkCache.Delete(slug)
+}
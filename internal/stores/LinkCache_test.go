@@ -0,0 +1,111 @@
+package stores
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shu8/linkener/internal/cache"
+)
+
+// setUpTestLinkCache - a store of the given type in a new file, with the link cache enabled until the test ends
+func setUpTestLinkCache(t *testing.T, storeType string) Store {
+	store := setUpTestStore(t, storeType)
+	t.Cleanup(func() { linkCache = nil })
+	linkCache = cache.NewLRU(10, time.Hour)
+	return store
+}
+
+// cacheTestLink - read the link from the store and cache it, as redirects do
+func cacheTestLink(t *testing.T, store Store, slug string) {
+	_, version := CachedLink(slug)
+	url, err := store.GetURL(slug, false)
+	if err != nil || url == nil {
+		t.Fatalf("getting %s: got %v and error %v", slug, url, err)
+	}
+	CacheLink(Link{URL: *url, Visits: url.VisitCount}, version)
+	if link, _ := CachedLink(slug); link == nil {
+		t.Fatalf("caching %s: not cached", slug)
+	}
+}
+
+func TestLinkCacheInvalidation(t *testing.T) {
+	for _, storeType := range []string{"json", "sqlite"} {
+		t.Run(storeType, func(t *testing.T) {
+			store := setUpTestLinkCache(t, storeType)
+			for _, slug := range []string{"edited", "trashed", "deleted", "other"} {
+				_, err := store.InsertURL(ShortURL{Slug: slug, URL: "https://example.com/" + slug, Owner: "alice"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				cacheTestLink(t, store, slug)
+			}
+
+			edited, err := store.GetURL("edited", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			edited.URL = "https://example.org"
+			for slug, change := range map[string]func() error{
+				"edited":  func() error { return store.UpdateURL(*edited) },
+				"trashed": func() error { return store.TrashURL("trashed") },
+				"deleted": func() error { return store.DeleteURL("deleted") },
+			} {
+				err := change()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if link, _ := CachedLink(slug); link != nil {
+					t.Errorf("%s: still cached after changing", slug)
+				}
+			}
+
+			if link, _ := CachedLink("other"); link == nil || link.URL.URL != "https://example.com/other" {
+				t.Errorf("other: got %+v, want it still cached", link)
+			}
+		})
+	}
+}
+
+func TestLinkCacheSkipsStaleReads(t *testing.T) {
+	store := setUpTestLinkCache(t, "sqlite")
+	_, err := store.InsertURL(ShortURL{Slug: "example", URL: "https://example.com", Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A redirect reads the link, then it's changed before the redirect caches what it read
+	_, version := CachedLink("example")
+	url, err := store.GetURL("example", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := *url
+	changed.URL = "https://example.org"
+	err = store.UpdateURL(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	CacheLink(Link{URL: *url}, version)
+	if link, _ := CachedLink("example"); link != nil {
+		t.Errorf("got %q cached from before the change, want nothing cached", link.URL.URL)
+	}
+}
+
+func TestAddCachedVisit(t *testing.T) {
+	store := setUpTestLinkCache(t, "sqlite")
+	_, err := store.InsertURL(ShortURL{Slug: "example", URL: "https://example.com", Owner: "alice", AllowedVisits: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheTestLink(t, store, "example")
+
+	AddCachedVisit("example")
+	AddCachedVisit("missing")
+	if link, _ := CachedLink("example"); link == nil || link.Visits != 1 {
+		t.Errorf("got %+v cached, want 1 visit", link)
+	}
+	if link, _ := CachedLink("missing"); link != nil {
+		t.Error("missing: cached by counting a visit")
+	}
+}
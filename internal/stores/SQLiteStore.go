@@ -2,8 +2,11 @@ package stores
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
+
 	"github.com/shu8/linkener/internal/config"
 )
 
@@ -25,6 +28,128 @@ var schema = []string{
 	);`,
 }
 
+// migrations are applied in order on top of schema; the database's user_version records how many have run
+var migrations = []string{
+	// 1: link owners
+	`ALTER TABLE urls ADD COLUMN owner TEXT NOT NULL DEFAULT '';`,
+	// 2: workspaces the links belong to; 0 is none
+	`ALTER TABLE urls ADD COLUMN workspace INTEGER NOT NULL DEFAULT 0;`,
+	// 3: link revisions
+	`CREATE TABLE url_revisions (
+		slug TEXT NOT NULL,
+		revision INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		allowed_visits INT NOT NULL,
+		password TEXT NOT NULL,
+		editor TEXT NOT NULL,
+		date_created DATETIME NOT NULL,
+		rolled_back_from INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (slug, revision)
+	);`,
+	// 4: trashed links
+	`ALTER TABLE urls ADD COLUMN date_deleted DATETIME;`,
+	// 5: visit counts, so redirects don't need to load every visit
+	`ALTER TABLE urls ADD COLUMN visit_count INTEGER NOT NULL DEFAULT 0;
+	UPDATE urls SET visit_count=(SELECT COUNT(*) FROM url_visits WHERE url_visits.slug=urls.slug);`,
+	// 6: visit times, and daily rollups of visits older than the retention period
+	`ALTER TABLE url_visits ADD COLUMN date_visited DATETIME;
+	CREATE TABLE url_visit_rollups (
+		slug TEXT NOT NULL,
+		date TEXT NOT NULL,
+		referer TEXT NOT NULL,
+		visits INTEGER NOT NULL,
+		PRIMARY KEY (slug, date, referer)
+	);`,
+	// 7: visitors' IPs and user agents
+	`ALTER TABLE url_visits ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_visits ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';`,
+	// 8: bot visits, rolled up separately
+	`ALTER TABLE url_visits ADD COLUMN bot INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE url_visit_rollups_new (
+		slug TEXT NOT NULL,
+		date TEXT NOT NULL,
+		referer TEXT NOT NULL,
+		bot INTEGER NOT NULL DEFAULT 0,
+		visits INTEGER NOT NULL,
+		PRIMARY KEY (slug, date, referer, bot)
+	);
+	INSERT INTO url_visit_rollups_new (slug, date, referer, visits) SELECT slug, date, referer, visits FROM url_visit_rollups;
+	DROP TABLE url_visit_rollups;
+	ALTER TABLE url_visit_rollups_new RENAME TO url_visit_rollups;`,
+	// 9: query string forwarding and UTM parameters, and the UTM parameters links were visited with
+	`ALTER TABLE urls ADD COLUMN forward_query INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE urls ADD COLUMN utm_source TEXT NOT NULL DEFAULT '';
+	ALTER TABLE urls ADD COLUMN utm_medium TEXT NOT NULL DEFAULT '';
+	ALTER TABLE urls ADD COLUMN utm_campaign TEXT NOT NULL DEFAULT '';
+	ALTER TABLE urls ADD COLUMN utm_term TEXT NOT NULL DEFAULT '';
+	ALTER TABLE urls ADD COLUMN utm_content TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_visits ADD COLUMN utm_source TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_visits ADD COLUMN utm_medium TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_visits ADD COLUMN utm_campaign TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_visits ADD COLUMN utm_term TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_visits ADD COLUMN utm_content TEXT NOT NULL DEFAULT '';`,
+	// 10: prefix links
+	`ALTER TABLE urls ADD COLUMN prefix INTEGER NOT NULL DEFAULT 0;`,
+	// 11: templated destinations
+	`ALTER TABLE urls ADD COLUMN template INTEGER NOT NULL DEFAULT 0;`,
+	// 12: routing rules, and the rules visits matched
+	`ALTER TABLE urls ADD COLUMN rules_json TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE url_visits ADD COLUMN rule INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE url_visit_rollups_new (
+		slug TEXT NOT NULL,
+		date TEXT NOT NULL,
+		referer TEXT NOT NULL,
+		bot INTEGER NOT NULL DEFAULT 0,
+		rule INTEGER NOT NULL DEFAULT 0,
+		visits INTEGER NOT NULL,
+		PRIMARY KEY (slug, date, referer, bot, rule)
+	);
+	INSERT INTO url_visit_rollups_new (slug, date, referer, bot, visits) SELECT slug, date, referer, bot, visits FROM url_visit_rollups;
+	DROP TABLE url_visit_rollups;
+	ALTER TABLE url_visit_rollups_new RENAME TO url_visit_rollups;`,
+	// 13: the settings added since revisions were (query string forwarding, UTM parameters, prefix links, templated
+	// destinations and routing rules) in revisions; NULL for revisions from before they were kept
+	`ALTER TABLE url_revisions ADD COLUMN forward_query INTEGER;
+	ALTER TABLE url_revisions ADD COLUMN utm_json TEXT;
+	ALTER TABLE url_revisions ADD COLUMN prefix INTEGER;
+	ALTER TABLE url_revisions ADD COLUMN template INTEGER;
+	ALTER TABLE url_revisions ADD COLUMN rules_json TEXT;`,
+	// 14: whether link.expired has been sent, so it's only sent once a URL runs out of visits
+	`ALTER TABLE urls ADD COLUMN expired_notified INTEGER NOT NULL DEFAULT 0;`,
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(migrations[i])
+		if err == nil {
+			// PRAGMA doesn't accept bound parameters
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func openDB() (*sql.DB, error) {
 	// go-sqlite3 will create db if it doesn't exist
 	db, err := sql.Open("sqlite3", config.Config.SQLiteStoreLocation)
@@ -46,12 +171,18 @@ func openDB() (*sql.DB, error) {
 		}
 	}
 
+	err = migrate(db)
+	if err != nil {
+		println(err.Error())
+		return nil, errors.New("Unable to migrate database")
+	}
+
 	return db, nil
 }
 
 func getVisits(db *sql.DB, url *ShortURL) error {
 	url.Visits = []Visit{}
-	rows, err := db.Query("SELECT referer FROM url_visits WHERE slug=?", url.Slug)
+	rows, err := db.Query("SELECT referer, date_visited, ip, user_agent, bot, rule, utm_source, utm_medium, utm_campaign, utm_term, utm_content FROM url_visits WHERE slug=?", url.Slug)
 	if err != nil {
 		println(err.Error())
 		return errors.New("Error reading from database")
@@ -59,8 +190,10 @@ func getVisits(db *sql.DB, url *ShortURL) error {
 	defer rows.Close()
 
 	for rows.Next() {
-		var referer string
-		err := rows.Scan(&referer)
+		visit := Visit{}
+		campaign := UTMParams{}
+		err := rows.Scan(&visit.Referer, &visit.Time, &visit.IP, &visit.UserAgent, &visit.Bot, &visit.Rule,
+			&campaign.Source, &campaign.Medium, &campaign.Campaign, &campaign.Term, &campaign.Content)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				return nil
@@ -68,21 +201,51 @@ func getVisits(db *sql.DB, url *ShortURL) error {
 			println(err.Error())
 			return errors.New("Error reading from database")
 		}
-		url.AddVisit(referer)
+		if !campaign.Empty() {
+			visit.Campaign = &campaign
+		}
+		url.AddVisit(visit)
 	}
 
 	return nil
 }
 
-// GetURLs - GET requests
-func (e SQLiteStore) GetURLs() (*[]ShortURL, error) {
+// marshalRules - a URL's routing rules, as they're stored
+func marshalRules(url ShortURL) (string, error) {
+	rules := url.Rules
+	if rules == nil {
+		rules = []RoutingRule{}
+	}
+
+	rulesJSON, err := json.Marshal(rules)
+	if err != nil {
+		println(err.Error())
+		return "", errors.New("Error writing to database")
+	}
+	return string(rulesJSON), nil
+}
+
+// unmarshalRules - read a URL's stored routing rules into it
+func unmarshalRules(rulesJSON string, url *ShortURL) error {
+	url.Rules = []RoutingRule{}
+	err := json.Unmarshal([]byte(rulesJSON), &url.Rules)
+	if err != nil {
+		println(err.Error())
+		return errors.New("Error reading from database")
+	}
+	return nil
+}
+
+// getURLs - every URL either in or out of the trash
+func getURLs(trashed, withVisits bool) (*[]ShortURL, error) {
 	db, err := openDB()
 	if err != nil {
 		return nil, err
 	}
 	defer db.Close()
 
-	rows, err := db.Query("SELECT slug, url, date_created, allowed_visits, password FROM urls")
+	rows, err := db.Query(`SELECT slug, url, date_created, allowed_visits, password, owner, workspace, date_deleted, visit_count,
+		prefix, template, forward_query, utm_source, utm_medium, utm_campaign, utm_term, utm_content, rules_json, expired_notified FROM urls WHERE (date_deleted IS NOT NULL)=?`, trashed)
 	if err != nil {
 		println(err.Error())
 		return nil, errors.New("Error reading from database")
@@ -92,7 +255,9 @@ func (e SQLiteStore) GetURLs() (*[]ShortURL, error) {
 	urls := []ShortURL{}
 	for rows.Next() {
 		url := ShortURL{}
-		err := rows.Scan(&url.Slug, &url.URL, &url.DateCreated, &url.AllowedVisits, &url.Password)
+		var rulesJSON string
+		err := rows.Scan(&url.Slug, &url.URL, &url.DateCreated, &url.AllowedVisits, &url.Password, &url.Owner, &url.Workspace, &url.DateDeleted, &url.VisitCount,
+			&url.Prefix, &url.Template, &url.ForwardQuery, &url.UTM.Source, &url.UTM.Medium, &url.UTM.Campaign, &url.UTM.Term, &url.UTM.Content, &rulesJSON, &url.ExpiredNotified)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				return nil, nil
@@ -101,28 +266,60 @@ func (e SQLiteStore) GetURLs() (*[]ShortURL, error) {
 			return nil, errors.New("Error reading from database")
 		}
 
-		err = getVisits(db, &url)
+		err = unmarshalRules(rulesJSON, &url)
 		if err != nil {
 			return nil, err
 		}
+
+		if withVisits {
+			err = getVisits(db, &url)
+			if err != nil {
+				return nil, err
+			}
+		}
 		urls = append(urls, url)
 	}
 
 	return &urls, nil
 }
 
+// GetURLs - GET requests
+func (e SQLiteStore) GetURLs(withVisits bool) (*[]ShortURL, error) {
+	return getURLs(false, withVisits)
+}
+
+// GetTrashedURLs - URLs in the trash
+func (e SQLiteStore) GetTrashedURLs(withVisits bool) (*[]ShortURL, error) {
+	return getURLs(true, withVisits)
+}
+
 // GetURL - GET /slug requests
-func (e SQLiteStore) GetURL(slug string) (*ShortURL, error) {
+func (e SQLiteStore) GetURL(slug string, withVisits bool) (*ShortURL, error) {
+	return getURL("slug=?", slug, withVisits)
+}
+
+// GetPrefixURL - the prefix link with the longest slug that the path starts with, followed by a /
+func (e SQLiteStore) GetPrefixURL(path string) (*ShortURL, error) {
+	// Not LIKE, as slugs can contain _
+	return getURL("prefix=1 AND substr(?, 1, length(slug) + 1)=slug || '/' ORDER BY length(slug) DESC LIMIT 1", path, false)
+}
+
+// getURL - the first short URL not in the trash matching the condition, which has one parameter
+func getURL(condition string, param string, withVisits bool) (*ShortURL, error) {
 	db, err := openDB()
 	if err != nil {
 		return nil, err
 	}
 	defer db.Close()
 
-	row := db.QueryRow("SELECT slug, url, date_created, allowed_visits, password FROM urls WHERE slug=?", slug)
+	row := db.QueryRow(`SELECT slug, url, date_created, allowed_visits, password, owner, workspace, visit_count,
+		prefix, template, forward_query, utm_source, utm_medium, utm_campaign, utm_term, utm_content, rules_json, expired_notified FROM urls
+		WHERE date_deleted IS NULL AND `+condition, param)
 
 	url := ShortURL{}
-	err = row.Scan(&url.Slug, &url.URL, &url.DateCreated, &url.AllowedVisits, &url.Password)
+	var rulesJSON string
+	err = row.Scan(&url.Slug, &url.URL, &url.DateCreated, &url.AllowedVisits, &url.Password, &url.Owner, &url.Workspace, &url.VisitCount,
+		&url.Prefix, &url.Template, &url.ForwardQuery, &url.UTM.Source, &url.UTM.Medium, &url.UTM.Campaign, &url.UTM.Term, &url.UTM.Content, &rulesJSON, &url.ExpiredNotified)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -131,24 +328,43 @@ func (e SQLiteStore) GetURL(slug string) (*ShortURL, error) {
 		return nil, errors.New("Error reading from database")
 	}
 
-	err = getVisits(db, &url)
+	err = unmarshalRules(rulesJSON, &url)
 	if err != nil {
 		return nil, err
 	}
 
+	if withVisits {
+		err = getVisits(db, &url)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &url, nil
 }
 
 // InsertURL - POST requests
-func (e SQLiteStore) InsertURL(slug, url, password string, allowedVisits int) (*ShortURL, error) {
+func (e SQLiteStore) InsertURL(url ShortURL) (*ShortURL, error) {
+	defer invalidateLink(url.Slug)
+
 	db, err := openDB()
 	if err != nil {
 		return nil, err
 	}
 	defer db.Close()
 
-	newURL := ShortURL{DateCreated: time.Now(), URL: url, Slug: slug, AllowedVisits: allowedVisits, Password: password}
-	_, err = db.Exec("INSERT INTO urls (slug, url, password, allowed_visits) VALUES(?,?,?,?)", slug, url, password, allowedVisits)
+	rulesJSON, err := marshalRules(url)
+	if err != nil {
+		return nil, err
+	}
+
+	newURL := url
+	newURL.DateCreated = time.Now()
+	newURL.Visits = []Visit{}
+	_, err = db.Exec(`INSERT INTO urls (slug, url, password, allowed_visits, owner, workspace,
+		prefix, template, forward_query, utm_source, utm_medium, utm_campaign, utm_term, utm_content, rules_json) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		url.Slug, url.URL, url.Password, url.AllowedVisits, url.Owner, url.Workspace,
+		url.Prefix, url.Template, url.ForwardQuery, url.UTM.Source, url.UTM.Medium, url.UTM.Campaign, url.UTM.Term, url.UTM.Content, rulesJSON)
 	if err != nil {
 		println(err.Error())
 		return nil, errors.New("Error saving to database")
@@ -159,6 +375,8 @@ func (e SQLiteStore) InsertURL(slug, url, password string, allowedVisits int) (*
 
 // DeleteURL - DELETE requests
 func (e SQLiteStore) DeleteURL(slug string) error {
+	defer invalidateLink(slug)
+
 	db, err := openDB()
 	if err != nil {
 		return err
@@ -185,6 +403,20 @@ func (e SQLiteStore) DeleteURL(slug string) error {
 		return errors.New("Error writing to database")
 	}
 
+	_, err = tx.Exec("DELETE FROM url_visit_rollups WHERE slug=?", slug)
+	if err != nil {
+		println(err.Error())
+		tx.Rollback()
+		return errors.New("Error writing to database")
+	}
+
+	_, err = tx.Exec("DELETE FROM url_revisions WHERE slug=?", slug)
+	if err != nil {
+		println(err.Error())
+		tx.Rollback()
+		return errors.New("Error writing to database")
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		println(err.Error())
@@ -195,14 +427,134 @@ func (e SQLiteStore) DeleteURL(slug string) error {
 }
 
 // UpdateURL - PUT requests
-func (e SQLiteStore) UpdateURL(slug, url, password string, allowedVisits int) error {
+func (e SQLiteStore) UpdateURL(url ShortURL) error {
+	defer invalidateLink(url.Slug)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rulesJSON, err := marshalRules(url)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(`UPDATE urls SET url=?, password=?, allowed_visits=?, owner=?, workspace=?,
+		prefix=?, template=?, forward_query=?, utm_source=?, utm_medium=?, utm_campaign=?, utm_term=?, utm_content=?, rules_json=?, expired_notified=0 WHERE slug=?`,
+		url.URL, url.Password, url.AllowedVisits, url.Owner, url.Workspace,
+		url.Prefix, url.Template, url.ForwardQuery, url.UTM.Source, url.UTM.Medium, url.UTM.Campaign, url.UTM.Term, url.UTM.Content, rulesJSON, url.Slug)
+	if err != nil {
+		println(err.Error())
+		return errors.New("Error writing to database")
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return errors.New("URL not found")
+	}
+
+	return nil
+}
+
+// MarkExpiredNotified - record that link.expired has been sent for the URL; false if it already had been
+func (e SQLiteStore) MarkExpiredNotified(slug string) (bool, error) {
+	defer invalidateLink(slug)
+
+	db, err := openDB()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	result, err := db.Exec("UPDATE urls SET expired_notified=1 WHERE slug=? AND expired_notified=0", slug)
+	if err != nil {
+		println(err.Error())
+		return false, errors.New("Error writing to database")
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		println(err.Error())
+		return false, errors.New("Error writing to database")
+	}
+
+	return affected > 0, nil
+}
+
+// setSQLiteDateDeleted - move a URL in or out of the trash
+func setSQLiteDateDeleted(slug string, dateDeleted *time.Time) error {
+	defer invalidateLink(slug)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Only URLs that aren't already where they're being moved to
+	result, err := db.Exec("UPDATE urls SET date_deleted=? WHERE slug=? AND (date_deleted IS NULL)=?", dateDeleted, slug, dateDeleted != nil)
+	if err != nil {
+		println(err.Error())
+		return errors.New("Error writing to database")
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return errors.New("URL not found")
+	}
+
+	return nil
+}
+
+// TrashURL - soft DELETE requests
+func (e SQLiteStore) TrashURL(slug string) error {
+	now := time.Now().UTC()
+	return setSQLiteDateDeleted(slug, &now)
+}
+
+// RestoreURL - move a URL back out of the trash
+func (e SQLiteStore) RestoreURL(slug string) error {
+	return setSQLiteDateDeleted(slug, nil)
+}
+
+// RecordVisits - record a batch of visits to short URLs
+func (e SQLiteStore) RecordVisits(visits []VisitRecord) error {
 	db, err := openDB()
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	_, err = db.Exec("UPDATE urls SET url=?, password=? WHERE slug=?", slug)
+	tx, err := db.Begin()
+	if err != nil {
+		println(err.Error())
+		return errors.New("Error writing to database")
+	}
+
+	for _, visit := range visits {
+		if !visit.CountOnly {
+			campaign := UTMParams{}
+			if visit.Visit.Campaign != nil {
+				campaign = *visit.Visit.Campaign
+			}
+			// Visits to short URLs deleted since aren't kept, so they aren't counted against another with the same slug
+			_, err = tx.Exec(`INSERT INTO url_visits (slug, referer, date_visited, ip, user_agent, bot, rule,
+				utm_source, utm_medium, utm_campaign, utm_term, utm_content) SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+				WHERE EXISTS (SELECT 1 FROM urls WHERE slug=?)`,
+				visit.Slug, visit.Visit.Referer, visit.Visit.Time, visit.Visit.IP, visit.Visit.UserAgent, visit.Visit.Bot, visit.Visit.Rule,
+				campaign.Source, campaign.Medium, campaign.Campaign, campaign.Term, campaign.Content, visit.Slug)
+		}
+		if err == nil && !visit.Visit.Bot {
+			_, err = tx.Exec("UPDATE urls SET visit_count=visit_count+1 WHERE slug=?", visit.Slug)
+		}
+		if err != nil {
+			println(err.Error())
+			tx.Rollback()
+			return errors.New("Error writing to database")
+		}
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		println(err.Error())
 		return errors.New("Error writing to database")
@@ -211,15 +563,204 @@ func (e SQLiteStore) UpdateURL(slug, url, password string, allowedVisits int) er
 	return nil
 }
 
-// RecordVisit - record a visit to a short URL
-func (e SQLiteStore) RecordVisit(slug, referer string) error {
+// AddRevision - save a new revision of a short URL, numbered after its previous ones
+func (e SQLiteStore) AddRevision(slug string, revision Revision) (*Revision, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		println(err.Error())
+		return nil, errors.New("Error writing to database")
+	}
+
+	err = tx.QueryRow("SELECT COALESCE(MAX(revision), 0) + 1 FROM url_revisions WHERE slug=?", slug).Scan(&revision.ID)
+	if err == nil {
+		if revision.DateCreated.IsZero() {
+			revision.DateCreated = time.Now()
+		}
+		// NULL for settings the revision doesn't have
+		var utmJSON, rulesJSON sql.NullString
+		if revision.UTM != nil {
+			var utm []byte
+			utm, err = json.Marshal(revision.UTM)
+			utmJSON = sql.NullString{String: string(utm), Valid: true}
+		}
+		if err == nil && revision.Rules != nil {
+			rulesJSON.String, err = marshalRules(ShortURL{Rules: *revision.Rules})
+			rulesJSON.Valid = true
+		}
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO url_revisions (slug, revision, url, allowed_visits, password, editor, date_created, rolled_back_from,
+				forward_query, utm_json, prefix, template, rules_json) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+				slug, revision.ID, revision.URL, revision.AllowedVisits, revision.Password, revision.Editor, revision.DateCreated, revision.RolledBackFrom,
+				revision.ForwardQuery, utmJSON, revision.Prefix, revision.Template, rulesJSON)
+		}
+	}
+	if err != nil {
+		println(err.Error())
+		tx.Rollback()
+		return nil, errors.New("Error writing to database")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		println(err.Error())
+		return nil, errors.New("Error writing to database")
+	}
+
+	return &revision, nil
+}
+
+// GetRevisions - a short URL's revisions, oldest first
+func (e SQLiteStore) GetRevisions(slug string) (*[]Revision, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT revision, url, allowed_visits, password, editor, date_created, rolled_back_from,
+		forward_query, utm_json, prefix, template, rules_json FROM url_revisions WHERE slug=? ORDER BY revision`, slug)
+	if err != nil {
+		println(err.Error())
+		return nil, errors.New("Error reading from database")
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		revision := Revision{}
+		var forwardQuery, prefix, template sql.NullBool
+		var utmJSON, rulesJSON sql.NullString
+		err := rows.Scan(&revision.ID, &revision.URL, &revision.AllowedVisits, &revision.Password, &revision.Editor, &revision.DateCreated, &revision.RolledBackFrom,
+			&forwardQuery, &utmJSON, &prefix, &template, &rulesJSON)
+		if err == nil && utmJSON.Valid {
+			revision.UTM = &UTMParams{}
+			err = json.Unmarshal([]byte(utmJSON.String), revision.UTM)
+		}
+		if err == nil && rulesJSON.Valid {
+			rules := ShortURL{}
+			err = unmarshalRules(rulesJSON.String, &rules)
+			revision.Rules = &rules.Rules
+		}
+		if err != nil {
+			println(err.Error())
+			return nil, errors.New("Error reading from database")
+		}
+		if forwardQuery.Valid {
+			revision.ForwardQuery = &forwardQuery.Bool
+		}
+		if prefix.Valid {
+			revision.Prefix = &prefix.Bool
+		}
+		if template.Valid {
+			revision.Template = &template.Bool
+		}
+		revisions = append(revisions, revision)
+	}
+
+	return &revisions, nil
+}
+
+// GetVisitRollups - a short URL's rolled up visits, oldest first
+func (e SQLiteStore) GetVisitRollups(slug string) (*[]VisitRollup, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT date, referer, bot, rule, visits FROM url_visit_rollups WHERE slug=? ORDER BY date, referer, bot, rule", slug)
+	if err != nil {
+		println(err.Error())
+		return nil, errors.New("Error reading from database")
+	}
+	defer rows.Close()
+
+	rollups := []VisitRollup{}
+	for rows.Next() {
+		rollup := VisitRollup{}
+		err := rows.Scan(&rollup.Date, &rollup.Referer, &rollup.Bot, &rollup.Rule, &rollup.Visits)
+		if err != nil {
+			println(err.Error())
+			return nil, errors.New("Error reading from database")
+		}
+		rollups = append(rollups, rollup)
+	}
+
+	return &rollups, nil
+}
+
+// CompactVisits - roll visits from before the given time up into daily totals, and delete them. Returns how many
+// visits were rolled up
+func (e SQLiteStore) CompactVisits(before time.Time) (int, error) {
+	db, err := openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		println(err.Error())
+		return 0, errors.New("Error writing to database")
+	}
+
+	// Visit times are stored in UTC, starting with the date
+	before = before.UTC()
+	_, err = tx.Exec(`INSERT INTO url_visit_rollups (slug, date, referer, bot, rule, visits)
+		SELECT slug, substr(date_visited, 1, 10), referer, bot, rule, COUNT(*) FROM url_visits WHERE date_visited < ?
+		GROUP BY slug, substr(date_visited, 1, 10), referer, bot, rule
+		ON CONFLICT (slug, date, referer, bot, rule) DO UPDATE SET visits=visits+excluded.visits`, before)
+	var result sql.Result
+	if err == nil {
+		result, err = tx.Exec("DELETE FROM url_visits WHERE date_visited < ?", before)
+	}
+	if err != nil {
+		println(err.Error())
+		tx.Rollback()
+		return 0, errors.New("Error writing to database")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		println(err.Error())
+		return 0, errors.New("Error writing to database")
+	}
+
+	compacted, _ := result.RowsAffected()
+	return int(compacted), nil
+}
+
+// PurgeVisits - delete all of a short URL's visits and visit rollups. Its visit count is kept, for its visit limit
+func (e SQLiteStore) PurgeVisits(slug string) error {
 	db, err := openDB()
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	_, err = db.Exec("INSERT INTO url_visits (slug, referer) VALUES (?, ?)", slug, referer)
+	tx, err := db.Begin()
+	if err != nil {
+		println(err.Error())
+		return errors.New("Error writing to database")
+	}
+
+	_, err = tx.Exec("DELETE FROM url_visits WHERE slug=?", slug)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM url_visit_rollups WHERE slug=?", slug)
+	}
+	if err != nil {
+		println(err.Error())
+		tx.Rollback()
+		return errors.New("Error writing to database")
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		println(err.Error())
 		return errors.New("Error writing to database")
@@ -0,0 +1,44 @@
+package stores
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/shu8/linkener/internal/config"
+)
+
+func TestVisitCountMigration(t *testing.T) {
+	store := setUpTestStore(t, "sqlite")
+
+	// A database from before visits were counted
+	db, err := sql.Open("sqlite3", config.Config.SQLiteStoreLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range append(append([]string{}, schema...), migrations[:4]...) {
+		_, err = db.Exec(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Exec("PRAGMA user_version = 4")
+	if err == nil {
+		_, err = db.Exec(`INSERT INTO urls (slug, url, allowed_visits, password) VALUES ('visited', 'https://example.com', 0, ''),
+			('unvisited', 'https://example.org', 0, '');
+		INSERT INTO url_visits (slug, referer) VALUES ('visited', ''), ('visited', 'https://example.net'), ('visited', '')`)
+	}
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for slug, want := range map[string]int{"visited": 3, "unvisited": 0} {
+		url, err := store.GetURL(slug, true)
+		if err != nil || url == nil {
+			t.Fatalf("%s: got %v and error %v", slug, url, err)
+		}
+		if url.VisitCount != want || len(url.Visits) != want {
+			t.Errorf("%s: got a count of %d and %d visits, want %d", slug, url.VisitCount, len(url.Visits), want)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package stores
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/shu8/linkener/internal/config"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// setUpTestStore - a store of the given type, in a new file
+func setUpTestStore(t *testing.T, storeType string) Store {
+	oldJSONLocation, oldSQLiteLocation := config.Config.JSONStoreLocation, config.Config.SQLiteStoreLocation
+	t.Cleanup(func() {
+		config.Config.JSONStoreLocation = oldJSONLocation
+		config.Config.SQLiteStoreLocation = oldSQLiteLocation
+	})
+	config.Config.JSONStoreLocation = filepath.Join(t.TempDir(), "urls.json")
+	config.Config.SQLiteStoreLocation = filepath.Join(t.TempDir(), "urls.db")
+
+	store, err := StoreFactory(storeType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
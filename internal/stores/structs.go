@@ -4,22 +4,122 @@ import "time"
 
 // Store - interface for all types of URL data storage formats (e.g. JSON/SQLite)
 type Store interface {
-	GetURLs() (*[]ShortURL, error)
-	GetURL(string) (*ShortURL, error)
-	InsertURL(slug, url, password string, allowedVisits int) (*ShortURL, error)
+	GetURLs(withVisits bool) (*[]ShortURL, error)
+	GetURL(slug string, withVisits bool) (*ShortURL, error)
+	GetPrefixURL(path string) (*ShortURL, error)
+	InsertURL(url ShortURL) (*ShortURL, error)
 	DeleteURL(slug string) error
-	UpdateURL(slug, url, password string, allowedVisits int) error
-	RecordVisit(slug, referer string) error
+	TrashURL(slug string) error
+	RestoreURL(slug string) error
+	GetTrashedURLs(withVisits bool) (*[]ShortURL, error)
+	UpdateURL(url ShortURL) error
+	RecordVisits(visits []VisitRecord) error
+	AddRevision(slug string, revision Revision) (*Revision, error)
+	GetRevisions(slug string) (*[]Revision, error)
+	GetVisitRollups(slug string) (*[]VisitRollup, error)
+	CompactVisits(before time.Time) (int, error)
+	PurgeVisits(slug string) error
+	MarkExpiredNotified(slug string) (bool, error)
+}
+
+// Revision - a version of a ShortURL's destination and settings, saved whenever it's created or updated
+type Revision struct {
+	ID             int       `json:"id"`
+	URL            string    `json:"url"`
+	AllowedVisits  int       `json:"allowed_visits"`
+	Password       string    `json:"password"`
+	Editor         string    `json:"editor"`
+	DateCreated    time.Time `json:"date_created"`
+	RolledBackFrom int       `json:"rolled_back_from,omitempty"`
+	// Settings added after revisions were; nil in revisions saved before they were kept, so rolling back leaves them be
+	ForwardQuery *bool          `json:"forward_query,omitempty"`
+	UTM          *UTMParams     `json:"utm,omitempty"`
+	Prefix       *bool          `json:"prefix,omitempty"`
+	Template     *bool          `json:"template,omitempty"`
+	Rules        *[]RoutingRule `json:"rules,omitempty"`
 }
 
 // Visit - global structure for each ShortURL
 type Visit struct {
 	Referer string `json:"referer"`
+	// nil for visits recorded before visit times were
+	Time *time.Time `json:"time,omitempty"`
+	// Hashed in privacy mode; empty if the visitor asked not to be tracked
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	// Bot visits are recorded, but don't count towards visit limits
+	Bot bool `json:"bot,omitempty"`
+	// The UTM parameters the short URL was visited with, if any
+	Campaign *UTMParams `json:"campaign,omitempty"`
+	// The number (from 1) of the routing rule the visit matched; 0 if it was sent to the short URL's own URL
+	Rule int `json:"rule,omitempty"`
+}
+
+// UTMParams - the UTM parameters identifying a marketing campaign
+type UTMParams struct {
+	Source   string `json:"utm_source,omitempty"`
+	Medium   string `json:"utm_medium,omitempty"`
+	Campaign string `json:"utm_campaign,omitempty"`
+	Term     string `json:"utm_term,omitempty"`
+	Content  string `json:"utm_content,omitempty"`
+}
+
+// Empty - whether none of the parameters are set
+func (u UTMParams) Empty() bool {
+	return u == UTMParams{}
+}
+
+// VisitRollup - how many visits (or bot visits) a short URL had on one day (UTC) from one referer, matching one routing
+// rule, once they're too old to keep
+type VisitRollup struct {
+	Date    string `json:"date"`
+	Referer string `json:"referer"`
+	Bot     bool   `json:"bot,omitempty"`
+	Rule    int    `json:"rule,omitempty"`
+	Visits  int    `json:"visits"`
+}
+
+// RoutingRule - a destination for visits matching all of the rule's conditions, instead of the short URL's URL.
+// Conditions that aren't set match every visit
+type RoutingRule struct {
+	URL string `json:"url"`
+	// Operating systems, any of which match: android, ios, windows, macos, linux or chromeos
+	OS []string `json:"os,omitempty"`
+	// Matches user agents containing it, ignoring case
+	UserAgent string `json:"user_agent,omitempty"`
+	// Language tags, any of which match the visitor's preferred language; e.g. "fr" also matches "fr-CA"
+	Languages []string        `json:"languages,omitempty"`
+	Header    *RuleMatch      `json:"header,omitempty"`
+	Query     *RuleMatch      `json:"query,omitempty"`
+	Time      *RuleTimeWindow `json:"time,omitempty"`
+}
+
+// RuleMatch - a request header or query string parameter a routing rule matches, if it has the value (or any value, if
+// it's empty)
+type RuleMatch struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// RuleTimeWindow - the times of day (15:04, from start until before end) and days of the week (mon to sun) a routing
+// rule matches, in the time zone (UTC by default). Windows ending before they start wrap past midnight
+type RuleTimeWindow struct {
+	Start    string   `json:"start,omitempty"`
+	End      string   `json:"end,omitempty"`
+	Days     []string `json:"days,omitempty"`
+	TimeZone string   `json:"time_zone,omitempty"`
+}
+
+// VisitRecord - a visit to record to the short URL with the given slug
+type VisitRecord struct {
+	Slug  string
+	Visit Visit
+	// Only count the visit, without keeping any record of it
+	CountOnly bool
 }
 
 // AddVisit - helper function to record a visit to a short URL
-func (e *ShortURL) AddVisit(referer string) {
-	visit := Visit{Referer: referer}
+func (e *ShortURL) AddVisit(visit Visit) {
 	(*e).Visits = append(e.Visits, visit)
 }
 
@@ -29,6 +129,27 @@ type ShortURL struct {
 	URL           string    `json:"url"`
 	DateCreated   time.Time `json:"date_created"`
 	AllowedVisits int       `json:"allowed_visits"`
-	Visits        []Visit   `json:"visits"`
+	Visits        []Visit   `json:"visits"` // Only loaded when asked for
+	VisitCount    int       `json:"visit_count"`
 	Password      string    `json:"password"`
+	Owner         string    `json:"owner"`
+	Workspace     int64     `json:"workspace"`
+	// Prefix links also match paths starting with their slug and a /, with the rest of the path added to the destination
+	Prefix bool `json:"prefix"`
+	// Templated links' URLs have placeholders filled in from the visit's path, query string or headers
+	Template bool `json:"template"`
+	// Whether to add the query string the short URL is visited with to the destination
+	ForwardQuery bool `json:"forward_query"`
+	// Added to the destination, unless it or the forwarded query string already has them
+	UTM UTMParams `json:"utm"`
+	// Checked in order before visits are sent to URL; the first that matches is used instead
+	Rules []RoutingRule `json:"rules"`
+	// Whether link.expired has been sent since the URL was created or last changed
+	ExpiredNotified bool `json:"expired_notified,omitempty"`
+	// When the URL was moved to the trash; nil if it hasn't been
+	DateDeleted *time.Time `json:"date_deleted,omitempty"`
+	// Only used by stores that keep revisions with the URL; never returned by GetURL(s)
+	Revisions []Revision `json:"revisions,omitempty"`
+	// Only used by stores that keep visit rollups with the URL; never returned by GetURL(s)
+	Rollups []VisitRollup `json:"rollups,omitempty"`
 }
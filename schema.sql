@@ -1,3 +1,5 @@
+-- Initial auth database schema. Later changes are applied by linkener on startup (see internal/db/Db.go)
+
 CREATE TABLE users (
     username TEXT PRIMARY KEY,
     password TEXT